@@ -0,0 +1,105 @@
+package gatt
+
+import "net"
+
+// Bond Management Service UUIDs.
+var (
+	bondMgmtServiceUUID      = UUID16(0x181e)
+	bondMgmtControlPointUUID = UUID16(0x2aa4)
+	bondMgmtFeatureUUID      = UUID16(0x2aa5)
+)
+
+// Bond Management Control Point opcodes. Only the LE variants
+// are supported; this is an LE-only server.
+const (
+	bondMgmtDeleteRequester = 0x03 // delete the bond of the requesting device (LE)
+	bondMgmtDeleteAll       = 0x06 // delete all bonds on the server (LE)
+	bondMgmtDeleteOthers    = 0x09 // delete all bonds but that of the requesting device (LE)
+)
+
+// Bond Management Feature bits, for the supported opcodes.
+const (
+	bondMgmtFeatureDeleteRequester = 1 << 4
+	bondMgmtFeatureDeleteAll       = 1 << 10
+	bondMgmtFeatureDeleteOthers    = 1 << 16
+)
+
+// Bond Management Service application error codes.
+const (
+	bondMgmtEcodeOpNotSupported = 0x80 // the opcode is not supported
+	bondMgmtEcodeOpFailed       = 0x81 // the operation failed
+)
+
+// A BondStore holds the bonds of centrals, such as their long term
+// keys, as stored by the host's Bluetooth stack. Its methods delete
+// bonds on behalf of the Bond Management Service.
+type BondStore interface {
+	// DeleteBond deletes the bond with the central with address addr.
+	DeleteBond(addr net.HardwareAddr) error
+	// DeleteAllBonds deletes all bonds.
+	DeleteAllBonds() error
+	// DeleteOtherBonds deletes all bonds but that with the central
+	// with address keep.
+	DeleteOtherBonds(keep net.HardwareAddr) error
+}
+
+// NewBondManagementService returns a Bond Management Service (0x181E),
+// which lets a connected central delete its own bond, all bonds, or all
+// bonds but its own, via store. This lets a device be reset from a phone
+// app, without physical access. Authorization codes are not supported.
+//
+// Writes to the control point require an encrypted link, as by
+// RequireSecurity(SecurityMedium), so that only a paired central
+// can delete bonds.
+func NewBondManagementService(store BondStore) *Service {
+	svc := &Service{uuid: bondMgmtServiceUUID}
+
+	cp := svc.AddCharacteristic(bondMgmtControlPointUUID)
+	cp.HandleWriteFunc(func(r Request, data []byte) byte {
+		return bondMgmtControl(store, r, data)
+	})
+	cp.props &^= charWriteNR // the control point requires a write response
+	cp.secure &^= charWriteNR
+	cp.RequireSecurity(SecurityMedium)
+
+	features := uint32(bondMgmtFeatureDeleteRequester | bondMgmtFeatureDeleteAll | bondMgmtFeatureDeleteOthers)
+	feat := svc.AddCharacteristic(bondMgmtFeatureUUID)
+	feat.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		resp.Write([]byte{byte(features), byte(features >> 8), byte(features >> 16)})
+	})
+	return svc
+}
+
+// bondMgmtControl performs the Bond Management Control Point
+// operation data, requested by r.
+func bondMgmtControl(store BondStore, r Request, data []byte) (status byte) {
+	if len(data) == 0 {
+		return StatusInvalidValueLength
+	}
+	var addr net.HardwareAddr
+	if r.Conn != nil {
+		addr = r.Conn.RemoteAddr().HardwareAddr
+	}
+
+	var err error
+	switch data[0] {
+	case bondMgmtDeleteRequester:
+		if addr == nil {
+			return bondMgmtEcodeOpFailed
+		}
+		err = store.DeleteBond(addr)
+	case bondMgmtDeleteAll:
+		err = store.DeleteAllBonds()
+	case bondMgmtDeleteOthers:
+		if addr == nil {
+			return bondMgmtEcodeOpFailed
+		}
+		err = store.DeleteOtherBonds(addr)
+	default:
+		return bondMgmtEcodeOpNotSupported
+	}
+	if err != nil {
+		return bondMgmtEcodeOpFailed
+	}
+	return StatusSuccess
+}
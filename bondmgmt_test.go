@@ -0,0 +1,96 @@
+package gatt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// testBondStore records the bond deletions requested of it.
+type testBondStore struct {
+	deleted []string
+	err     error
+}
+
+func (s *testBondStore) DeleteBond(addr net.HardwareAddr) error {
+	s.deleted = append(s.deleted, "bond "+addr.String())
+	return s.err
+}
+
+func (s *testBondStore) DeleteAllBonds() error {
+	s.deleted = append(s.deleted, "all")
+	return s.err
+}
+
+func (s *testBondStore) DeleteOtherBonds(keep net.HardwareAddr) error {
+	s.deleted = append(s.deleted, "all but "+keep.String())
+	return s.err
+}
+
+func TestBondManagementService(t *testing.T) {
+	store := new(testBondStore)
+	svc := NewBondManagementService(store)
+	cp, feat := svc.chars[0], svc.chars[1]
+	if cp.props&charWriteNR != 0 {
+		t.Errorf("control point supports write without response")
+	}
+
+	s := new(Server)
+	hw, _ := net.ParseMAC("01:02:03:04:05:06")
+	s.connected(hw)
+
+	if data, status := s.readChar(feat, hw, 20, 0); status != StatusSuccess || fmt.Sprintf("%x", data) != "100401" {
+		t.Errorf("read features: got %x, %#x want 100401, %#x", data, status, StatusSuccess)
+	}
+
+	cases := []struct {
+		data   []byte
+		status byte
+	}{
+		{data: []byte{bondMgmtDeleteRequester}, status: StatusSuccess},
+		{data: []byte{bondMgmtDeleteAll}, status: StatusSuccess},
+		{data: []byte{bondMgmtDeleteOthers}, status: StatusSuccess},
+		{data: []byte{0x01}, status: bondMgmtEcodeOpNotSupported}, // BR/EDR and LE
+		{data: []byte{}, status: StatusInvalidValueLength},
+	}
+	for _, tt := range cases {
+		if status := s.writeChar(cp, hw, tt.data, false); status != tt.status {
+			t.Errorf("write %x: got status %#x want %#x", tt.data, status, tt.status)
+		}
+	}
+	want := []string{"bond 01:02:03:04:05:06", "all", "all but 01:02:03:04:05:06"}
+	if fmt.Sprint(store.deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted: got %q want %q", store.deleted, want)
+	}
+
+	// A request from a central that is no longer
+	// connected has no requester to delete the bond of.
+	other, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	if status := s.writeChar(cp, other, []byte{bondMgmtDeleteRequester}, false); status != bondMgmtEcodeOpFailed {
+		t.Errorf("delete from disconnected central: got status %#x want %#x", status, bondMgmtEcodeOpFailed)
+	}
+
+	store.err = errors.New("no such bond")
+	if status := s.writeChar(cp, hw, []byte{bondMgmtDeleteRequester}, false); status != bondMgmtEcodeOpFailed {
+		t.Errorf("failed delete: got status %#x want %#x", status, bondMgmtEcodeOpFailed)
+	}
+}
+
+func TestBondManagementSecurity(t *testing.T) {
+	store := new(testBondStore)
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", []*Service{NewBondManagementService(store)})
+	go l2c.listenAndServe()
+
+	// 11: control point value
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "delete all -- not encrypted", send: "120b0006", want: "01120b000f"},
+		{name: "encrypt", event: "security medium"},
+		{name: "delete all", send: "120b0006", want: "13"},
+	})
+	if want := []string{"all"}; fmt.Sprint(store.deleted) != fmt.Sprint(want) {
+		t.Errorf("deleted: got %q want %q", store.deleted, want)
+	}
+}
@@ -11,6 +11,11 @@
 
 #define ATT_CID 4
 
+// LE PHY support, from the Bluetooth 5 spec;
+// not defined by older BlueZ headers.
+#define OCF_LE_SET_PHY 0x0032
+#define EVT_LE_PHY_UPDATE_COMPLETE 0x0C
+
 int lastSignal = 0;
 
 static void signalHandler(int signal) {
@@ -38,6 +43,9 @@ int main(int argc, const char* argv[]) {
 
   char stdinBuf[256 * 2 + 1];
   char l2capSockBuf[256];
+  unsigned char hciEventBuf[HCI_MAX_EVENT_SIZE];
+  struct hci_filter hciFilter;
+  uint8_t lePHYs = 0x01; // LE 1M is always supported
   int len;
   int i;
   struct bt_security btSecurity;
@@ -93,6 +101,34 @@ int main(int argc, const char* argv[]) {
   printf("%02x", daddr.b[0]);
   printf("\n");
 
+  // report the LE PHYs supported by the adapter: bit 0 is 1M, bit 1 is 2M, bit 2 is Coded
+  {
+    le_read_local_supported_features_rp leFeatures;
+    struct hci_request rq;
+
+    memset(&rq, 0, sizeof(rq));
+    rq.ogf = OGF_LE_CTL;
+    rq.ocf = OCF_LE_READ_LOCAL_SUPPORTED_FEATURES;
+    rq.rparam = &leFeatures;
+    rq.rlen = LE_READ_LOCAL_SUPPORTED_FEATURES_RP_SIZE;
+
+    if (hci_send_req(hciSocket, &rq, 1000) == 0 && leFeatures.status == 0) {
+      if (leFeatures.features[1] & 0x01) {
+        lePHYs |= 0x02; // LE 2M PHY, feature bit 8
+      }
+      if (leFeatures.features[1] & 0x08) {
+        lePHYs |= 0x04; // LE Coded PHY, feature bit 11
+      }
+    }
+  }
+  printf("phys %x\n", lePHYs);
+
+  // listen for LE meta events, such as PHY updates
+  hci_filter_clear(&hciFilter);
+  hci_filter_set_ptype(HCI_EVENT_PKT, &hciFilter);
+  hci_filter_set_event(EVT_LE_META_EVENT, &hciFilter);
+  setsockopt(hciSocket, SOL_HCI, HCI_FILTER, &hciFilter, sizeof(hciFilter));
+
   // bind
   memset(&sockAddr, 0, sizeof(sockAddr));
   sockAddr.l2_family = AF_BLUETOOTH;
@@ -137,11 +173,12 @@ int main(int argc, const char* argv[]) {
         FD_ZERO(&rfds);
         FD_SET(0, &rfds);
         FD_SET(clientL2capSock, &rfds);
+        FD_SET(hciSocket, &rfds);
 
         tv.tv_sec = 1;
         tv.tv_usec = 0;
 
-        result = select(clientL2capSock + 1, &rfds, NULL, NULL, &tv);
+        result = select((clientL2capSock > hciSocket ? clientL2capSock : hciSocket) + 1, &rfds, NULL, NULL, &tv);
 
         if (-1 == result) {
           if (SIGINT == lastSignal || SIGKILL == lastSignal) {
@@ -175,15 +212,66 @@ int main(int argc, const char* argv[]) {
               break;
             }
 
-            i = 0;
-            while(stdinBuf[i] != '\n') {
-              unsigned int data = 0;
-              sscanf(&stdinBuf[i], "%02x", &data);
-              l2capSockBuf[i / 2] = data;
-              i += 2;
+            if (strncmp(stdinBuf, "phy ", 4) == 0) {
+              // set preferred PHYs: phy <addr> <tx phys> <rx phys>
+              // only one central is ever connected, so the address is ignored
+              char addrStr[18] = { 0 };
+              unsigned int txPHYs = 0;
+              unsigned int rxPHYs = 0;
+              uint8_t setPHYCmd[7];
+
+              sscanf(stdinBuf, "phy %17s %x %x", addrStr, &txPHYs, &rxPHYs);
+
+              setPHYCmd[0] = hciHandle & 0xff;
+              setPHYCmd[1] = (hciHandle >> 8) & 0xff;
+              setPHYCmd[2] = 0x00; // all phys: we have tx and rx preferences
+              setPHYCmd[3] = txPHYs;
+              setPHYCmd[4] = rxPHYs;
+              setPHYCmd[5] = 0x00; // phy options: no coding preference
+              setPHYCmd[6] = 0x00;
+
+              hci_send_cmd(hciSocket, OGF_LE_CTL, OCF_LE_SET_PHY, sizeof(setPHYCmd), setPHYCmd);
+            } else if (strncmp(stdinBuf, "conn ", 5) == 0) {
+              // name the central to send to: conn <addr>
+              // only one central is ever connected, so there is nothing to do
+            } else if (strncmp(stdinBuf, "disconnect ", 11) == 0) {
+              // disconnect a single central: disconnect <addr>
+              char addrStr[18] = { 0 };
+              bdaddr_t addr;
+              bdaddr_t swappedAddr;
+
+              sscanf(stdinBuf, "disconnect %17s", addrStr);
+              str2ba(addrStr, &addr);
+              baswap(&swappedAddr, &addr); // clientBdAddr is stored swapped; see accept
+
+              // only one central is ever connected
+              if (bacmp(&swappedAddr, &clientBdAddr) == 0) {
+                hci_disconnect(hciSocket, hciHandle, HCI_OE_USER_ENDED_CONNECTION, 1000);
+              }
+            } else {
+              i = 0;
+              while(stdinBuf[i] != '\n') {
+                unsigned int data = 0;
+                sscanf(&stdinBuf[i], "%02x", &data);
+                l2capSockBuf[i / 2] = data;
+                i += 2;
+              }
+
+              len = write(clientL2capSock, l2capSockBuf, (len - 1) / 2);
             }
+          }
+
+          if (FD_ISSET(hciSocket, &rfds)) {
+            len = read(hciSocket, hciEventBuf, sizeof(hciEventBuf));
 
-            len = write(clientL2capSock, l2capSockBuf, (len - 1) / 2);
+            // LE PHY Update Complete: type, event, plen, subevent, status, handle (2), tx phy, rx phy
+            if (len >= 9 && hciEventBuf[0] == HCI_EVENT_PKT && hciEventBuf[1] == EVT_LE_META_EVENT &&
+                hciEventBuf[3] == EVT_LE_PHY_UPDATE_COMPLETE && hciEventBuf[4] == 0 &&
+                (hciEventBuf[5] | (hciEventBuf[6] << 8)) == hciHandle &&
+                hciEventBuf[7] >= 1 && hciEventBuf[7] <= 3 && hciEventBuf[8] >= 1 && hciEventBuf[8] <= 3) {
+              // report PHYs in the same bit format as "phys"
+              printf("phy %x %x\n", 1 << (hciEventBuf[7] - 1), 1 << (hciEventBuf[8] - 1));
+            }
           }
 
           if (FD_ISSET(clientL2capSock, &rfds)) {
@@ -3,6 +3,8 @@ package gatt
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"time"
 )
 
 // Do not re-order the bit flags below;
@@ -10,19 +12,52 @@ import (
 
 // Characteristic property flags.
 const (
-	charRead    = 1 << (iota + 1) // the characteristic may be read
-	charWriteNR                   // the characteristic may be written to, with no reply
-	charWrite                     // the characteristic may be written to, with a reply
-	charNotify                    // the characteristic supports notifications
+	charRead     = 1 << (iota + 1) // the characteristic may be read
+	charWriteNR                    // the characteristic may be written to, with no reply
+	charWrite                      // the characteristic may be written to, with a reply
+	charNotify                     // the characteristic supports notifications
+	charIndicate                   // the characteristic supports indications
 )
 
 // Supported statuses for GATT characteristic read/write operations.
+// They are untyped constants, so that handlers may return them as
+// bytes; convert them to Status to print their names.
 const (
-	StatusSuccess         = attEcodeSuccess
-	StatusInvalidOffset   = attEcodeInvalidOffset
-	StatusUnexpectedError = attEcodeUnlikely
+	StatusSuccess                    = attEcodeSuccess
+	StatusReadNotPermitted           = attEcodeReadNotPerm
+	StatusWriteNotPermitted          = attEcodeWriteNotPerm
+	StatusInsufficientAuthentication = attEcodeAuthentication
+	StatusInvalidOffset              = attEcodeInvalidOffset
+	StatusInsufficientAuthorization  = attEcodeAuthorization
+	StatusInvalidValueLength         = attEcodeInvalAttrValueLen
+	StatusUnexpectedError            = attEcodeUnlikely
+	StatusInsufficientEncryption     = attEcodeInsuffEnc
+	StatusInsufficientResources      = attEcodeInsuffResources
 )
 
+// A Status is an ATT error code, the outcome of a read or write, such
+// as the status returned by a WriteHandler. Its String method returns
+// the code's name in the Bluetooth specification, e.g. "ReadNotPermitted",
+// or its hex value if it is reserved.
+type Status byte
+
+func (s Status) String() string {
+	if s >= attEcodeAppMin && s <= attEcodeAppMax {
+		return fmt.Sprintf("ApplicationError(0x%02x)", byte(s))
+	}
+	return attEcodeName(byte(s))
+}
+
+// ApplicationStatus returns the n'th application-defined status,
+// for errors specific to a service. Its code is 0x80+n.
+// ApplicationStatus panics if n is not in the range [0, 0x1f].
+func ApplicationStatus(n int) Status {
+	if n < 0 || n > attEcodeAppMax-attEcodeAppMin {
+		panic(fmt.Sprintf("gatt: application status %d out of range", n))
+	}
+	return Status(attEcodeAppMin + n)
+}
+
 // A Request is the context for a request from a connected device.
 type Request struct {
 	Server         *Server
@@ -32,12 +67,30 @@ type Request struct {
 }
 
 // A ReadRequest is a characteristic read request from a connected device.
+// The server checks that the offset requested by the central is not past
+// the end of the value: it asks for reads at an offset other than 0 from
+// one byte early, with a Cap one larger, and reports StatusInvalidOffset
+// if the handler returns nothing. Handlers serve the value from Offset
+// as usual; if Offset is past its end, they may return nothing or report
+// StatusInvalidOffset.
 type ReadRequest struct {
 	Request
 	Cap    int // maximum allowed reply length
 	Offset int // request value offset
 }
 
+// A PreparedWrite is a complete write, reassembled from the fragments
+// queued by a central using prepared (reliable) writes.
+type PreparedWrite struct {
+	// Characteristic is the characteristic being written.
+	// For writes to a descriptor, such as the client characteristic
+	// configuration or one added by AddDescriptor, it is the
+	// characteristic that owns the descriptor.
+	Characteristic *Characteristic
+	Handle         uint16 // handle of the attribute being written
+	Value          []byte
+}
+
 type ReadResponseWriter interface {
 	// Write writes data to return as the characteristic value.
 	Write([]byte) (int, error)
@@ -50,6 +103,36 @@ type ReadHandler interface {
 	ServeRead(resp ReadResponseWriter, req *ReadRequest)
 }
 
+// A ReadResult is the result of an asynchronous read.
+type ReadResult struct {
+	Value  []byte // the value, starting at the requested offset
+	Status byte   // StatusSuccess, or the reason that the read failed
+}
+
+// An AsyncReadHandler handles GATT read requests asynchronously. It is
+// meant for values that are slow to obtain, such as values fetched over
+// a network, since reading them synchronously would hold up the server.
+//
+// ServeReadAsync must return promptly. It must send exactly one result
+// on the returned channel, which should be buffered, so that the send
+// never blocks: the server stops waiting for the result after 30s, or
+// if the central disconnects. The value should start at req.Offset;
+// it is truncated to req.Cap.
+type AsyncReadHandler interface {
+	ServeReadAsync(req *ReadRequest) <-chan ReadResult
+}
+
+// AsyncReadHandlerFunc is an adapter to allow the use of
+// ordinary functions as AsyncReadHandlers. If f is a function
+// with the appropriate signature, AsyncReadHandlerFunc(f) is an
+// AsyncReadHandler that calls f.
+type AsyncReadHandlerFunc func(req *ReadRequest) <-chan ReadResult
+
+// ServeReadAsync returns f(req).
+func (f AsyncReadHandlerFunc) ServeReadAsync(req *ReadRequest) <-chan ReadResult {
+	return f(req)
+}
+
 // ReadHandlerFunc is an adapter to allow the use of
 // ordinary functions as ReadHandlers. If f is a function
 // with the appropriate signature, ReadHandlerFunc(f) is a
@@ -107,26 +190,39 @@ type Notifier interface {
 	// receive any more notifications with this notifier.
 	Done() bool
 
+	// Stopped returns a channel that is closed once Done reports
+	// true, when the central unsubscribes or disconnects. It lets
+	// a goroutine that streams data select on it, rather than poll.
+	Stopped() <-chan struct{}
+
 	// Cap returns the maximum number of bytes that may be sent
-	// in a single notification.
+	// in a single notification. It follows changes to the MTU.
 	Cap() int
 }
 
 // A Characteristic is a BLE characteristic.
 type Characteristic struct {
-	uuid     UUID
-	props    uint   // enabled properties
-	secure   uint   // security enabled properties
-	value    []byte // static value; internal use only; TODO: replace with "ValueHandler" instead
-	descs    []*desc
-	valuen   uint16 // handle; set during generateHandles, needed when notifying
-	rhandler ReadHandler
-	whandler WriteHandler
-	nhandler NotifyHandler
+	uuid      UUID
+	props     uint          // enabled properties
+	secure    uint          // security enabled properties
+	security  SecurityLevel // security level required by secure properties; see RequireSecurity
+	value     []byte        // static value; internal use only; TODO: replace with "ValueHandler" instead
+	userDesc  string        // user description; see SetDescription
+	descs     []*desc
+	snapshot  time.Duration // if > 0, long reads are served from a snapshot held this long
+	mustFit   bool          // reads fail if the value does not fit in one PDU
+	dedupe    bool          // skip notifications of unchanged values; see SuppressDuplicateNotifications
+	maxLen    int           // if > 0, the maximum length of written values; see SetMaxLength
+	fixedLen  bool          // written values must be exactly maxLen bytes; see SetFixedLength
+	validate  func(data []byte) (status byte)
+	tooLong   func(valueLen, mtu int)
+	rhandler  ReadHandler
+	arhandler AsyncReadHandler
+	whandler  WriteHandler
+	nhandler  NotifyHandler
 
 	// storage used by other types
-	service  *Service
-	notifier *notifier
+	service *Service
 }
 
 // HandleRead makes the characteristic support read requests,
@@ -136,6 +232,7 @@ func (c *Characteristic) HandleRead(h ReadHandler) {
 	c.props |= charRead
 	c.secure |= charRead
 	c.rhandler = h
+	c.arhandler = nil
 }
 
 // HandleReadFunc calls HandleRead(ReadHandlerFunc(f)).
@@ -143,10 +240,214 @@ func (c *Characteristic) HandleReadFunc(f func(resp ReadResponseWriter, req *Rea
 	c.HandleRead(ReadHandlerFunc(f))
 }
 
+// HandleReadAsync makes the characteristic support read requests,
+// and routes read requests to h, which produces values asynchronously.
+// While h obtains a value, the server continues to process other events,
+// such as disconnects and RSSI updates, but does not answer further
+// requests, since ATT requests are sequential. For example:
+//
+//	c.HandleReadAsync(gatt.AsyncReadHandlerFunc(
+//		func(req *gatt.ReadRequest) <-chan gatt.ReadResult {
+//			resc := make(chan gatt.ReadResult, 1)
+//			go func() {
+//				v, err := fetch() // e.g. from a shared backend
+//				if err != nil || req.Offset > len(v) {
+//					resc <- gatt.ReadResult{Status: gatt.StatusUnexpectedError}
+//					return
+//				}
+//				resc <- gatt.ReadResult{Value: v[req.Offset:]}
+//			}()
+//			return resc
+//		}))
+//
+// Requests that read several values at once, Read Multiple and Find
+// By Type Value, do not read c's value; a Read Multiple that includes
+// it fails with a request-not-supported error.
+//
+// HandleReadAsync replaces any ReadHandler set by HandleRead, and vice
+// versa. It cannot be combined with SnapshotLongReads or MustFitMTU,
+// which read the whole value while blocking other requests; servers
+// fail to start with such characteristics. HandleReadAsync must be
+// called before any server using c has been started.
+func (c *Characteristic) HandleReadAsync(h AsyncReadHandler) {
+	c.props |= charRead
+	c.secure |= charRead
+	c.rhandler = nil
+	c.arhandler = h
+}
+
+// SnapshotLongReads makes long reads of c's value consistent. Centrals
+// read values longer than the MTU allows in pieces, using a sequence of
+// requests at increasing offsets. Ordinarily, each piece is read from
+// c's ReadHandler separately, so a value that changes in the meantime
+// may be read inconsistently. With SnapshotLongReads, a read at offset
+// 0, or at any offset if no sequence is in progress, reads the full value
+// (up to 512 bytes) at once, and the rest of the sequence is served from
+// that snapshot until it has been read in full or timeout elapses.
+// SnapshotLongReads must be called before any server
+// using c has been started.
+func (c *Characteristic) SnapshotLongReads(timeout time.Duration) {
+	c.snapshot = timeout
+}
+
+// MustFitMTU marks c's value as one that centrals must read atomically,
+// in a single PDU. Centrals read values longer than the MTU allows in
+// pieces, which is not atomic. If a read would require that, because
+// the value is too long for the connection's current MTU, the read
+// fails with StatusInvalidValueLength and, if tooLong is non-nil,
+// tooLong is called with the length of the value and the MTU.
+// This helps catch mismatches between value sizes and negotiated MTUs.
+// MustFitMTU must be called before any server using c has been started.
+func (c *Characteristic) MustFitMTU(tooLong func(valueLen, mtu int)) {
+	c.mustFit = true
+	c.tooLong = tooLong
+}
+
+// SuppressDuplicateNotifications makes the server skip notifications
+// of c's value to a central that carry the same data, after truncation
+// to fit the MTU, as the last notification sent to it, sparing it
+// redundant traffic. A central that subscribes again, or reconnects,
+// is always sent the next value. Do not use it for characteristics
+// whose notifications serve as keep-alives or events. Indications
+// are never suppressed.
+// SuppressDuplicateNotifications must be called before any server
+// using c has been started.
+func (c *Characteristic) SuppressDuplicateNotifications() {
+	c.dedupe = true
+}
+
+// SetMaxLength limits the length of values written to c to n bytes.
+// Longer writes, including long writes reassembled from prepared
+// writes, fail with StatusInvalidValueLength without reaching c's
+// WriteHandler. n may not exceed 512, the maximum length of an
+// attribute value, which is also the default limit.
+// SetMaxLength must be called before any server using c has been started.
+func (c *Characteristic) SetMaxLength(n int) {
+	if n < 0 || n > attMaxValueLen {
+		panic(fmt.Sprintf("gatt: invalid max length %d", n))
+	}
+	c.maxLen = n
+}
+
+// SetFixedLength makes values written to c be exactly n bytes long,
+// as for values of a fixed-size type. Writes of any other length,
+// including long writes reassembled from prepared writes, fail with
+// StatusInvalidValueLength without reaching c's WriteHandler.
+// n must be between 1 and 512, the maximum length of an attribute value.
+// SetFixedLength must be called before any server using c has been started.
+func (c *Characteristic) SetFixedLength(n int) {
+	if n < 1 || n > attMaxValueLen {
+		panic(fmt.Sprintf("gatt: invalid fixed length %d", n))
+	}
+	c.maxLen = n
+	c.fixedLen = true
+}
+
+// RequireSecurity makes reads, writes and subscriptions of c's value
+// fail unless the connection's security level is at least level:
+// SecurityMedium requires an encrypted link, and SecurityHigh one
+// encrypted using keys from an authenticated (MITM-protected) pairing.
+// Requests over a less secure link fail with an insufficient encryption
+// or insufficient authentication error respectively, from which the
+// central decides whether to encrypt the link or to pair first.
+// The default, SecurityLow, requires no security.
+// RequireSecurity must be called before any server using c has been started.
+func (c *Characteristic) RequireSecurity(level SecurityLevel) {
+	c.security = level
+}
+
+// SetDescription sets c's user description, a human-readable name
+// such as "Fan speed" that centrals can show in place of c's UUID.
+// If s is not empty, c gets a read-only Characteristic User
+// Description descriptor (0x2901) whose value is s, in UTF-8.
+// s may not be longer than 512 bytes, the maximum length of an
+// attribute value.
+// SetDescription must be called before any server using c has been started.
+func (c *Characteristic) SetDescription(s string) {
+	if len(s) > attMaxValueLen {
+		panic(fmt.Sprintf("gatt: description of %d bytes is too long", len(s)))
+	}
+	c.userDesc = s
+}
+
+// AddDescriptor adds a descriptor with UUID u to c, after any others.
+// Centrals read value, which may not be longer than 512 bytes. If h is
+// not nil, the descriptor is also writable, subject to the security
+// level required by c (see RequireSecurity), and writes to it, including
+// long writes, are routed to h, with c as the Request's Characteristic.
+// Writes do not change the value that centrals read.
+// The client characteristic configuration descriptor (0x2902) is
+// managed by the server, and may not be added.
+// AddDescriptor must be called before any server using c has been started.
+func (c *Characteristic) AddDescriptor(u UUID, value []byte, h WriteHandler) {
+	if uuidEqual(u, gattAttrClientCharacteristicConfigUUID) {
+		panic("gatt: the client characteristic configuration descriptor may not be added")
+	}
+	if len(value) > attMaxValueLen {
+		panic(fmt.Sprintf("gatt: descriptor value of %d bytes is too long", len(value)))
+	}
+	c.descs = append(c.descs, &desc{uuid: u, value: value, char: c, whandler: h})
+}
+
+// ValidateWrite makes c check each value written to it using v before
+// the value reaches c's WriteHandler. If v returns anything other than
+// StatusSuccess, the write fails with that status; v may return an
+// application error code to reject e.g. an out-of-range value.
+// Regular writes are checked as they arrive; long writes, reassembled
+// from prepared writes, are checked when the central executes them,
+// before any of the queued writes is applied.
+// ValidateWrite must be called before any server using c has been started.
+func (c *Characteristic) ValidateWrite(v func(data []byte) (status byte)) {
+	c.validate = v
+}
+
+// maxLength returns the maximum length of values written to c.
+func (c *Characteristic) maxLength() int {
+	if c.maxLen > 0 {
+		return c.maxLen
+	}
+	return attMaxValueLen
+}
+
+// HandleReadAt makes the characteristic support read requests,
+// serving the first size bytes of r as its value. Each read request
+// reads only the portion of the value that it returns, so large values
+// (read in pieces via Read Blob requests) need not be held in memory.
+// HandleReadAt must be called before any server using c has been started.
+func (c *Characteristic) HandleReadAt(r io.ReaderAt, size int64) {
+	c.HandleRead(readerAtHandler{r: r, size: size})
+}
+
+// readerAtHandler is a ReadHandler that serves a value from an io.ReaderAt.
+type readerAtHandler struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func (h readerAtHandler) ServeRead(resp ReadResponseWriter, req *ReadRequest) {
+	off := int64(req.Offset)
+	if off > h.size {
+		resp.SetStatus(StatusInvalidOffset)
+		return
+	}
+	n := h.size - off
+	if n > int64(req.Cap) {
+		n = int64(req.Cap)
+	}
+	b := make([]byte, n)
+	if _, err := h.r.ReadAt(b, off); err != nil && err != io.EOF {
+		resp.SetStatus(StatusUnexpectedError)
+		return
+	}
+	resp.Write(b)
+}
+
 // HandleWrite makes the characteristic support write and
 // write-no-response requests, and routes write requests to h.
 // The WriteHandler does not differentiate between write and
 // write-no-response requests; it is handled automatically.
+// A characteristic with a WriteHandler but no ReadHandler is write-only;
+// centrals that attempt to read it receive a read-not-permitted error.
 // HandleWrite must be called before any server using c has been started.
 func (c *Characteristic) HandleWrite(h WriteHandler) {
 	c.props |= charWrite | charWriteNR
@@ -173,57 +474,130 @@ func (c *Characteristic) HandleNotifyFunc(f func(r Request, n Notifier)) {
 	c.HandleNotify(NotifyHandlerFunc(f))
 }
 
-// TODO: Add Indication support. It should be transparent and appear
-// as a Notify, the way that Write and WriteNR are handled.
+// HandleIndicate makes the characteristic support indications, and
+// routes indication requests to h. Indications are like notifications,
+// except that the central confirms each one; each write to the Notifier
+// blocks until the central has confirmed it. If c also supports
+// notifications, h is used for both, and the central chooses.
+// HandleIndicate must be called before any server using c has been started.
+func (c *Characteristic) HandleIndicate(h NotifyHandler) {
+	c.props |= charIndicate
+	c.secure |= charIndicate
+	c.nhandler = h
+}
+
+// HandleIndicateFunc calls HandleIndicate(NotifyHandlerFunc(f)).
+func (c *Characteristic) HandleIndicateFunc(f func(r Request, n Notifier)) {
+	c.HandleIndicate(NotifyHandlerFunc(f))
+}
+
+// serveRead routes req to c's ReadHandler or, if c has none, to def.
+// If neither is set, the read fails with StatusReadNotPermitted.
+func (c *Characteristic) serveRead(def ReadHandler, resp ReadResponseWriter, req *ReadRequest) {
+	h := c.rhandler
+	if h == nil && c.arhandler != nil {
+		// Wait for the result, but not forever. Reads by
+		// centrals of characteristics with an AsyncReadHandler
+		// don't end up here.
+		var res ReadResult
+		select {
+		case res = <-c.arhandler.ServeReadAsync(req):
+		case <-time.After(attTimeout):
+			res.Status = StatusUnexpectedError
+		}
+		if len(res.Value) > req.Cap {
+			res.Value = res.Value[:req.Cap]
+		}
+		resp.SetStatus(res.Status)
+		resp.Write(res.Value)
+		return
+	}
+	if h == nil {
+		h = def
+	}
+	if h == nil {
+		resp.SetStatus(StatusReadNotPermitted)
+		return
+	}
+	h.ServeRead(resp, req)
+}
+
+// serveWrite routes a write to c's WriteHandler or, if c has none, to def.
+// If neither is set, the write fails with StatusWriteNotPermitted.
+func (c *Characteristic) serveWrite(def WriteHandler, r Request, data []byte) (status byte) {
+	h := c.whandler
+	if h == nil {
+		h = def
+	}
+	if h == nil {
+		return StatusWriteNotPermitted
+	}
+	return h.ServeWrite(r, data)
+}
+
+// serveNotify routes a notification request to c's NotifyHandler, if any.
+func (c *Characteristic) serveNotify(r Request, n Notifier) {
+	if c.nhandler != nil {
+		c.nhandler.ServeNotify(r, n)
+	}
+}
 
 func (c *Characteristic) generateHandles(n uint16) (uint16, []handle) {
 	var h handle
 	var handles []handle
 
 	h = handle{
-		typ:    "characteristic",
-		n:      n,
-		uuid:   c.uuid,
-		props:  c.props,
-		secure: c.secure,
-		attr:   c,
-		startn: n,
-		valuen: n + 1,
+		typ:      "characteristic",
+		n:        n,
+		uuid:     c.uuid,
+		props:    c.props,
+		secure:   c.secure,
+		security: c.security,
+		attr:     c,
+		startn:   n,
+		valuen:   n + 1,
 	}
 	handles = append(handles, h)
 
 	n++
-	c.valuen = n
 	h = handle{
 		typ:   "characteristicValue",
 		uuid:  c.uuid, // copy from the characteristic
 		n:     n,
+		decln: n - 1,
 		value: c.value,
 	}
 	handles = append(handles, h)
 
-	if c.props&charNotify != 0 {
+	if c.props&(charNotify|charIndicate) != 0 {
 		// add ccc (client characteristic configuration) descriptor
 		n++
 		cccn := n
 		secure := uint(0)
 		// If the characteristic requested secure notifications,
 		// then set ccc security to r/w.
-		if c.secure&charNotify != 0 {
+		if c.secure&(charNotify|charIndicate) != 0 {
 			secure = charRead | charWrite
 		}
 		h = handle{
-			typ:    "descriptor",
-			n:      cccn,
-			uuid:   gattAttrClientCharacteristicConfigUUID,
-			attr:   c,
-			props:  charRead | charWrite,
-			secure: secure,
-			value:  []byte{0x00, 0x00},
+			typ:      "descriptor",
+			n:        cccn,
+			uuid:     gattAttrClientCharacteristicConfigUUID,
+			attr:     c,
+			props:    charRead | charWrite,
+			secure:   secure,
+			security: c.security,
+			value:    []byte{0x00, 0x00},
 		}
 		handles = append(handles, h)
 	}
 
+	if c.userDesc != "" {
+		n++
+		d := &desc{uuid: gattAttrCharacteristicUserDescriptionUUID, value: []byte(c.userDesc)}
+		handles = append(handles, d.handle(n))
+	}
+
 	for _, desc := range c.descs {
 		n++
 		handles = append(handles, desc.handle(n))
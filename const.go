@@ -1,5 +1,10 @@
 package gatt
 
+import (
+	"fmt"
+	"time"
+)
+
 // This file includes constants from the BLE spec.
 
 const (
@@ -52,8 +57,37 @@ const (
 	attEcodeInsuffEnc         = 0x0f
 	attEcodeUnsuppGrpType     = 0x10
 	attEcodeInsuffResources   = 0x11
+
+	// Application errors, in the range 0x80-0x9f.
+	attEcodeAppMin     = 0x80
+	attEcodeAppMax     = 0x9f
+	attEcodeDeviceBusy = 0x80 // the server is paused; see Server.Pause
+)
+
+// attMaxValueLen is the maximum length of an attribute value.
+const attMaxValueLen = 512
+
+// attMaxPrepQueueLen is the most prepared write fragments that a
+// connection may queue, which bounds the memory that a central can
+// tie up: fragments are no longer than attMaxValueLen. It allows
+// several maximum length values to be written at the minimum MTU.
+const attMaxPrepQueueLen = 256
+
+// attReadByTypeMaxValueLen is the most of a value that a Read By Type
+// Response can carry: each entry's one-byte length covers the handle too.
+const attReadByTypeMaxValueLen = 0xff - 2
+
+// Link layer data lengths: the maximum payload of an LL data PDU,
+// by default and with the data length extension.
+const (
+	llDefaultDataLen = 27
+	llMaxDataLen     = 251
 )
 
+// attTimeout is the ATT transaction timeout: how long to wait
+// for the response to a request before giving up.
+const attTimeout = 30 * time.Second
+
 // attRespFor maps from att request
 // codes to att response codes.
 var attRespFor = map[byte]byte{
@@ -79,14 +113,120 @@ var (
 	gattAttrIncludeUUID          = UUID16(0x2802)
 	gattAttrCharacteristicUUID   = UUID16(0x2803)
 
-	gattAttrClientCharacteristicConfigUUID = UUID16(0x2902)
-	gattAttrServerCharacteristicConfigUUID = UUID16(0x2903)
+	gattAttrCharacteristicUserDescriptionUUID = UUID16(0x2901)
+	gattAttrClientCharacteristicConfigUUID    = UUID16(0x2902)
+	gattAttrServerCharacteristicConfigUUID    = UUID16(0x2903)
 
-	gattAttrDeviceNameUUID = UUID16(0x2A00)
-	gattAttrAppearanceUUID = UUID16(0x2A01)
+	gattAttrDeviceNameUUID     = UUID16(0x2A00)
+	gattAttrAppearanceUUID     = UUID16(0x2A01)
+	gattAttrServiceChangedUUID = UUID16(0x2A05)
+
+	gattAttrServerSupportedFeaturesUUID = UUID16(0x2B3A)
 )
 
 // https://developer.bluetooth.org/gatt/characteristics/Pages/CharacteristicViewer.aspx?u=org.bluetooth.characteristic.gap.appearance.xml
 var gapCharAppearanceGenericComputer = []byte{0x00, 0x80}
 
-const gattCCCNotifyFlag = 1
+// Att opcode flags.
+const (
+	attOpCommandFlag = 0x40 // the pdu is a command, which gets no response
+	attOpSignedFlag  = 0x80 // the pdu carries an authentication signature
+)
+
+// isCommand reports whether op is a command opcode. Servers
+// never respond to commands, not even with an error.
+func isCommand(op byte) bool {
+	return op&attOpCommandFlag != 0
+}
+
+// isSigned reports whether op is a signed opcode.
+func isSigned(op byte) bool {
+	return op&attOpSignedFlag != 0
+}
+
+// attOpNames maps from att opcodes to their names.
+var attOpNames = map[byte]string{
+	attOpError:           "ErrorResponse",
+	attOpMtuReq:          "ExchangeMTURequest",
+	attOpMtuResp:         "ExchangeMTUResponse",
+	attOpFindInfoReq:     "FindInformationRequest",
+	attOpFindInfoResp:    "FindInformationResponse",
+	attOpFindByTypeReq:   "FindByTypeValueRequest",
+	attOpFindByTypeResp:  "FindByTypeValueResponse",
+	attOpReadByTypeReq:   "ReadByTypeRequest",
+	attOpReadByTypeResp:  "ReadByTypeResponse",
+	attOpReadReq:         "ReadRequest",
+	attOpReadResp:        "ReadResponse",
+	attOpReadBlobReq:     "ReadBlobRequest",
+	attOpReadBlobResp:    "ReadBlobResponse",
+	attOpReadMultiReq:    "ReadMultipleRequest",
+	attOpReadMultiResp:   "ReadMultipleResponse",
+	attOpReadByGroupReq:  "ReadByGroupTypeRequest",
+	attOpReadByGroupResp: "ReadByGroupTypeResponse",
+	attOpWriteReq:        "WriteRequest",
+	attOpWriteResp:       "WriteResponse",
+	attOpWriteCmd:        "WriteCommand",
+	attOpPrepWriteReq:    "PrepareWriteRequest",
+	attOpPrepWriteResp:   "PrepareWriteResponse",
+	attOpExecWriteReq:    "ExecuteWriteRequest",
+	attOpExecWriteResp:   "ExecuteWriteResponse",
+	attOpHandleNotify:    "HandleValueNotification",
+	attOpHandleInd:       "HandleValueIndication",
+	attOpHandleCnf:       "HandleValueConfirmation",
+	attOpSignedWriteCmd:  "SignedWriteCommand",
+}
+
+// attOpName returns the name of the att opcode op,
+// or its hex value if it is unknown.
+func attOpName(op byte) string {
+	if name, ok := attOpNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", op)
+}
+
+// attEcodeNames maps from att error codes to their names.
+var attEcodeNames = map[byte]string{
+	attEcodeSuccess:           "Success",
+	attEcodeInvalidHandle:     "InvalidHandle",
+	attEcodeReadNotPerm:       "ReadNotPermitted",
+	attEcodeWriteNotPerm:      "WriteNotPermitted",
+	attEcodeInvalidPDU:        "InvalidPDU",
+	attEcodeAuthentication:    "InsufficientAuthentication",
+	attEcodeReqNotSupp:        "RequestNotSupported",
+	attEcodeInvalidOffset:     "InvalidOffset",
+	attEcodeAuthorization:     "InsufficientAuthorization",
+	attEcodePrepQueueFull:     "PrepareQueueFull",
+	attEcodeAttrNotFound:      "AttributeNotFound",
+	attEcodeAttrNotLong:       "AttributeNotLong",
+	attEcodeInsuffEncrKeySize: "InsufficientEncryptionKeySize",
+	attEcodeInvalAttrValueLen: "InvalidAttributeValueLength",
+	attEcodeUnlikely:          "UnlikelyError",
+	attEcodeInsuffEnc:         "InsufficientEncryption",
+	attEcodeUnsuppGrpType:     "UnsupportedGroupType",
+	attEcodeInsuffResources:   "InsufficientResources",
+	attEcodeDeviceBusy:        "DeviceBusy",
+}
+
+// attEcodeName returns the name of the att error code ecode,
+// or its hex value if it is unknown, e.g. application-defined.
+func attEcodeName(ecode byte) string {
+	if name, ok := attEcodeNames[ecode]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", ecode)
+}
+
+// Execute Write Request flags.
+const (
+	attExecWriteCancel = 0x00 // cancel all prepared writes
+	attExecWriteCommit = 0x01 // immediately write all pending prepared values
+)
+
+const (
+	gattCCCNotifyFlag   = 1
+	gattCCCIndicateFlag = 2
+)
+
+// Server Supported Features characteristic bits.
+const gattServerFeatureEATT = 1 << 0 // enhanced ATT bearer supported
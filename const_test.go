@@ -0,0 +1,95 @@
+package gatt
+
+import "testing"
+
+func TestAttNames(t *testing.T) {
+	ops := []struct {
+		op   byte
+		want string
+	}{
+		{attOpError, "ErrorResponse"},
+		{attOpReadByTypeReq, "ReadByTypeRequest"},
+		{attOpHandleCnf, "HandleValueConfirmation"},
+		{attOpSignedWriteCmd, "SignedWriteCommand"},
+		{0x7f, "0x7f"},
+	}
+	for _, tt := range ops {
+		if got := attOpName(tt.op); got != tt.want {
+			t.Errorf("attOpName(0x%02x) = %q want %q", tt.op, got, tt.want)
+		}
+	}
+
+	ecodes := []struct {
+		ecode byte
+		want  string
+	}{
+		{attEcodeAuthentication, "InsufficientAuthentication"},
+		{attEcodeAttrNotFound, "AttributeNotFound"},
+		{attEcodeDeviceBusy, "DeviceBusy"},
+		{0x9f, "0x9f"},
+	}
+	for _, tt := range ecodes {
+		if got := attEcodeName(tt.ecode); got != tt.want {
+			t.Errorf("attEcodeName(0x%02x) = %q want %q", tt.ecode, got, tt.want)
+		}
+	}
+
+	for op, want := range map[byte][2]bool{
+		attOpReadReq:        {false, false},
+		attOpWriteReq:       {false, false},
+		attOpWriteCmd:       {true, false},
+		attOpSignedWriteCmd: {true, true},
+		0x7f:                {true, false},
+	} {
+		if got := [2]bool{isCommand(op), isSigned(op)}; got != want {
+			t.Errorf("isCommand, isSigned(%s) = %v want %v", attOpName(op), got, want)
+		}
+	}
+
+	e := attErr{opcode: attOpReadReq, handle: 0x0b, status: attEcodeAuthentication}
+	if got, want := e.String(), "ReadRequest handle 0x000b: InsufficientAuthentication"; got != want {
+		t.Errorf("attErr.String() = %q want %q", got, want)
+	}
+}
+
+func TestStatusString(t *testing.T) {
+	for s, want := range map[Status]string{
+		StatusSuccess:                    "Success",
+		0x01:                             "InvalidHandle",
+		StatusReadNotPermitted:           "ReadNotPermitted",
+		StatusWriteNotPermitted:          "WriteNotPermitted",
+		0x04:                             "InvalidPDU",
+		StatusInsufficientAuthentication: "InsufficientAuthentication",
+		0x06:                             "RequestNotSupported",
+		StatusInvalidOffset:              "InvalidOffset",
+		StatusInsufficientAuthorization:  "InsufficientAuthorization",
+		0x09:                             "PrepareQueueFull",
+		0x0a:                             "AttributeNotFound",
+		0x0b:                             "AttributeNotLong",
+		0x0c:                             "InsufficientEncryptionKeySize",
+		StatusInvalidValueLength:         "InvalidAttributeValueLength",
+		StatusUnexpectedError:            "UnlikelyError",
+		StatusInsufficientEncryption:     "InsufficientEncryption",
+		0x10:                             "UnsupportedGroupType",
+		StatusInsufficientResources:      "InsufficientResources",
+		0x12:                             "0x12",
+		ApplicationStatus(0):             "ApplicationError(0x80)",
+		ApplicationStatus(0x1f):          "ApplicationError(0x9f)",
+		0xa0:                             "0xa0",
+	} {
+		if got := s.String(); got != want {
+			t.Errorf("Status(0x%02x).String() = %q want %q", byte(s), got, want)
+		}
+	}
+
+	for _, n := range []int{-1, 0x20} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("ApplicationStatus(%d) did not panic", n)
+				}
+			}()
+			ApplicationStatus(n)
+		}()
+	}
+}
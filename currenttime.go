@@ -0,0 +1,69 @@
+package gatt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Adjust reasons for the Current Time characteristic (0x2A2B).
+// They may be combined.
+const (
+	CurrentTimeManualUpdate      = 1 << 0 // the time was set manually
+	CurrentTimeExternalReference = 1 << 1 // the time was set from an external reference, e.g. GPS
+	CurrentTimeZoneChange        = 1 << 2 // the time zone changed
+	CurrentTimeDSTChange         = 1 << 3 // daylight saving time changed
+)
+
+// currentTimeLen is the length of an encoded Current Time value.
+const currentTimeLen = 10
+
+// EncodeCurrentTime encodes t as a Current Time characteristic (0x2A2B)
+// value, as defined by the Current Time Service. The value carries no
+// time zone; the wall clock time of t in its own location is encoded.
+// reason is a combination of the CurrentTime* adjust reasons, or 0.
+// The year is encoded as 0 (unknown) if it falls outside [1582,9999].
+func EncodeCurrentTime(t time.Time, reason uint8) []byte {
+	b := make([]byte, currentTimeLen)
+	if year := t.Year(); year >= 1582 && year <= 9999 {
+		binary.LittleEndian.PutUint16(b, uint16(year))
+	}
+	b[2] = byte(t.Month())
+	b[3] = byte(t.Day())
+	b[4] = byte(t.Hour())
+	b[5] = byte(t.Minute())
+	b[6] = byte(t.Second())
+	// Day of week runs from 1 (Monday) to 7 (Sunday).
+	b[7] = byte((int(t.Weekday())+6)%7 + 1)
+	// Fractions of a second, in units of 1/256 s.
+	b[8] = byte(t.Nanosecond() * 256 / int(time.Second))
+	b[9] = reason
+	return b
+}
+
+// DecodeCurrentTime decodes a Current Time characteristic (0x2A2B) value,
+// as encoded by EncodeCurrentTime, interpreting it as a wall clock time
+// in loc. The encoded day of week is ignored, since it is implied by the
+// date. DecodeCurrentTime returns an error if the date is unknown or
+// any field is out of range.
+func DecodeCurrentTime(b []byte, loc *time.Location) (t time.Time, reason uint8, err error) {
+	if len(b) != currentTimeLen {
+		return time.Time{}, 0, fmt.Errorf("invalid current time length %d, want %d", len(b), currentTimeLen)
+	}
+	year := int(binary.LittleEndian.Uint16(b))
+	month, day := int(b[2]), int(b[3])
+	hour, min, sec := int(b[4]), int(b[5]), int(b[6])
+	if year == 0 || month == 0 || day == 0 {
+		return time.Time{}, 0, errors.New("current time date unknown")
+	}
+	if year < 1582 || year > 9999 || month > 12 || day > 31 || hour > 23 || min > 59 || sec > 59 || b[7] > 7 {
+		return time.Time{}, 0, fmt.Errorf("invalid current time %x", b)
+	}
+	nsec := int(b[8]) * int(time.Second) / 256
+	t = time.Date(year, time.Month(month), day, hour, min, sec, nsec, loc)
+	if t.Day() != day {
+		return time.Time{}, 0, fmt.Errorf("invalid current time date %d-%02d-%02d", year, month, day)
+	}
+	return t, b[9], nil
+}
@@ -0,0 +1,59 @@
+package gatt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestCurrentTime(t *testing.T) {
+	cases := []struct {
+		t      time.Time
+		reason uint8
+		enc    string
+	}{
+		// Thursday, 3 April 2014, 15:04:05.5; manual update
+		{t: time.Date(2014, 4, 3, 15, 4, 5, 500000000, time.UTC), reason: CurrentTimeManualUpdate, enc: "de0704030f0405048001"},
+		// Sunday, 31 December 2023, 23:59:59; time zone and DST change
+		{t: time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC), reason: CurrentTimeZoneChange | CurrentTimeDSTChange, enc: "e7070c1f173b3b07000c"},
+		// Monday, 1 January 2024, 00:00:00.25; no reason
+		{t: time.Date(2024, 1, 1, 0, 0, 0, 250000000, time.UTC), reason: 0, enc: "e8070101000000014000"},
+	}
+
+	for _, tt := range cases {
+		want, _ := hex.DecodeString(tt.enc)
+		got := EncodeCurrentTime(tt.t, tt.reason)
+		if !bytes.Equal(got, want) {
+			t.Errorf("EncodeCurrentTime(%v, %#x): got %x want %x", tt.t, tt.reason, got, want)
+		}
+
+		dt, reason, err := DecodeCurrentTime(want, time.UTC)
+		if err != nil {
+			t.Errorf("DecodeCurrentTime(%x): %v", want, err)
+			continue
+		}
+		if !dt.Equal(tt.t) || reason != tt.reason {
+			t.Errorf("DecodeCurrentTime(%x): got %v, %#x want %v, %#x", want, dt, reason, tt.t, tt.reason)
+		}
+	}
+}
+
+func TestDecodeCurrentTimeInvalid(t *testing.T) {
+	cases := []string{
+		"de0704030f04050480",     // short
+		"de0704030f040504800100", // long
+		"000004030f0405048001",   // unknown year
+		"de0700030f0405048001",   // unknown month
+		"de070d030f0405048001",   // month 13
+		"de07021e0f0405048001",   // 30 February
+		"de070403180405048001",   // hour 24
+		"de0704030f0405088001",   // day of week 8
+	}
+	for _, tt := range cases {
+		b, _ := hex.DecodeString(tt)
+		if _, _, err := DecodeCurrentTime(b, time.UTC); err == nil {
+			t.Errorf("DecodeCurrentTime(%x): got nil error", b)
+		}
+	}
+}
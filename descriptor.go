@@ -1,12 +1,14 @@
 package gatt
 
 type desc struct {
-	uuid  UUID
-	value []byte // static value
+	uuid     UUID
+	value    []byte          // static value
+	char     *Characteristic // owning characteristic; set by AddDescriptor
+	whandler WriteHandler    // if not nil, the descriptor is writable
 }
 
 func (d *desc) handle(n uint16) handle {
-	return handle{
+	h := handle{
 		typ:    "descriptor",
 		n:      n,
 		uuid:   d.uuid,
@@ -15,6 +17,12 @@ func (d *desc) handle(n uint16) handle {
 		secure: 0,
 		value:  d.value,
 	}
+	if d.whandler != nil {
+		h.props |= charWrite
+		h.secure = charWrite
+		h.security = d.char.security
+	}
+	return h
 }
 
 func (d *desc) UUID() UUID {
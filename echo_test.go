@@ -0,0 +1,75 @@
+package gatt
+
+import (
+	"sync"
+	"testing"
+)
+
+var (
+	echoServiceUUID = MustParseUUID("4e6f7465-6563-686f-0000-000000000000")
+	echoCharUUID    = MustParseUUID("4e6f7465-6563-686f-0000-000000000001")
+)
+
+// newEchoService returns a service with a single characteristic that
+// may be read, written, and subscribed to. Reads return the most
+// recently written value, and each write notifies a subscribed central
+// of the new value before the write is acknowledged. It is a canonical
+// target for exercising the full read/write/notify machinery.
+func newEchoService() *Service {
+	svc := &Service{uuid: echoServiceUUID}
+	char := svc.AddCharacteristic(echoCharUUID)
+
+	var mu sync.Mutex
+	var value []byte
+	var notifier Notifier
+
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Offset > len(value) {
+			resp.SetStatus(StatusInvalidOffset)
+			return
+		}
+		v := value[req.Offset:]
+		if len(v) > req.Cap {
+			v = v[:req.Cap]
+		}
+		resp.Write(v)
+	})
+	char.HandleWriteFunc(func(r Request, data []byte) byte {
+		mu.Lock()
+		value = append([]byte(nil), data...)
+		n := notifier
+		mu.Unlock()
+		if n != nil && !n.Done() {
+			n.Write(data)
+		}
+		return StatusSuccess
+	})
+	char.HandleNotifyFunc(func(r Request, n Notifier) {
+		mu.Lock()
+		notifier = n
+		mu.Unlock()
+	})
+	return svc
+}
+
+func TestEcho(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", []*Service{newEchoService()})
+	go l2c.listenAndServe()
+
+	// echo service [9,12]: 10: characteristic, 11: value, 12: ccc
+	runRxTx(t, shim, []rxtx{
+		{name: "read -- empty", send: "0a0b00", want: "0b"},
+		{name: "write 'abc' -- ok", send: "120b00616263", want: "13"},
+		{name: "read -- 'abc'", send: "0a0b00", want: "0b616263"},
+		{name: "read blob at 1 -- 'bc'", send: "0c0b000100", want: "0d6263"},
+		{name: "subscribe -- ok", send: "120c000100", want: "13"},
+		{name: "write 'xyz' -- notified 'xyz'", send: "120b0078797a", want: "1b0b0078797a"},
+		{name: "-- write ok", want: "13"},
+		{name: "unsubscribe -- ok", send: "120c000000", want: "13"},
+		{name: "write 'q' -- ok, not notified", send: "120b0071", want: "13"},
+		{name: "read -- 'q'", send: "0a0b00", want: "0b71"},
+	})
+}
@@ -0,0 +1,112 @@
+package gatt
+
+import "sync"
+
+// An EventStream is a NotifyHandler that streams events, such as log
+// lines or sensor readings, to subscribed centrals. It holds the most
+// recent events in a bounded buffer and, if Replay is set, sends them
+// to each new subscriber before any new events, so that the subscriber
+// catches up on what it missed. Use it with Characteristic.HandleNotify.
+//
+// Each event is sent as a single notification, truncated as needed to
+// fit. If a subscriber falls behind, such that more events are pending
+// for it than the buffer holds, the oldest pending events are dropped.
+type EventStream struct {
+	// Replay makes new subscribers receive the buffered events first.
+	// Replay must be set, if at all, before the stream is in use.
+	Replay bool
+
+	mu    sync.Mutex
+	depth int
+	buf   [][]byte // most recent events, oldest first
+	subs  map[*eventSubscriber]bool
+}
+
+// NewEventStream returns an EventStream that buffers up to depth events.
+func NewEventStream(depth int) *EventStream {
+	if depth < 1 {
+		depth = 1
+	}
+	return &EventStream{depth: depth, subs: make(map[*eventSubscriber]bool)}
+}
+
+// An eventSubscriber is a subscription to an EventStream.
+type eventSubscriber struct {
+	n       Notifier
+	pending [][]byte      // events yet to be sent, oldest first; guarded by the stream's mu
+	wake    chan struct{} // signalled when events are added to pending
+}
+
+// Push adds event to the stream, buffering it and sending it to all
+// subscribers. Push does not block waiting for events to be sent.
+func (s *EventStream) Push(event []byte) {
+	event = append([]byte(nil), event...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = appendBounded(s.buf, event, s.depth)
+	for sub := range s.subs {
+		sub.pending = appendBounded(sub.pending, event, s.depth)
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ServeNotify subscribes n to the stream.
+func (s *EventStream) ServeNotify(r Request, n Notifier) {
+	sub := &eventSubscriber{n: n, wake: make(chan struct{}, 1)}
+	s.mu.Lock()
+	if s.Replay && len(s.buf) > 0 {
+		sub.pending = append(sub.pending, s.buf...)
+		sub.wake <- struct{}{}
+	}
+	s.subs[sub] = true
+	s.mu.Unlock()
+	go s.serve(sub)
+}
+
+// serve sends pending events to sub until the central unsubscribes.
+func (s *EventStream) serve(sub *eventSubscriber) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, sub)
+		s.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-sub.wake:
+		case <-sub.n.Stopped():
+			return
+		}
+		for {
+			s.mu.Lock()
+			if len(sub.pending) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			event := sub.pending[0]
+			sub.pending = sub.pending[1:]
+			s.mu.Unlock()
+
+			if sub.n.Done() {
+				return
+			}
+			if len(event) > sub.n.Cap() {
+				event = event[:sub.n.Cap()]
+			}
+			if _, err := sub.n.Write(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// appendBounded appends event to events,
+// dropping the oldest events to keep at most depth.
+func appendBounded(events [][]byte, event []byte, depth int) [][]byte {
+	if len(events) >= depth {
+		events = append(events[:0:0], events[len(events)-depth+1:]...)
+	}
+	return append(events, event)
+}
@@ -0,0 +1,130 @@
+package gatt
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A testNotifier is a Notifier that records what it sends.
+type testNotifier struct {
+	mu      sync.Mutex
+	sent    []string
+	done    bool
+	c       chan string   // receives each notification sent
+	stopped chan struct{} // closed by stop
+}
+
+func newTestNotifier() *testNotifier {
+	return &testNotifier{c: make(chan string, 100), stopped: make(chan struct{})}
+}
+
+func (n *testNotifier) Write(data []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.done {
+		return 0, errors.New("done")
+	}
+	n.sent = append(n.sent, string(data))
+	n.c <- string(data)
+	return len(data), nil
+}
+
+func (n *testNotifier) Done() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.done
+}
+
+func (n *testNotifier) Stopped() <-chan struct{} { return n.stopped }
+
+func (n *testNotifier) Cap() int { return 5 }
+
+func (n *testNotifier) stop() {
+	n.mu.Lock()
+	if !n.done {
+		n.done = true
+		close(n.stopped)
+	}
+	n.mu.Unlock()
+}
+
+// expect checks that n sends want, in order.
+func (n *testNotifier) expect(t *testing.T, name string, want ...string) {
+	for _, w := range want {
+		select {
+		case got := <-n.c:
+			if got != w {
+				t.Errorf("%s: got notification %q want %q", name, got, w)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: timed out waiting for notification %q", name, w)
+			return
+		}
+	}
+	select {
+	case got := <-n.c:
+		t.Errorf("%s: got unexpected notification %q", name, got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	for _, replay := range []bool{false, true} {
+		s := NewEventStream(2)
+		s.Replay = replay
+		s.Push([]byte("a"))
+		s.Push([]byte("b"))
+		s.Push([]byte("c"))
+
+		n := newTestNotifier()
+		s.ServeNotify(Request{}, n)
+		if replay {
+			n.expect(t, "replay", "b", "c")
+		} else {
+			n.expect(t, "no replay")
+		}
+
+		s.Push([]byte("d"))
+		s.Push([]byte("truncated"))
+		n.expect(t, "new events", "d", "trunc")
+
+		n.stop()
+		s.Push([]byte("e"))
+		n.expect(t, "after unsubscribe")
+	}
+}
+
+func TestEventStreamUnsubscribe(t *testing.T) {
+	s := NewEventStream(2)
+	n := newTestNotifier()
+	s.ServeNotify(Request{}, n)
+
+	// The subscriber goes once the central unsubscribes,
+	// without waiting for another event.
+	n.stop()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		subs := len(s.subs)
+		s.mu.Unlock()
+		if subs == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriber still serving after unsubscribe")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAppendBounded(t *testing.T) {
+	var events [][]byte
+	for _, e := range []string{"a", "b", "c", "d"} {
+		events = appendBounded(events, []byte(e), 3)
+	}
+	if len(events) != 3 || string(events[0]) != "b" || string(events[2]) != "d" {
+		t.Errorf("appendBounded: got %q want [b c d]", events)
+	}
+}
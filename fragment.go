@@ -0,0 +1,130 @@
+package gatt
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// fragmentHeaderLen is the length of the header of each fragment
+// handled by Reassemble: the fragment index and the total number
+// of fragments, each a little-endian uint16.
+const fragmentHeaderLen = 4
+
+// reassembleMaxBuffered is the most payload data, in bytes, that a
+// reassembler buffers at once, across all connections.
+const reassembleMaxBuffered = 1 << 20
+
+// Reassemble returns a WriteHandler that reassembles payloads that
+// centrals send as a series of fragments, typically using Write Commands
+// (write without response), and passes each complete payload to h.
+//
+// Each write carries one fragment: a 4 byte header followed by a piece
+// of the payload. The header holds the index of the fragment, starting
+// at 0, and the total number of fragments in the payload, each encoded
+// as a little-endian uint16. Fragments may arrive in any order; a
+// repeated fragment replaces the earlier copy. Once all have arrived,
+// their pieces are concatenated in index order and delivered to h.
+//
+// If a payload is not complete within timeout of its first fragment,
+// or a fragment with a different total arrives, the incomplete payload
+// is discarded. Payloads are reassembled separately for each Conn;
+// writes without a Conn fail with StatusUnexpectedError. At most 1 MiB
+// of incomplete payloads is buffered; a fragment that would exceed that
+// fails with StatusInsufficientResources, discarding its payload.
+//
+// Writes of incomplete payloads succeed; the write that completes a
+// payload returns h's status. Malformed fragments are discarded, and
+// fail with StatusUnexpectedError.
+func Reassemble(h WriteHandler, timeout time.Duration) WriteHandler {
+	return &reassembler{
+		h:        h,
+		timeout:  timeout,
+		payloads: make(map[Conn]*partialPayload),
+		max:      reassembleMaxBuffered,
+		now:      time.Now,
+	}
+}
+
+type reassembler struct {
+	h       WriteHandler
+	timeout time.Duration
+
+	mu       sync.Mutex
+	payloads map[Conn]*partialPayload // payloads being reassembled, by connection
+	buffered int                      // total size of the fragments in payloads
+	max      int                      // the most that may be buffered; replaceable for testing
+
+	now func() time.Time // the current time; replaceable for testing
+}
+
+// A partialPayload is a payload whose fragments have not all arrived.
+type partialPayload struct {
+	total   uint16
+	frags   map[uint16][]byte // fragments received, by index
+	size    int               // total size of frags
+	expires time.Time
+}
+
+func (r *reassembler) ServeWrite(req Request, data []byte) (status byte) {
+	if len(data) < fragmentHeaderLen {
+		return StatusUnexpectedError
+	}
+	index := binary.LittleEndian.Uint16(data)
+	total := binary.LittleEndian.Uint16(data[2:])
+	if index >= total || req.Conn == nil {
+		return StatusUnexpectedError
+	}
+	frag := data[fragmentHeaderLen:]
+
+	r.mu.Lock()
+	now := r.now()
+	for c, p := range r.payloads {
+		if now.After(p.expires) {
+			r.discard(c)
+		}
+	}
+	p := r.payloads[req.Conn]
+	if p != nil && p.total != total {
+		r.discard(req.Conn)
+		p = nil
+	}
+	if p == nil {
+		// Start a new payload.
+		p = &partialPayload{
+			total:   total,
+			frags:   make(map[uint16][]byte),
+			expires: now.Add(r.timeout),
+		}
+		r.payloads[req.Conn] = p
+	}
+	grow := len(frag) - len(p.frags[index])
+	if r.buffered+grow > r.max {
+		r.discard(req.Conn)
+		r.mu.Unlock()
+		return StatusInsufficientResources
+	}
+	p.frags[index] = append([]byte(nil), frag...)
+	p.size += grow
+	r.buffered += grow
+	if len(p.frags) < int(p.total) {
+		r.mu.Unlock()
+		return StatusSuccess
+	}
+	r.discard(req.Conn)
+	r.mu.Unlock()
+
+	var payload []byte
+	for i := uint16(0); i < p.total; i++ {
+		payload = append(payload, p.frags[i]...)
+	}
+	return r.h.ServeWrite(req, payload)
+}
+
+// discard forgets the payload being reassembled for c. r.mu must be held.
+func (r *reassembler) discard(c Conn) {
+	if p, ok := r.payloads[c]; ok {
+		r.buffered -= p.size
+		delete(r.payloads, c)
+	}
+}
@@ -0,0 +1,102 @@
+package gatt
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestReassemble(t *testing.T) {
+	var delivered []string
+	h := Reassemble(WriteHandlerFunc(func(r Request, data []byte) byte {
+		delivered = append(delivered, string(data))
+		return StatusSuccess
+	}), time.Second)
+	r := h.(*reassembler)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+
+	cases := []struct {
+		name    string
+		frag    string // hex
+		advance time.Duration
+		status  byte
+		want    string // payload delivered, if any
+	}{
+		{name: "single fragment", frag: "00000100" + "616263", want: "abc"},
+		{name: "1 of 3", frag: "01000300" + "6465"},
+		{name: "2 of 3", frag: "02000300" + "66"},
+		{name: "1 of 3, repeated", frag: "01000300" + "4445"},
+		{name: "0 of 3 -- complete", frag: "00000300" + "6162", want: "abDEf"},
+		{name: "0 of 2", frag: "00000200" + "78"},
+		{name: "1 of 2, too late", frag: "01000200" + "79", advance: 2 * time.Second},
+		{name: "0 of 2, again -- complete", frag: "00000200" + "78", want: "xy"},
+		{name: "0 of 2", frag: "00000200" + "78"},
+		{name: "0 of 3 -- discards the incomplete payload", frag: "00000300" + "61"},
+		{name: "1 of 2, incomplete payload was discarded", frag: "01000200" + "79"},
+		{name: "index out of range", frag: "02000200" + "61", status: StatusUnexpectedError},
+		{name: "short header", frag: "000001", status: StatusUnexpectedError},
+	}
+
+	req := Request{Conn: &conn{}}
+	for _, tt := range cases {
+		delivered = nil
+		now = now.Add(tt.advance)
+		frag, _ := hex.DecodeString(tt.frag)
+		if status := h.ServeWrite(req, frag); status != tt.status {
+			t.Errorf("%s: got status %#x want %#x", tt.name, status, tt.status)
+		}
+		var want []string
+		if tt.want != "" {
+			want = []string{tt.want}
+		}
+		if len(delivered) != len(want) || len(want) > 0 && delivered[0] != want[0] {
+			t.Errorf("%s: delivered %q want %q", tt.name, delivered, want)
+		}
+	}
+}
+
+func TestReassembleLimits(t *testing.T) {
+	h := Reassemble(WriteHandlerFunc(func(r Request, data []byte) byte { return StatusSuccess }), time.Second)
+	r := h.(*reassembler)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	r.max = 8
+	a, b := Request{Conn: &conn{}}, Request{Conn: &conn{}}
+	write := func(req Request, frag string) byte {
+		b, _ := hex.DecodeString(frag)
+		return h.ServeWrite(req, b)
+	}
+
+	if status := write(Request{}, "00000100"+"61"); status != StatusUnexpectedError {
+		t.Errorf("write without a Conn: got status %#x want %#x", status, StatusUnexpectedError)
+	}
+
+	// Expired payloads are swept out by writes from any connection.
+	write(a, "00000200"+"6162")
+	now = now.Add(2 * time.Second)
+	write(b, "00000200"+"6162")
+	if len(r.payloads) != 1 || r.buffered != 2 {
+		t.Errorf("after a's payload expired: got %d payloads, %d bytes want 1, 2", len(r.payloads), r.buffered)
+	}
+
+	// At most r.max bytes are buffered across connections.
+	if status := write(a, "00000200"+"616263"); status != StatusSuccess {
+		t.Errorf("a: 3 bytes: got status %#x want success", status)
+	}
+	if status := write(a, "00000200"+"6162636465"); status != StatusSuccess {
+		t.Errorf("a: 5 byte fragment replacing 3: got status %#x want success", status)
+	}
+	if status := write(b, "01000300"+"61"); status != StatusSuccess {
+		t.Errorf("b: new payload: got status %#x want success", status)
+	}
+	if status := write(a, "01000200"+"616263"); status != StatusInsufficientResources {
+		t.Errorf("a: over the limit: got status %#x want %#x", status, StatusInsufficientResources)
+	}
+	if len(r.payloads) != 1 || r.buffered != 1 {
+		t.Errorf("after a's payload was discarded: got %d payloads, %d bytes want 1, 1", len(r.payloads), r.buffered)
+	}
+	if status := write(b, "00000300"+"6162"); status != StatusSuccess {
+		t.Errorf("b: within the limit again: got status %#x want success", status)
+	}
+}
@@ -1,5 +1,7 @@
 package gatt
 
+import "fmt"
+
 // handle is a BLE handle. It is not exported;
 // managing handles is an implementation detail.
 // TODO: The organization of this is borrowed
@@ -8,16 +10,18 @@ package gatt
 // tighter and more typesafe with a bit of effort,
 // once some l2cap unit tests are in place.
 type handle struct {
-	n      uint16 // gatt handle number
-	startn uint16
-	valuen uint16
-	endn   uint16
-	typ    string
-	uuid   UUID
-	attr   interface{}
-	props  uint
-	secure uint
-	value  []byte
+	n        uint16 // gatt handle number
+	startn   uint16
+	valuen   uint16 // for characteristic declarations, the value handle
+	decln    uint16 // for characteristic values, the declaration handle
+	endn     uint16
+	typ      string
+	uuid     UUID
+	attr     interface{}
+	props    uint
+	secure   uint          // properties that require security
+	security SecurityLevel // the security level they require
+	value    []byte
 }
 
 // isPrimaryService reports whether this handle is
@@ -38,8 +42,38 @@ func (h handle) isDescriptor(uuid UUID) bool {
 	return h.typ == "descriptor" && uuidEqual(uuid, h.uuid)
 }
 
-func generateHandles(name string, svcs []*Service, base uint16) *handleRange {
-	svcs = append(defaultServices(name), svcs...)
+// owner returns the characteristic that owns the attribute of this
+// handle, if it is a characteristic or one of its descriptors.
+func (h handle) owner() *Characteristic {
+	switch a := h.attr.(type) {
+	case *Characteristic:
+		return a
+	case *desc:
+		return a.char
+	}
+	return nil
+}
+
+// attrType returns the attribute type of this handle,
+// as reported to centrals, if it has one.
+func (h handle) attrType() (uuid UUID, ok bool) {
+	switch h.typ {
+	case "service":
+		return gattAttrPrimaryServiceUUID, true
+	case "includedService":
+		return gattAttrSecondaryServiceUUID, true
+	case "include":
+		return gattAttrIncludeUUID, true
+	case "characteristic":
+		return gattAttrCharacteristicUUID, true
+	case "characteristicValue", "descriptor":
+		return h.uuid, true
+	}
+	return UUID{}, false
+}
+
+func generateHandles(name string, features byte, svcChanged *Characteristic, svcs []*Service, base uint16) *handleRange {
+	svcs = append(defaultServices(name, features, svcChanged), svcs...)
 	handles := make([]handle, 0)
 	n := base
 
@@ -48,11 +82,44 @@ func generateHandles(name string, svcs []*Service, base uint16) *handleRange {
 		n, hh = svc.generateHandles(n)
 		handles = append(handles, hh...)
 	}
+	setIncludeValues(handles)
 
 	return &handleRange{hh: handles, base: base}
 }
 
-func defaultServices(name string) []*Service {
+// setIncludeValues sets the values of the include declarations in
+// handles: the included service's handle range, followed by its UUID
+// if it is a 16-bit UUID. Includes of services that are not in handles
+// are left without a value, for validate to reject.
+func setIncludeValues(handles []handle) {
+	ranges := make(map[*Service][2]uint16)
+	for _, h := range handles {
+		if h.typ == "service" {
+			ranges[h.attr.(*Service)] = [2]uint16{h.startn, h.endn}
+		}
+	}
+	for i, h := range handles {
+		if h.typ != "include" {
+			continue
+		}
+		r, ok := ranges[h.attr.(*Service)]
+		if !ok {
+			continue
+		}
+		v := []byte{byte(r[0]), byte(r[0] >> 8), byte(r[1]), byte(r[1] >> 8)}
+		if h.uuid.Len() == 2 {
+			v = append(v, h.uuid.reverseBytes()...)
+		}
+		handles[i].value = v
+	}
+}
+
+// defaultServices returns the Generic Access and Generic Attribute
+// services. features is the value of the GATT service's Server
+// Supported Features characteristic; see gattServerFeature*.
+// svcChanged, if not nil, is the GATT service's Service Changed
+// characteristic; see newServiceChanged.
+func defaultServices(name string, features byte, svcChanged *Characteristic) []*Service {
 	gapService := &Service{
 		uuid: gatAttrGAPUUID,
 		chars: []*Characteristic{
@@ -71,10 +138,58 @@ func defaultServices(name string) []*Service {
 		},
 	}
 
-	gattService := &Service{uuid: gatAttrGATTUUID}
+	gattService := &Service{
+		uuid: gatAttrGATTUUID,
+		chars: []*Characteristic{
+			&Characteristic{
+				uuid:   gattAttrServerSupportedFeaturesUUID,
+				props:  charRead,
+				secure: charRead,
+				value:  []byte{features},
+			},
+		},
+	}
+	if svcChanged != nil {
+		gattService.chars = append([]*Characteristic{svcChanged}, gattService.chars...)
+	}
 	return []*Service{gapService, gattService}
 }
 
+// newServiceChanged returns a Service Changed characteristic,
+// whose indications are sent by the l2cap itself.
+func newServiceChanged() *Characteristic {
+	return &Characteristic{uuid: gattAttrServiceChangedUUID, props: charIndicate}
+}
+
+// info returns the public description of the handles in r.
+func (r *handleRange) info() []HandleInfo {
+	info := make([]HandleInfo, len(r.hh))
+	for i, h := range r.hh {
+		info[i] = HandleInfo{Handle: h.n, Type: h.typ, UUID: h.uuid, Properties: byte(h.props)}
+	}
+	return info
+}
+
+// valueHandle returns the value handle of char in r.
+func (r *handleRange) valueHandle(char *Characteristic) (n uint16, ok bool) {
+	for _, h := range r.hh {
+		if h.typ == "characteristic" && h.attr == char {
+			return h.valuen, true
+		}
+	}
+	return 0, false
+}
+
+// serviceRange returns the group range of svc in r.
+func (r *handleRange) serviceRange(svc *Service) (start, end uint16, ok bool) {
+	for _, h := range r.hh {
+		if h.typ == "service" && h.attr == svc {
+			return h.startn, h.endn, true
+		}
+	}
+	return 0, 0, false
+}
+
 // A handleRange is a contiguous range of handles.
 type handleRange struct {
 	hh   []handle
@@ -129,3 +244,45 @@ func (r *handleRange) Subrange(start, end uint16) []handle {
 	}
 	return r.hh[startidx:endidx]
 }
+
+// groupEnd returns the last handle in the group that
+// starts with the service declaration hh[i]: the handle
+// just before the next service declaration, or the last
+// handle in r if there is no next service.
+func (r *handleRange) groupEnd(i int) uint16 {
+	for _, h := range r.hh[i+1:] {
+		if h.typ == "service" {
+			return h.n - 1
+		}
+	}
+	return r.base + uint16(len(r.hh)) - 1
+}
+
+// validate checks that r is well formed: handles are numbered
+// contiguously from r.base, and every service's group range
+// starts at its declaration and ends at its last attribute.
+// Since groups end just before the next service, validated
+// groups never overlap.
+func (r *handleRange) validate() error {
+	for i, h := range r.hh {
+		if want := r.base + uint16(i); h.n != want {
+			return fmt.Errorf("handle %d at index %d, want %d", h.n, i, want)
+		}
+		if h.typ == "include" && h.value == nil {
+			return fmt.Errorf("include at handle %d of service %v, which is not served", h.n, h.uuid)
+		}
+		if len(h.value) > attMaxValueLen {
+			return fmt.Errorf("%s %v at handle %d has a %d byte value, more than the maximum of %d", h.typ, h.uuid, h.n, len(h.value), attMaxValueLen)
+		}
+		if char, ok := h.attr.(*Characteristic); ok && h.typ == "characteristic" && char.arhandler != nil && (char.snapshot > 0 || char.mustFit) {
+			return fmt.Errorf("characteristic %v at handle %d has an AsyncReadHandler, which cannot be used with SnapshotLongReads or MustFitMTU", h.uuid, h.n)
+		}
+		if h.typ != "service" {
+			continue
+		}
+		if end := r.groupEnd(i); h.startn != h.n || h.endn != end {
+			return fmt.Errorf("service %v has group range [%d,%d], want [%d,%d]", h.uuid, h.startn, h.endn, h.n, end)
+		}
+	}
+	return nil
+}
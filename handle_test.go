@@ -3,6 +3,7 @@ package gatt
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestHandleRangeAt(t *testing.T) {
@@ -66,3 +67,92 @@ func TestHandleRangeSubrange(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateHandlesGroups(t *testing.T) {
+	svcs := []*Service{
+		&Service{uuid: UUID16(0xfff0)},
+		&Service{uuid: UUID16(0xfff1)},
+	}
+	svcs[0].AddCharacteristic(UUID16(0xfff2)).HandleNotifyFunc(func(r Request, n Notifier) {})
+	svcs[0].chars[0].descs = []*desc{&desc{uuid: UUID16(0x2901), value: []byte("a")}}
+	svcs[1].AddCharacteristic(UUID16(0xfff3))
+
+	r := generateHandles("", 0, nil, svcs, 1)
+	if err := r.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	// gap [1,5], gatt [6,8], fff0 [9,13], fff1 [14,16]
+	want := [][2]uint16{{1, 5}, {6, 8}, {9, 13}, {14, 16}}
+	var got [][2]uint16
+	for _, h := range r.hh {
+		if h.typ == "service" {
+			got = append(got, [2]uint16{h.startn, h.endn})
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("group ranges: got %v want %v", got, want)
+	}
+
+	r.hh[8].endn = 14 // overlap fff1
+	if err := r.validate(); err == nil {
+		t.Errorf("validate with overlapping groups: got nil error")
+	}
+}
+
+func TestValidateAsyncRead(t *testing.T) {
+	async := AsyncReadHandlerFunc(func(req *ReadRequest) <-chan ReadResult { return nil })
+	cases := []struct {
+		name  string
+		setup func(c *Characteristic)
+		ok    bool
+	}{
+		{name: "async", setup: func(c *Characteristic) {}, ok: true},
+		{name: "async with snapshots", setup: func(c *Characteristic) { c.SnapshotLongReads(time.Second) }},
+		{name: "async, must fit", setup: func(c *Characteristic) { c.MustFitMTU(nil) }},
+	}
+	for _, tt := range cases {
+		svc := &Service{uuid: UUID16(0xfff0)}
+		c := svc.AddCharacteristic(UUID16(0xfff1))
+		c.HandleReadAsync(async)
+		tt.setup(c)
+		err := generateHandles("", 0, nil, []*Service{svc}, 1).validate()
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: validate: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestHandleRangeLookup(t *testing.T) {
+	svc := &Service{uuid: UUID16(0xfff0)}
+	a := svc.AddCharacteristic(UUID16(0xfff1))
+	a.HandleNotifyFunc(func(r Request, n Notifier) {})
+	a.descs = []*desc{&desc{uuid: UUID16(0x2901), value: []byte("a")}}
+	b := svc.AddCharacteristic(UUID16(0xfff2))
+
+	r := generateHandles("", 0, nil, []*Service{svc}, 1)
+
+	// fff0 [9,15]: 10: a, 11: a value, 12: a ccc, 13: a desc, 14: b, 15: b value
+	if start, end, ok := r.serviceRange(svc); !ok || start != 9 || end != 15 {
+		t.Errorf("service range: got [%d,%d] %v want [9,15] true", start, end, ok)
+	}
+	got := make([]uint16, 0, 2)
+	for _, char := range []*Characteristic{a, b} {
+		n, ok := r.valueHandle(char)
+		if !ok {
+			t.Errorf("characteristic %v not in table", char.uuid)
+		}
+		got = append(got, n)
+	}
+	if want := []uint16{11, 15}; !reflect.DeepEqual(got, want) {
+		t.Errorf("value handles: got %v want %v", got, want)
+	}
+
+	other := &Service{uuid: UUID16(0xffe0)}
+	if _, _, ok := r.serviceRange(other); ok {
+		t.Errorf("service range of unserved service: got ok")
+	}
+	if _, ok := r.valueHandle(other.AddCharacteristic(UUID16(0xffe1))); ok {
+		t.Errorf("value handle of unserved characteristic: got ok")
+	}
+}
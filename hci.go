@@ -7,17 +7,19 @@ import (
 	"strings"
 )
 
-func newHCI(s shim) *hci {
+func newHCI(s Transport) *hci {
 	c := &hci{
-		shim:    s,
-		readbuf: bufio.NewReader(s),
+		Transport: s,
+		readbuf:   bufio.NewReader(s),
+		logger:    nopLogger{},
 	}
 	return c
 }
 
 type hci struct {
-	shim
+	Transport
 	readbuf *bufio.Reader
+	logger  Logger // see Server.Logger; never nil
 }
 
 // advertiseEIR instructs hci to begin advertising. adv and scan
@@ -52,8 +54,8 @@ func (c *hci) advertiseEIR(adv []byte, scan []byte) error {
 	case len(scan) > MaxEIRPacketLength:
 		return ErrEIRPacketTooLong
 	}
-	// log.Printf("HCI: Sending %x %x", adv, scan)
-	_, err := fmt.Fprintf(c.shim, "%x %x\n", adv, scan)
+	c.logger.Debugf("gatt: hci sending %x %x", adv, scan)
+	_, err := fmt.Fprintf(c.Transport, "%x %x\n", adv, scan)
 	return err
 }
 
@@ -72,7 +74,7 @@ func (c *hci) event() (string, error) {
 		case "adapterState":
 			return f[1], nil
 		case "hciDeviceId":
-			// log.Printf("HCI device id %s", f[1])
+			c.logger.Infof("gatt: hci device id %s", f[1])
 			continue
 		default:
 			return "", errors.New("unexpected event type: " + s)
@@ -3,7 +3,6 @@ package gatt
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"reflect"
 	"testing"
 )
@@ -12,9 +11,9 @@ type testshim struct {
 	bytes.Buffer
 }
 
-func (t *testshim) Close() error           { return nil }
-func (t *testshim) Wait() error            { return nil }
-func (t *testshim) Signal(os.Signal) error { return nil }
+func (t *testshim) Close() error          { return nil }
+func (t *testshim) Wait() error           { return nil }
+func (t *testshim) Control(Command) error { return nil }
 
 func TestAdvertiseEIR(t *testing.T) {
 	cases := []struct {
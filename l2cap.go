@@ -1,64 +1,170 @@
-// TODO: Figure out about how to structure things for multiple
-// OS / BLE interface configurations. Build tags? Subpackages?
-
 package gatt
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 )
 
 // l2capHandler is the set of callback methods required to handle l2cap events.
 type l2capHandler interface {
-	readChar(c *Characteristic, maxlen int, offset int) (data []byte, status byte)
-	writeChar(c *Characteristic, data []byte, noResponse bool) (status byte)
+	readChar(c *Characteristic, hw net.HardwareAddr, maxlen int, offset int) (data []byte, status byte)
+	writeChar(c *Characteristic, hw net.HardwareAddr, data []byte, noResponse bool) (status byte)
+	writeDesc(d *desc, hw net.HardwareAddr, data []byte) (status byte)
 	startNotify(c *Characteristic, maxlen int)
 	stopNotify(c *Characteristic)
+	startIndicate(c *Characteristic, maxlen int)
+	stopIndicate(c *Characteristic)
 	connected(hw net.HardwareAddr)
-	disconnected(hw net.HardwareAddr)
+	switched(hw net.HardwareAddr)
+	disconnected(hw net.HardwareAddr, reason DisconnectReason)
 	receivedRSSI(rssi int)
 	receivedBDAddr(bdaddr string)
-	// TODO: MTUChange?
-	// TODO: SecurityChange?
+	ownAddressChanged(addr string)
+	readCharAsync(c *Characteristic, hw net.HardwareAddr, maxlen int, offset int) <-chan ReadResult
+	validateWrite(c *Characteristic, data []byte) (status byte)
+	validateWrites(writes []PreparedWrite) (status byte)
+	prepareProgress(c *Characteristic, bytesQueued, fragments int)
+	phyUpdated(tx, rx PHY)
+	mtuChanged(mtu int)
+	securityChanged(level SecurityLevel)
+	dataLengthChanged(tx, rx int)
+	authorizeRead(c *Characteristic, hw net.HardwareAddr) bool
+	authorizeWrite(c *Characteristic, hw net.HardwareAddr) bool
+	transportReopened()
 }
 
 // newL2cap uses s to provide l2cap access.
-func newL2cap(s shim, handler l2capHandler) *l2cap {
+func newL2cap(s Transport, handler l2capHandler) *l2cap {
 	c := &l2cap{
-		shim:    s,
-		readbuf: bufio.NewReader(s),
-		mtu:     23,
-		handler: handler,
+		shim:       s,
+		readbuf:    bufio.NewReader(s),
+		conn:       newAttConn(nil),
+		conns:      make(map[string]*attConn),
+		cccs:       make(map[string]map[*Characteristic]uint16),
+		handler:    handler,
+		cnfTimeout: attTimeout,
+		now:        time.Now,
+		notified:   make(map[string]map[*Characteristic][]byte),
+		notifyq:    make(map[uint16]chan struct{}),
+		logger:     nopLogger{},
 	}
 	return c
 }
 
-type security int
+// An attConn is the state of the ATT bearer of a connected central.
+// The l2cap holds one for each central, so that several may be
+// connected at once; they share the handle table.
+type attConn struct {
+	addr     net.HardwareAddr // the central; nil if none
+	mtu      uint16
+	security SecurityLevel
+	dataLen  [2]int              // maximum LL payload sizes, tx and rx
+	active   time.Time           // time of the last PDU received from the central
+	prepq    []prepWrite         // prepared writes, awaiting execution
+	snaps    map[uint16]snapshot // snapshots for long reads, by value handle
+
+	// Handle value confirmations from the central arrive on cnfc.
+	// Only one indication may be outstanding at a time; indmu
+	// serializes them.
+	indmu sync.Mutex
+	cnfc  chan struct{}
+}
 
-const (
-	securityLow = iota
-	securityMed
-	securityHigh
-)
+// newAttConn returns the state of a new connection with the central at addr.
+func newAttConn(addr net.HardwareAddr) *attConn {
+	return &attConn{
+		addr:    addr,
+		mtu:     23,
+		dataLen: [2]int{llDefaultDataLen, llDefaultDataLen},
+		snaps:   make(map[uint16]snapshot),
+		cnfc:    make(chan struct{}, 1),
+	}
+}
 
 type l2cap struct {
-	shim     shim
+	shim     Transport
 	readbuf  *bufio.Reader
-	sendmu   sync.Mutex // serializes writes to the shim
-	mtu      uint16
+	statemu  sync.Mutex       // held by the eventloop while handling each shim line
+	sendmu   sync.Mutex       // serializes writes to the shim, and guards shim and named
+	named    net.HardwareAddr // the central to which the shim sends PDUs, if known; see sendTo
 	handles  *handleRange
-	security security
+	valuens  map[*Characteristic]uint16 // value handles, by characteristic
+	features byte                       // GATT server supported features; see Server.ServerFeatures
+	svcchg   *Characteristic            // the Service Changed characteristic, if served; see Server.ServiceChanged
+	maxMTU   uint16                     // if >= 23, caps the mtu used when sending; see Server.MaxMTU
+	strict   bool                       // reject duplicate characteristic UUIDs; see Server.StrictServices
+	skipBad  bool                       // log and skip malformed shim lines; see Server.SkipMalformedEvents
+	async    *asyncRead                 // outstanding asynchronous read, if any
+	errbuf   []byte                     // reused for error responses; see errResp
+	respws   []*l2capWriter             // writers to release once handleReq has sent its response; see respWriter
 	handler  l2capHandler
-	serving  bool
-	quit     chan struct{}
+
+	// badEvent, if non-nil, is called instead of logging each
+	// malformed line skipped; see Server.MalformedEvent.
+	badEvent func(line string, err error)
+
+	logger Logger // see Server.Logger; never nil
+
+	// reopen, if non-nil, reopens the transport after reading from it
+	// fails, as governed by reconnect; see Server.Reconnect.
+	reopen    func() (Transport, error)
+	reconnect ReconnectPolicy
+
+	// connmu guards conn, conns, the connections' mtu, dataLen and
+	// active, phys, and cccs. They are only written by the eventloop,
+	// which may read them without locking.
+	connmu sync.RWMutex
+	conn   *attConn                              // the connection that shim events concern; never nil
+	conns  map[string]*attConn                   // connected centrals, by address
+	phys   PHY                                   // PHYs supported by the adapter, as reported by the shim
+	cccs   map[string]map[*Characteristic]uint16 // client characteristic configurations, by central address; see setCCC
+
+	now func() time.Time // the current time; replaceable for testing
+
+	serving bool
+	quit    chan struct{}
+
+	rssimu   sync.Mutex
+	rssistop chan struct{}    // closed to stop the RSSI monitor; nil if not running
+	rssiaddr net.HardwareAddr // the central whose RSSI is monitored
+
+	// Requests that we make as a client, such as MTU exchanges,
+	// are serialized by reqmu. The one awaiting its response, if
+	// any, is pending, which pendmu guards; see handleResp.
+	reqmu   sync.Mutex
+	pendmu  sync.Mutex
+	pending *clientReq
+
+	// Indications fail if not confirmed within cnfTimeout;
+	// see attConn.cnfc.
+	cnfTimeout time.Duration
+
+	// notified holds, by central address, the values last notified
+	// for characteristics that suppress duplicates; see duplicate.
+	notifiedmu sync.Mutex
+	notified   map[string]map[*Characteristic][]byte
+
+	notifymu sync.Mutex
+	notifyq  map[uint16]chan struct{} // the last in each notification queue; see notifyTurn
+	sending  int                      // notifications and indications being sent; see flush
+	idle     chan struct{}            // closed when sending drops to 0
+
+	pausemu sync.RWMutex
+	paused  bool
+	allowed [][2]uint16 // handle ranges that remain accessible while paused
 }
 
 func (c *l2cap) listenAndServe() error {
@@ -70,13 +176,58 @@ func (c *l2cap) listenAndServe() error {
 	return c.eventloop()
 }
 
+// listenAndServeContext is like listenAndServe, but also stops serving
+// once ctx is done: it then disconnects the central, if any, closes c,
+// and returns ctx.Err(). c must not also be closed by the caller.
+func (c *l2cap) listenAndServeContext(ctx context.Context) error {
+	if c.serving {
+		return errors.New("already serving")
+	}
+	c.serving = true
+	c.quit = make(chan struct{})
+	errc := make(chan error, 1)
+	go func() { errc <- c.eventloop() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	c.connmu.RLock()
+	connected := c.conn.addr != nil
+	c.connmu.RUnlock()
+	if connected {
+		c.disconnect()
+	}
+	c.close()
+	<-errc
+	return ctx.Err()
+}
+
 func (c *l2cap) setServices(name string, svcs []*Service) error {
 	// cannot be called while serving
 	if c.serving {
 		return errors.New("cannot set services while serving")
 	}
-	c.handles = generateHandles(name, svcs, uint16(1)) // ble handles start at 1
-	// log.Println("Generated handles: ", c.handles)
+	if c.strict {
+		if err := uniqueCharUUIDs(svcs); err != nil {
+			return err
+		}
+	}
+	handles := generateHandles(name, c.features, c.svcchg, svcs, uint16(1)) // ble handles start at 1
+	c.logger.Debugf("gatt: generated %d handles for %d services", len(handles.hh), len(svcs))
+	if err := handles.validate(); err != nil {
+		return err
+	}
+	c.handles = handles
+	// The services may be shared with other l2caps, so
+	// value handles are looked up in our own table.
+	c.valuens = make(map[*Characteristic]uint16)
+	for _, h := range handles.hh {
+		if h.typ == "characteristic" {
+			c.valuens[h.attr.(*Characteristic)] = h.valuen
+		}
+	}
 	return nil
 }
 
@@ -85,98 +236,575 @@ func (c *l2cap) close() error {
 		return errors.New("not serving")
 	}
 	c.serving = false
+	c.stopRSSIMonitor()
 	close(c.quit)
 	return nil
 }
 
 func (c *l2cap) eventloop() error {
+	// Read in the background, so that closing
+	// takes effect even if the shim is idle.
+	linec := make(chan shimLine)
+	go c.readLines(linec)
+
 	for {
-		// TODO: Check c.quit *concurrently* with other
-		// blocking activities.
+		var line shimLine
 		select {
 		case <-c.quit:
 			return nil
-		default:
+		case line = <-linec:
 		}
 
-		s, err := c.readbuf.ReadString('\n')
-		// log.Printf("L2CAP: Received %s", s)
+		s, err := line.s, line.err
+		if err != nil && c.reopen != nil {
+			reopened, rerr := c.reopenTransport(err)
+			if rerr != nil {
+				return rerr
+			}
+			if !reopened {
+				return nil // closed
+			}
+			go c.readLines(linec)
+			continue
+		}
+		if err == io.EOF {
+			// The shim has shut down. Any partial final
+			// line is incomplete; discard it unparsed.
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+		c.logger.Debugf("gatt: l2cap received %s", strings.TrimSpace(s))
 		f := strings.Fields(s)
 		if len(f) < 2 {
+			// Nothing to act on, e.g. an empty data frame.
 			continue
 		}
 
 		// TODO: Think about concurrency here. Do we want to spawn
 		// new goroutines to not block this core loop?
 
-		switch f[0] {
-		case "accept":
-			hw, err := net.ParseMAC(f[1])
-			if err != nil {
-				return errors.New("failed to parse accepted addr " + f[1] + ": " + err.Error())
-			}
-			c.handler.connected(hw)
-			c.mtu = 23
-		case "disconnect":
-			hw, err := net.ParseMAC(f[1])
-			if err != nil {
-				return errors.New("failed to parse disconnected addr " + f[1] + ": " + err.Error())
-			}
-			c.handler.disconnected(hw)
-		case "rssi":
-			n, err := strconv.Atoi(f[1])
-			if err != nil {
-				return errors.New("failed to parse rssi " + f[1] + ": " + err.Error())
-			}
-			c.handler.receivedRSSI(n)
-		case "security":
-			switch f[1] {
-			case "low":
-				c.security = securityLow
-			case "medium":
-				c.security = securityMed
-			case "high":
-				c.security = securityHigh
-			default:
-				return errors.New("unexpected security change: " + f[1])
+		c.statemu.Lock()
+		err = c.handleEvent(s, f)
+		c.statemu.Unlock()
+		if _, ok := err.(badEventError); ok && c.skipBad {
+			if c.badEvent != nil {
+				c.badEvent(strings.TrimSpace(s), err)
+			} else {
+				log.Printf("gatt: skipping malformed shim line %q: %v", strings.TrimSpace(s), err)
 			}
-			// TODO: notify l2capHandler about security change
-		case "bdaddr":
-			c.handler.receivedBDAddr(f[1])
-		case "hciDeviceId":
-			// log.Printf("l2cap hci device: %s", f[1])
-		case "data":
-			req, err := hex.DecodeString(f[1])
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// disconnected forgets the central at hw, which has disconnected
+// for reason. c.statemu must be held.
+func (c *l2cap) disconnected(hw net.HardwareAddr, reason DisconnectReason) {
+	c.rssimu.Lock()
+	if c.rssistop != nil && bytes.Equal(c.rssiaddr, hw) {
+		close(c.rssistop)
+		c.rssistop = nil
+	}
+	c.rssimu.Unlock()
+	if c.async != nil && bytes.Equal(c.async.conn.addr, hw) {
+		c.cancelAsync()
+	}
+	c.dropCCCs(hw)
+	c.forgetNotified(hw, nil)
+	c.connmu.Lock()
+	delete(c.conns, hw.String())
+	if bytes.Equal(c.conn.addr, hw) {
+		// Keep the MTU, so that the next accept
+		// can report the reset of the MTU to 23.
+		idle := newAttConn(nil)
+		idle.mtu = c.conn.mtu
+		c.conn = idle
+	}
+	c.connmu.Unlock()
+	c.sendmu.Lock()
+	if bytes.Equal(c.named, hw) {
+		c.named = nil
+	}
+	c.sendmu.Unlock()
+	c.handler.disconnected(hw, reason)
+}
+
+// reopenTransport replaces the transport, reading from which failed
+// with readErr, by reopening it, as governed by c.reconnect. Centrals
+// connected over the failed transport are disconnected; the handle
+// table, and so the services, are kept. reopenTransport reports
+// whether it reopened the transport; it gives up, returning an error,
+// once all attempts fail, and returns early, without error, if c is
+// closed. It is only called by the eventloop.
+func (c *l2cap) reopenTransport(readErr error) (reopened bool, err error) {
+	select {
+	case <-c.quit:
+		return false, nil
+	default:
+	}
+
+	c.statemu.Lock()
+	c.connmu.RLock()
+	addrs := make([]string, 0, len(c.conns))
+	for addr := range c.conns {
+		addrs = append(addrs, addr)
+	}
+	c.connmu.RUnlock()
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		hw, _ := net.ParseMAC(addr)
+		c.disconnected(hw, DisconnectUnknown)
+	}
+	c.statemu.Unlock()
+	c.transport().Close()
+
+	retries := c.reconnect.MaxRetries
+	if retries < 1 {
+		retries = 1
+	}
+	wait := c.reconnect.Backoff
+	for i := 0; i < retries; i++ {
+		select {
+		case <-time.After(wait):
+		case <-c.quit:
+			return false, nil
+		}
+		var t Transport
+		if t, err = c.reopen(); err == nil {
+			c.sendmu.Lock()
+			c.shim = t
+			c.named = nil
+			c.sendmu.Unlock()
+			c.readbuf = bufio.NewReader(t)
+			c.logger.Infof("gatt: reopened l2cap transport after error: %v", readErr)
+			c.handler.transportReopened()
+			return true, nil
+		}
+		c.logger.Infof("gatt: reopening l2cap transport, attempt %d: %v", i+1, err)
+		wait *= 2
+		if max := c.reconnect.MaxBackoff; max > 0 && wait > max {
+			wait = max
+		}
+	}
+	return false, fmt.Errorf("reading transport: %v; reopening it failed %d times: %v", readErr, retries, err)
+}
+
+// transport returns the current transport, which reopenTransport
+// may replace. It may be called concurrently with the eventloop.
+func (c *l2cap) transport() Transport {
+	c.sendmu.Lock()
+	defer c.sendmu.Unlock()
+	return c.shim
+}
+
+// A shimLine is a line read from the shim, or the error that ended reading.
+type shimLine struct {
+	s   string
+	err error
+}
+
+// readLines reads lines from the shim and sends them on linec, until
+// a read fails, whose error is sent last, or c.quit is closed.
+func (c *l2cap) readLines(linec chan<- shimLine) {
+	for {
+		s, err := c.readbuf.ReadString('\n')
+		select {
+		case linec <- shimLine{s, err}:
+		case <-c.quit:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleEvent handles the shim line s, split into fields f.
+// c.statemu must be held.
+func (c *l2cap) handleEvent(s string, f []string) error {
+	switch f[0] {
+	case "accept":
+		hw, err := net.ParseMAC(f[1])
+		if err != nil {
+			return badEventError{errors.New("failed to parse accepted addr " + f[1] + ": " + err.Error())}
+		}
+		c.handler.connected(hw)
+		c.dropCCCs(hw) // in case we missed its disconnection
+		conn := newAttConn(hw)
+		conn.active = c.now()
+		c.connmu.Lock()
+		prevMTU := c.conn.mtu
+		c.conn = conn
+		c.conns[hw.String()] = conn
+		c.cccs[hw.String()] = make(map[*Characteristic]uint16)
+		c.connmu.Unlock()
+		c.sendmu.Lock()
+		if c.named == nil {
+			// The shim sends PDUs to the central it accepted,
+			// unless we have named another; see sendTo.
+			c.named = hw
+		}
+		c.sendmu.Unlock()
+		if prevMTU != conn.mtu {
+			// The new connection starts at the minimum MTU.
+			c.handler.mtuChanged(int(conn.mtu))
+		}
+	case "conn":
+		// Shims that serve several centrals at once say which
+		// one the following events concern. Others only ever
+		// accept one at a time. The PDUs that we send name
+		// their central themselves; see sendTo.
+		hw, err := net.ParseMAC(f[1])
+		if err != nil {
+			return badEventError{errors.New("failed to parse connection addr " + f[1] + ": " + err.Error())}
+		}
+		// Answer any outstanding asynchronous read first;
+		// requests are handled one at a time, whoever sent them.
+		c.waitAsync()
+		c.connmu.Lock()
+		conn, ok := c.conns[hw.String()]
+		if ok {
+			c.conn = conn
+		}
+		c.connmu.Unlock()
+		if !ok {
+			return badEventError{errors.New("event for unconnected central " + f[1])}
+		}
+		c.handler.switched(hw)
+	case "disconnect":
+		hw, err := net.ParseMAC(f[1])
+		if err != nil {
+			return badEventError{errors.New("failed to parse disconnected addr " + f[1] + ": " + err.Error())}
+		}
+		// Shims may report the HCI reason code, in hex.
+		reason := DisconnectUnknown
+		if len(f) > 2 {
+			n, err := strconv.ParseUint(f[2], 16, 8)
 			if err != nil {
-				return err
-			}
-			if err = c.handleReq(req); err != nil {
-				return err
+				return badEventError{errors.New("failed to parse disconnect reason " + f[2] + ": " + err.Error())}
 			}
+			reason = DisconnectReason(n)
+		}
+		c.disconnected(hw, reason)
+	case "rssi":
+		n, err := strconv.Atoi(f[1])
+		if err != nil {
+			return badEventError{errors.New("failed to parse rssi " + f[1] + ": " + err.Error())}
+		}
+		c.handler.receivedRSSI(n)
+	case "security":
+		var level SecurityLevel
+		switch f[1] {
+		case "low":
+			level = SecurityLow
+		case "medium":
+			level = SecurityMedium
+		case "high":
+			level = SecurityHigh
+		default:
+			return badEventError{errors.New("unexpected security change: " + f[1])}
+		}
+		c.setSecurity(level)
+	case "bdaddr":
+		c.handler.receivedBDAddr(f[1])
+	case "ownaddr":
+		// Our own address has changed, e.g. a resolvable
+		// private address has rotated. Only some shims report this.
+		c.handler.ownAddressChanged(f[1])
+	case "hciDeviceId":
+		c.logger.Infof("gatt: l2cap hci device %s", f[1])
+	case "mtu":
+		// Some shims perform the MTU exchange themselves,
+		// and report the result; others never send this.
+		mtu, err := strconv.ParseUint(f[1], 10, 16)
+		if err != nil {
+			return badEventError{errors.New("failed to parse mtu " + f[1] + ": " + err.Error())}
+		}
+		c.setMTU(uint16(mtu))
+	case "phys":
+		phys, err := strconv.ParseUint(f[1], 16, 8)
+		if err != nil {
+			return badEventError{errors.New("failed to parse phys " + f[1] + ": " + err.Error())}
+		}
+		c.connmu.Lock()
+		c.phys = PHY(phys)
+		c.connmu.Unlock()
+	case "phy":
+		if len(f) < 3 {
+			return badEventError{fmt.Errorf("malformed phy update %q", s)}
+		}
+		tx, err := strconv.ParseUint(f[1], 16, 8)
+		if err != nil {
+			return badEventError{errors.New("failed to parse tx phy " + f[1] + ": " + err.Error())}
+		}
+		rx, err := strconv.ParseUint(f[2], 16, 8)
+		if err != nil {
+			return badEventError{errors.New("failed to parse rx phy " + f[2] + ": " + err.Error())}
+		}
+		c.handler.phyUpdated(PHY(tx), PHY(rx))
+	case "datalen":
+		// The link layer data length has changed, as by the
+		// data length extension. Only some shims report this.
+		if len(f) < 3 {
+			return badEventError{fmt.Errorf("malformed data length update %q", s)}
+		}
+		tx, err := strconv.Atoi(f[1])
+		if err != nil || tx < llDefaultDataLen || tx > llMaxDataLen {
+			return badEventError{fmt.Errorf("bad tx data length %q", f[1])}
+		}
+		rx, err := strconv.Atoi(f[2])
+		if err != nil || rx < llDefaultDataLen || rx > llMaxDataLen {
+			return badEventError{fmt.Errorf("bad rx data length %q", f[2])}
+		}
+		c.connmu.Lock()
+		changed := c.conn.dataLen != [2]int{tx, rx}
+		c.conn.dataLen = [2]int{tx, rx}
+		c.connmu.Unlock()
+		if changed {
+			c.handler.dataLengthChanged(tx, rx)
+		}
+	case "data":
+		req, err := hex.DecodeString(f[1])
+		if err != nil {
+			return badEventError{fmt.Errorf("malformed data %q: %v", f[1], err)}
+		}
+		c.connmu.Lock()
+		c.conn.active = c.now()
+		c.connmu.Unlock()
+		if len(req) > 0 && req[0] != attOpHandleCnf && req[0] != attOpMtuResp && req[0] != attOpError {
+			// ATT requests are sequential; answer any
+			// outstanding asynchronous read first.
+			c.waitAsync()
+		}
+		if err = c.handleReq(req); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// A badEventError reports a shim line that could not be parsed.
+// Unlike transport errors, these need not be fatal.
+type badEventError struct {
+	err error
 }
 
+func (e badEventError) Error() string { return e.err.Error() }
+
 func (c *l2cap) disconnect() error {
-	return c.shim.Signal(syscall.SIGHUP)
+	return c.transport().Control(CommandDisconnect)
+}
+
+// disconnectConn asks the transport to disconnect the central at addr,
+// leaving any other connections up. The transport reports the
+// disconnection as usual. disconnectConn returns an error if addr
+// is not connected.
+func (c *l2cap) disconnectConn(addr net.HardwareAddr) error {
+	c.connmu.RLock()
+	_, ok := c.conns[addr.String()]
+	c.connmu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%v not connected", addr)
+	}
+	c.sendmu.Lock()
+	_, err := fmt.Fprintf(c.shim, "disconnect %v\n", addr)
+	c.sendmu.Unlock()
+	return err
+}
+
+// resetConn restores the ATT state of the connection with the central
+// at addr to that of a new connection, without disconnecting: the MTU,
+// client characteristic configurations, queued prepared writes, and
+// security level. Active notifications are stopped.
+// resetConn must not be called from within an l2capHandler method.
+func (c *l2cap) resetConn(addr net.HardwareAddr) error {
+	c.statemu.Lock()
+	defer c.statemu.Unlock()
+
+	c.connmu.RLock()
+	conn, ok := c.conns[addr.String()]
+	c.connmu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%v not connected", addr)
+	}
+
+	for char := range c.cccs[addr.String()] {
+		c.setCCC(addr, char, 0)
+	}
+	conn.snaps = make(map[uint16]snapshot)
+	if conn != c.conn {
+		c.connmu.Lock()
+		conn.mtu, conn.security, conn.prepq = 23, SecurityLow, nil
+		c.connmu.Unlock()
+		return nil
+	}
+	// Report the changes for the current connection.
+	c.setMTU(23)
+	c.conn.prepq = nil
+	c.setSecurity(SecurityLow)
+	return nil
+}
+
+// setSecurity sets the connection security level to level,
+// and reports any change to the handler.
+func (c *l2cap) setSecurity(level SecurityLevel) {
+	if level == c.conn.security {
+		return
+	}
+	c.conn.security = level
+	c.handler.securityChanged(level)
+}
+
+// subscriptions returns the subscriptions of the central at addr,
+// in handle order, as set by its client characteristic configurations.
+// It returns nil if addr is not connected.
+// subscriptions must not be called from within an l2capHandler method.
+func (c *l2cap) subscriptions(addr net.HardwareAddr) []SubscriptionInfo {
+	c.statemu.Lock()
+	defer c.statemu.Unlock()
+
+	cccs, ok := c.cccs[addr.String()]
+	if !ok {
+		return nil
+	}
+
+	var subs []SubscriptionInfo
+	for _, h := range c.handles.Subrange(0x0001, 0xffff) {
+		if !h.isDescriptor(gattAttrClientCharacteristicConfigUUID) {
+			continue
+		}
+		ccc := cccs[h.attr.(*Characteristic)]
+		if ccc&(gattCCCNotifyFlag|gattCCCIndicateFlag) == 0 {
+			continue
+		}
+		subs = append(subs, SubscriptionInfo{
+			Characteristic: h.attr.(*Characteristic),
+			Notify:         ccc&gattCCCNotifyFlag != 0,
+			Indicate:       ccc&gattCCCIndicateFlag != 0,
+		})
+	}
+	return subs
+}
+
+// lastActivity returns the time at which the last PDU was received
+// from the central at addr, or at which it connected, if it has sent
+// none. It returns the zero time if addr is not connected.
+func (c *l2cap) lastActivity(addr net.HardwareAddr) time.Time {
+	c.connmu.RLock()
+	defer c.connmu.RUnlock()
+	conn, ok := c.conns[addr.String()]
+	if !ok {
+		return time.Time{}
+	}
+	return conn.active
+}
+
+// setPHY asks the controller to use the preferred
+// PHYs tx and rx for the connection with the central at addr.
+func (c *l2cap) setPHY(addr net.HardwareAddr, tx, rx PHY) error {
+	c.connmu.RLock()
+	_, connected := c.conns[addr.String()]
+	phys := c.phys
+	c.connmu.RUnlock()
+	if !connected {
+		return fmt.Errorf("%v not connected", addr)
+	}
+	if tx == 0 || rx == 0 {
+		return errors.New("no PHY requested")
+	}
+	if (tx|rx)&^phys != 0 {
+		return fmt.Errorf("PHY %v not supported by adapter (supports %v)", (tx|rx)&^phys, phys)
+	}
+	c.sendmu.Lock()
+	_, err := fmt.Fprintf(c.shim, "phy %v %x %x\n", addr, uint8(tx), uint8(rx))
+	c.sendmu.Unlock()
+	return err
 }
 
 func (c *l2cap) updateRSSI() error {
-	return c.shim.Signal(syscall.SIGUSR1)
+	return c.transport().Control(CommandUpdateRSSI)
+}
+
+// startRSSIMonitor requests an RSSI update every interval, until
+// stopRSSIMonitor is called, the current central disconnects, or c
+// is closed. Updates are delivered via handler.receivedRSSI as usual.
+// Starting a monitor stops any monitor already running.
+func (c *l2cap) startRSSIMonitor(interval time.Duration) {
+	c.connmu.RLock()
+	addr := c.conn.addr
+	c.connmu.RUnlock()
+	c.rssimu.Lock()
+	defer c.rssimu.Unlock()
+	if c.rssistop != nil {
+		close(c.rssistop)
+	}
+	stop := make(chan struct{})
+	c.rssistop = stop
+	c.rssiaddr = addr
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := c.updateRSSI(); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopRSSIMonitor stops the RSSI monitor, if one is running.
+func (c *l2cap) stopRSSIMonitor() {
+	c.rssimu.Lock()
+	defer c.rssimu.Unlock()
+	if c.rssistop != nil {
+		close(c.rssistop)
+		c.rssistop = nil
+	}
 }
 
+// send sends the pdu b to the current central; see sendTo.
 func (c *l2cap) send(b []byte) error {
-	if len(b) > int(c.mtu) {
-		panic(fmt.Errorf("cannot send %x: mtu %d", b, c.mtu))
+	c.connmu.RLock()
+	conn := c.conn
+	c.connmu.RUnlock()
+	return c.sendTo(conn, b)
+}
+
+// sendTo sends the pdu b to the central of conn. It returns an error,
+// sending nothing, if b does not fit in conn's MTU. The shim sends PDUs
+// to the central that we last named, or that it accepted, if we have
+// named none since; unless that is conn's central, sendTo names it
+// first, with a "conn <addr>" line. See Transport.
+func (c *l2cap) sendTo(conn *attConn, b []byte) error {
+	c.connmu.RLock()
+	mtu := conn.mtu
+	c.connmu.RUnlock()
+	if len(b) > int(mtu) {
+		// E.g. a notification sized for an MTU that
+		// has since shrunk, as after a reconnection.
+		return fmt.Errorf("cannot send %x: mtu %d", b, mtu)
 	}
 
-	// log.Printf("L2CAP: Sending %x", b)
+	c.logger.Debugf("gatt: l2cap sending %x", b)
 	c.sendmu.Lock()
+	defer c.sendmu.Unlock()
+	if conn.addr != nil && !bytes.Equal(conn.addr, c.named) {
+		if _, err := fmt.Fprintf(c.shim, "conn %v\n", conn.addr); err != nil {
+			return err
+		}
+		c.named = conn.addr
+	}
 	_, err := fmt.Fprintf(c.shim, "%x\n", b)
-	c.sendmu.Unlock()
 	return err
 }
 
@@ -186,19 +814,82 @@ type attErr struct {
 	status uint8
 }
 
-// TODO: Reformulate in a way that lets the caller avoid allocs.
-// Accept a []byte? Write directly to an io.Writer?
-func (e attErr) Marshal() []byte {
+func (e attErr) String() string {
+	return fmt.Sprintf("%s handle 0x%04x: %s", attOpName(e.opcode), e.handle, attEcodeName(e.status))
+}
+
+// AppendTo appends the error response for e to b,
+// and returns the extended buffer.
+func (e attErr) AppendTo(b []byte) []byte {
 	// little-endian encoding for handle
-	return []byte{attOpError, e.opcode, byte(e.handle), byte(e.handle >> 8), e.status}
+	return append(b, attOpError, e.opcode, byte(e.handle), byte(e.handle>>8), e.status)
+}
+
+// Marshal returns the error response for e.
+func (e attErr) Marshal() []byte {
+	return e.AppendTo(make([]byte, 0, 5))
 }
 
 // handleReq dispatches a raw request from the l2cap shim
 // to an appropriate handler, based on its type.
-// It panics if len(b) == 0.
+// Empty requests are dropped.
 func (c *l2cap) handleReq(b []byte) error {
-	var resp []byte
+	if len(b) == 0 {
+		return nil
+	}
+
+	if c.blocked(b[0], b[1:]) {
+		if isCommand(b[0]) {
+			// Commands get no response, not even an error.
+			return nil
+		}
+		return c.send(c.errResp(attErr{opcode: b[0], handle: reqHandle(b[0], b[1:]), status: attEcodeDeviceBusy}))
+	}
+
+	defer c.releaseWriters()
+	resp := c.respond(b)
+	if resp == nil {
+		return nil
+	}
+	return c.send(resp)
+}
 
+// errResp returns the error response for e. It is built in a buffer
+// that is reused for each request, so it must be sent before the next
+// request is handled; responses built by asynchronous reads must use
+// Marshal instead. errResp is only called by the eventloop.
+func (c *l2cap) errResp(e attErr) []byte {
+	c.errbuf = e.AppendTo(c.errbuf[:0])
+	return c.errbuf
+}
+
+// respWriter returns a writer, for building the response to the
+// request being handled, that handleReq releases once it has sent
+// the response. The writer must not be used after that, as by an
+// asynchronous read. respWriter is only called by the eventloop.
+func (c *l2cap) respWriter(mtu uint16) *l2capWriter {
+	w := newL2capWriter(mtu)
+	c.respws = append(c.respws, w)
+	return w
+}
+
+// releaseWriters releases the writers returned by respWriter.
+func (c *l2cap) releaseWriters() {
+	for i, w := range c.respws {
+		w.Release()
+		c.respws[i] = nil
+	}
+	c.respws = c.respws[:0]
+}
+
+// respond handles the non-empty request b, and returns the
+// response to send, if any. Responses never exceed the MTU.
+func (c *l2cap) respond(b []byte) (resp []byte) {
+	if isSigned(b[0]) {
+		// Authentication signatures are not verified, so signed
+		// PDUs, such as Signed Write Commands, are dropped silently.
+		return nil
+	}
 	switch reqType, req := b[0], b[1:]; reqType {
 	case attOpMtuReq:
 		resp = c.handleMTU(req)
@@ -214,96 +905,345 @@ func (c *l2cap) handleReq(b []byte) error {
 		resp = c.handleReadByGroup(req)
 	case attOpWriteReq, attOpWriteCmd:
 		resp = c.handleWrite(reqType, req)
-	case attOpReadMultiReq, attOpPrepWriteReq, attOpExecWriteReq, attOpSignedWriteCmd:
-		fallthrough
+	case attOpMtuResp, attOpError:
+		// Responses to our own (client) requests.
+		c.handleResp(b)
+	case attOpHandleCnf:
+		// Never respond to a confirmation, not even with an error.
+		c.handleCnf()
+	case attOpPrepWriteReq:
+		resp = c.handlePrepWrite(req)
+	case attOpExecWriteReq:
+		resp = c.handleExecWrite(req)
+	case attOpReadMultiReq:
+		resp = c.handleReadMulti(req)
 	default:
-		resp = attErr{opcode: reqType, handle: 0x0000, status: attEcodeReqNotSupp}.Marshal()
+		if isCommand(reqType) {
+			// Unsupported commands are dropped silently.
+			break
+		}
+		resp = c.errResp(attErr{opcode: reqType, handle: reqHandle(reqType, req), status: attEcodeReqNotSupp})
 	}
-
-	return c.send(resp)
+	return resp
 }
 
-func (c *l2cap) handleMTU(b []byte) []byte {
-	c.mtu = binary.LittleEndian.Uint16(b)
-	// This sanity check helps keep the response
-	// writing code easier, since you don't have
-	// to double-check that the response headers
-	// will fit in the MTU. This is also the min
-	// allowed by the BLE spec; we're just
-	// enforcing it.
-	if c.mtu < 23 {
-		c.mtu = 23
+// reqHandle returns the attribute handle that a request of type
+// reqType refers to, for use in error responses. For requests that
+// carry a handle range, it is the starting handle. Requests that do
+// not carry a handle, or are too short to, refer to handle 0x0000.
+func reqHandle(reqType byte, req []byte) uint16 {
+	switch reqType {
+	case attOpFindInfoReq, attOpFindByTypeReq, attOpReadByTypeReq, attOpReadByGroupReq,
+		attOpReadReq, attOpReadBlobReq, attOpReadMultiReq,
+		attOpWriteReq, attOpWriteCmd, attOpPrepWriteReq, attOpSignedWriteCmd:
+		if len(req) >= 2 {
+			return binary.LittleEndian.Uint16(req)
+		}
 	}
-	return []byte{attOpMtuResp, b[0], b[1]}
+	return 0x0000
 }
 
-func (c *l2cap) handleFindInfo(b []byte) []byte {
-	start, end := readHandleRange(b)
+// pause makes all attributes outside of the allowed
+// handle ranges inaccessible, until resume is called.
+func (c *l2cap) pause(allowed [][2]uint16) {
+	c.pausemu.Lock()
+	c.paused = true
+	c.allowed = allowed
+	c.pausemu.Unlock()
+}
 
-	w := newL2capWriter(c.mtu)
-	w.WriteByte(attOpFindInfoResp)
-	uuidLen := -1
-	for _, h := range c.handles.Subrange(start, end) {
-		var uuid UUID
-		switch h.typ {
-		case "service":
-			uuid = gattAttrPrimaryServiceUUID
-		case "includedService":
-			uuid = gattAttrSecondaryServiceUUID
-		case "characteristic":
-			uuid = gattAttrCharacteristicUUID
-		case "characteristicValue", "descriptor":
-			uuid = h.uuid
-		default:
-			continue
-		}
+func (c *l2cap) resume() {
+	c.pausemu.Lock()
+	c.paused = false
+	c.allowed = nil
+	c.pausemu.Unlock()
+}
 
-		if uuidLen == -1 {
-			uuidLen = uuid.Len()
-			if uuidLen == 2 {
-				w.WriteByte(0x01) // TODO: constants for 16bit vs 128bit uuid magic numbers here
-			} else {
-				w.WriteByte(0x02)
+// blocked reports whether a request of type reqType
+// must be refused because the server is paused.
+func (c *l2cap) blocked(reqType byte, req []byte) bool {
+	c.pausemu.RLock()
+	defer c.pausemu.RUnlock()
+	if !c.paused {
+		return false
+	}
+
+	switch reqType {
+	case attOpMtuReq, attOpMtuResp, attOpError, attOpHandleCnf, attOpFindInfoReq, attOpFindByTypeReq, attOpReadByGroupReq:
+		// MTU exchanges, responses to our own requests, and discovery
+		// of the attribute table don't access attribute values.
+		return false
+	case attOpReadByTypeReq:
+		if len(req) < 4 {
+			return false // let the handler reject it
+		}
+		start, end := binary.LittleEndian.Uint16(req), binary.LittleEndian.Uint16(req[2:])
+		if c.allowedRange(start, end) {
+			return false
+		}
+		// Include and characteristic discovery reads declarations,
+		// not values, so it remains available.
+		uuid := UUID{reverse(req[4:])}
+		return !uuidEqual(uuid, gattAttrIncludeUUID) && !uuidEqual(uuid, gattAttrCharacteristicUUID)
+	case attOpReadMultiReq:
+		for b := req; len(b) >= 2; b = b[2:] {
+			if n := binary.LittleEndian.Uint16(b); !c.allowedRange(n, n) {
+				return true
 			}
 		}
-		if uuid.Len() != uuidLen {
-			break
+		return false
+	case attOpExecWriteReq:
+		for _, w := range c.conn.prepq {
+			if !c.allowedRange(w.n, w.n) {
+				return true
+			}
 		}
+		return false
+	}
 
-		w.Chunk()
-		w.WriteUint16(h.n)
-		w.WriteUUID(uuid)
-		if ok := w.Commit(); !ok {
-			break
+	n := reqHandle(reqType, req)
+	return !c.allowedRange(n, n)
+}
+
+// allowedRange reports whether the handle range [start,end]
+// lies entirely within a range that is accessible while paused.
+// c.pausemu must be held.
+func (c *l2cap) allowedRange(start, end uint16) bool {
+	for _, r := range c.allowed {
+		if start >= r[0] && end <= r[1] {
+			return true
 		}
 	}
+	return false
+}
 
-	if uuidLen == -1 {
-		return attErr{opcode: attOpFindInfoReq, handle: start, status: attEcodeAttrNotFound}.Marshal()
+func (c *l2cap) handleMTU(b []byte) []byte {
+	if len(b) < 2 {
+		return c.errResp(attErr{opcode: attOpMtuReq, handle: 0x0000, status: attEcodeInvalidPDU})
 	}
-	return w.Bytes()
+	// Echo the requested mtu, but never use less than 23,
+	// the minimum allowed by the BLE spec, which keeps the
+	// response writing code easier, nor more than maxMTU.
+	c.setMTU(binary.LittleEndian.Uint16(b))
+	return []byte{attOpMtuResp, b[0], b[1]}
 }
 
-func (c *l2cap) handleFindByType(b []byte) []byte {
-	start, end := readHandleRange(b)
+// currentMTU returns the MTU of the current connection.
+// It may be called concurrently with the eventloop.
+func (c *l2cap) currentMTU() uint16 {
+	c.connmu.RLock()
+	defer c.connmu.RUnlock()
+	return c.conn.mtu
+}
 
-	if uuid := (UUID{reverse(b[4:6])}); !uuidEqual(uuid, gattAttrPrimaryServiceUUID) {
-		return attErr{opcode: attOpFindByTypeReq, handle: start, status: attEcodeAttrNotFound}.Marshal()
+// connMTU returns the MTU of the connection with the central
+// at addr, or 23 if it is not connected.
+// It may be called concurrently with the eventloop.
+func (c *l2cap) connMTU(addr net.HardwareAddr) uint16 {
+	c.connmu.RLock()
+	defer c.connmu.RUnlock()
+	if conn, ok := c.conns[addr.String()]; ok {
+		return conn.mtu
 	}
+	return 23
+}
 
-	uuid := UUID{reverse(b[6:])}
+// connDataLength returns the maximum link layer payload sizes of the
+// connection with the central at addr, for transmission and reception,
+// or the defaults if addr is not connected.
+// It may be called concurrently with the eventloop.
+func (c *l2cap) connDataLength(addr net.HardwareAddr) (tx, rx int) {
+	c.connmu.RLock()
+	defer c.connmu.RUnlock()
+	if conn, ok := c.conns[addr.String()]; ok {
+		return conn.dataLen[0], conn.dataLen[1]
+	}
+	return llDefaultDataLen, llDefaultDataLen
+}
 
-	w := newL2capWriter(c.mtu)
-	w.WriteByte(attOpFindByTypeResp)
+// setMTU sets the connection MTU to mtu, but no less than 23 and
+// no more than maxMTU, if set, and reports any change to the handler.
+func (c *l2cap) setMTU(mtu uint16) {
+	if mtu < 23 {
+		mtu = 23
+	}
+	if c.maxMTU >= 23 && mtu > c.maxMTU {
+		mtu = c.maxMTU
+	}
+	c.connmu.Lock()
+	changed := mtu != c.conn.mtu
+	c.conn.mtu = mtu
+	c.connmu.Unlock()
+	if changed {
+		c.handler.mtuChanged(int(mtu))
+	}
+}
+
+// A clientReq is a request that we have made as a client.
+type clientReq struct {
+	conn  *attConn    // the connection to whose central it was sent
+	mtu   uint16      // for MTU exchanges, the MTU offered
+	respc chan []byte // receives the response; buffered
+}
+
+// handleResp delivers b, a response from the current central, to
+// the pending client request, if it was sent to that central. The
+// response to an MTU exchange sets the connection MTU first, on the
+// eventloop, as all changes to the connection state are made.
+func (c *l2cap) handleResp(b []byte) {
+	c.pendmu.Lock()
+	p := c.pending
+	if p != nil && p.conn == c.conn {
+		c.pending = nil
+	} else {
+		p = nil
+	}
+	c.pendmu.Unlock()
+	if p == nil {
+		// No request is waiting for this central; drop it.
+		return
+	}
+	if len(b) == 3 && b[0] == attOpMtuResp {
+		mtu := binary.LittleEndian.Uint16(b[1:])
+		if mtu > p.mtu {
+			mtu = p.mtu
+		}
+		c.setMTU(mtu)
+	}
+	p.respc <- append([]byte(nil), b...)
+}
+
+// handleCnf delivers a handle value confirmation from the current
+// central to its pending indication, if any. Unexpected confirmations
+// are ignored; an indication discards any stale confirmation before it
+// is sent.
+func (c *l2cap) handleCnf() {
+	select {
+	case c.conn.cnfc <- struct{}{}:
+	default:
+		// A confirmation is already pending; drop this one.
+	}
+}
+
+// exchangeMTU performs an MTU exchange with the current central,
+// acting as the client, offering preferred, or maxMTU if set and
+// smaller, as our receive MTU. It blocks until the central responds or
+// attTimeout elapses. The MTU of its connection is set to the smaller
+// of the offer and the central's MTU, but never less than the BLE
+// minimum of 23, as by setMTU, which reports any change to the
+// handler; see handleResp. exchangeMTU returns the new MTU.
+func (c *l2cap) exchangeMTU(preferred int) (int, error) {
+	if preferred < 23 || preferred > 0xffff {
+		return 0, fmt.Errorf("invalid mtu %d", preferred)
+	}
+	if c.maxMTU >= 23 && preferred > int(c.maxMTU) {
+		preferred = int(c.maxMTU)
+	}
+
+	c.reqmu.Lock()
+	defer c.reqmu.Unlock()
+
+	// The current connection may change while we wait,
+	// so the request and its response concern this one.
+	c.connmu.RLock()
+	conn := c.conn
+	c.connmu.RUnlock()
+	p := &clientReq{conn: conn, mtu: uint16(preferred), respc: make(chan []byte, 1)}
+	c.pendmu.Lock()
+	c.pending = p
+	c.pendmu.Unlock()
+	defer func() {
+		c.pendmu.Lock()
+		if c.pending == p {
+			c.pending = nil
+		}
+		c.pendmu.Unlock()
+	}()
+
+	req := []byte{attOpMtuReq, byte(preferred), byte(preferred >> 8)}
+	if err := c.sendTo(conn, req); err != nil {
+		return 0, err
+	}
+
+	var b []byte
+	select {
+	case b = <-p.respc:
+	case <-time.After(attTimeout):
+		return 0, errors.New("timed out waiting for mtu response")
+	}
+
+	switch {
+	case len(b) == 5 && b[0] == attOpError && b[1] == attOpMtuReq:
+		return 0, fmt.Errorf("mtu exchange failed: att error %#02x", b[4])
+	case len(b) != 3 || b[0] != attOpMtuResp:
+		return 0, fmt.Errorf("unexpected mtu response %x", b)
+	}
+
+	c.connmu.RLock()
+	defer c.connmu.RUnlock()
+	return int(conn.mtu), nil
+}
+
+func (c *l2cap) handleFindInfo(b []byte) []byte {
+	if len(b) < 4 {
+		return c.errResp(attErr{opcode: attOpFindInfoReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
+	start, end := readHandleRange(b)
+
+	w := c.respWriter(c.conn.mtu)
+	w.WriteUint8(attOpFindInfoResp)
+	uuidLen := -1
+	for _, h := range c.handles.Subrange(start, end) {
+		uuid, ok := h.attrType()
+		if !ok {
+			continue
+		}
+
+		if uuidLen == -1 {
+			uuidLen = uuid.Len()
+			if uuidLen == 2 {
+				w.WriteUint8(0x01) // TODO: constants for 16bit vs 128bit uuid magic numbers here
+			} else {
+				w.WriteUint8(0x02)
+			}
+		}
+		if uuid.Len() != uuidLen {
+			break
+		}
+
+		w.Chunk()
+		w.WriteUint16(h.n)
+		w.WriteUUID(uuid)
+		if ok := w.Commit(); !ok {
+			break
+		}
+	}
+
+	if uuidLen == -1 {
+		return c.errResp(attErr{opcode: attOpFindInfoReq, handle: start, status: attEcodeAttrNotFound})
+	}
+	return w.Bytes()
+}
+
+func (c *l2cap) handleFindByType(b []byte) []byte {
+	if len(b) < 6 {
+		return c.errResp(attErr{opcode: attOpFindByTypeReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
+	start, end := readHandleRange(b)
+	typ, value := UUID{reverse(b[4:6])}, b[6:]
+
+	w := c.respWriter(c.conn.mtu)
+	w.WriteUint8(attOpFindByTypeResp)
 
 	var wrote bool
 	for _, h := range c.handles.Subrange(start, end) {
-		if !h.isPrimaryService(uuid) {
+		found, groupEnd, ok := c.findByTypeValue(h, typ, value)
+		if !ok {
 			continue
 		}
 		w.Chunk()
-		w.WriteUint16(h.startn)
-		w.WriteUint16(h.endn)
+		w.WriteUint16(found)
+		w.WriteUint16(groupEnd)
 		if ok := w.Commit(); !ok {
 			break
 		}
@@ -311,20 +1251,48 @@ func (c *l2cap) handleFindByType(b []byte) []byte {
 	}
 
 	if !wrote {
-		return attErr{opcode: attOpFindByTypeReq, handle: start, status: attEcodeAttrNotFound}.Marshal()
+		return c.errResp(attErr{opcode: attOpFindByTypeReq, handle: start, status: attEcodeAttrNotFound})
 	}
 
 	return w.Bytes()
 }
 
+// findByTypeValue reports whether the attribute h has type typ and
+// value value, for a Find By Type Value Request, and if so, returns
+// its handle and the end handle of its group. Attributes that don't
+// group others end their own group.
+func (c *l2cap) findByTypeValue(h handle, typ UUID, value []byte) (found, groupEnd uint16, ok bool) {
+	if uuidEqual(typ, gattAttrPrimaryServiceUUID) {
+		// Primary service discovery is by far the most common use;
+		// compare the UUIDs directly, rather than encoded values.
+		if !h.isPrimaryService(UUID{reverse(value)}) {
+			return 0, 0, false
+		}
+		return h.startn, h.endn, true
+	}
+
+	if t, ok := h.attrType(); !ok || !uuidEqual(typ, t) {
+		return 0, 0, false
+	}
+	v, status := c.readMultiValue(h.n, attMaxValueLen)
+	if status != attEcodeSuccess || !bytes.Equal(v, value) {
+		return 0, 0, false
+	}
+	return h.n, h.n, true
+}
+
 func (c *l2cap) handleReadByType(b []byte) []byte {
+	if len(b) != 6 && len(b) != 20 {
+		// The attribute type is a 16-bit or 128-bit UUID.
+		return c.errResp(attErr{opcode: attOpReadByTypeReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
 	start, end := readHandleRange(b)
 	uuid := UUID{reverse(b[4:])}
 
 	// TODO: Refactor out into two extra helper handle* functions?
 	if uuidEqual(uuid, gattAttrCharacteristicUUID) {
-		w := newL2capWriter(c.mtu)
-		w.WriteByte(attOpReadByTypeResp)
+		w := c.respWriter(c.conn.mtu)
+		w.WriteUint8(attOpReadByTypeResp)
 		uuidLen := -1
 		for _, h := range c.handles.Subrange(start, end) {
 			if h.typ != "characteristic" {
@@ -332,14 +1300,14 @@ func (c *l2cap) handleReadByType(b []byte) []byte {
 			}
 			if uuidLen == -1 {
 				uuidLen = h.uuid.Len()
-				w.WriteByte(byte(uuidLen + 5))
+				w.WriteUint8(byte(uuidLen + 5))
 			}
 			if h.uuid.Len() != uuidLen {
 				break
 			}
 			w.Chunk()
 			w.WriteUint16(h.startn)
-			w.WriteByte(byte(h.props))
+			w.WriteUint8(byte(h.props))
 			w.WriteUint16(h.valuen)
 			w.WriteUUID(h.uuid)
 			if ok := w.Commit(); !ok {
@@ -347,121 +1315,509 @@ func (c *l2cap) handleReadByType(b []byte) []byte {
 			}
 		}
 		if uuidLen == -1 {
-			return attErr{opcode: attOpReadByTypeReq, handle: start, status: attEcodeAttrNotFound}.Marshal()
+			return c.errResp(attErr{opcode: attOpReadByTypeReq, handle: start, status: attEcodeAttrNotFound})
 		}
 		return w.Bytes()
 	}
 
 	// TODO: Refactor out into two extra helper handle* functions?
 	// !bytes.Equal(uuid, gattAttrCharacteristicUUID)
-	var valuen uint16
-	var found bool
-	var secure bool
 
+	// Respond with the values of all matching attributes, in handle order,
+	// so long as they fit and are readable. All values in a response must
+	// have the same length; the first value determines it.
+	w := c.respWriter(c.conn.mtu)
+	w.WriteUint8(attOpReadByTypeResp)
+	var n int // number of values written
+	var valueLen int
+	var truncated bool
+
+loop:
 	for _, h := range c.handles.Subrange(start, end) {
-		if h.isCharacteristic(uuid) {
+		var valuen uint16
+		switch {
+		case h.isCharacteristic(uuid):
 			valuen = h.valuen
-			secure = h.secure&charRead != 0
-			found = true
+		case h.isDescriptor(uuid), h.typ == "include" && uuidEqual(uuid, gattAttrIncludeUUID):
+			valuen = h.n
+		default:
+			continue
+		}
+		declh := h // characteristic declaration, descriptor or include declaration
+
+		// Errors are only reported for the first match;
+		// later ones just end the response.
+		if status := c.readPerm(declh); status != attEcodeSuccess {
+			if n == 0 {
+				return c.errResp(attErr{opcode: attOpReadByTypeReq, handle: valuen, status: status})
+			}
 			break
 		}
-		if h.isDescriptor(uuid) {
-			valuen = h.n
-			secure = h.secure&charRead != 0
-			found = true
+
+		valueh, ok := c.handles.At(valuen)
+		if !ok {
+			// This can only happen (I think) if we've done
+			// a bad job constructing our handles. Don't let
+			// it take down the server.
+			if n == 0 {
+				return c.errResp(attErr{opcode: attOpReadByTypeReq, handle: valuen, status: attEcodeUnlikely})
+			}
+			break
+		}
+		data := c.attrValue(valueh)
+		if char, ok := declh.attr.(*Characteristic); ok && data == nil && declh.typ == "characteristic" {
+			// Ask server for data
+			if readsAsync(char) {
+				if n > 0 {
+					break
+				}
+				return c.readAsync(char, int(c.conn.mtu-4), 0, c.readByTypeResp(valuen))
+			}
+			var status byte
+			data, status = c.charReader(char)(char, int(c.conn.mtu-4), 0)
+			if status != StatusSuccess {
+				if n == 0 {
+					return c.errResp(attErr{opcode: attOpReadByTypeReq, handle: valuen, status: status})
+				}
+				break
+			}
+		}
+
+		switch {
+		case n == 0:
+			valueLen = readByTypeValueLen(w, data)
+			truncated = valueLen < len(data)
+			w.WriteUint8(byte(valueLen + 2))
+		case truncated || len(data) != valueLen:
+			break loop
+		}
+		w.Chunk()
+		w.WriteUint16(valuen)
+		w.WriteFit(data[:valueLen])
+		if ok := w.Commit(); !ok {
 			break
 		}
+		n++
 	}
 
-	if !found {
-		return attErr{opcode: attOpReadByTypeReq, handle: start, status: attEcodeAttrNotFound}.Marshal()
+	if n == 0 {
+		return c.errResp(attErr{opcode: attOpReadByTypeReq, handle: start, status: attEcodeAttrNotFound})
 	}
-	if secure && c.security > securityLow {
-		return attErr{opcode: attOpReadByTypeReq, handle: start, status: attEcodeAuthentication}.Marshal()
+	return w.Bytes()
+}
+
+// readByTypeResp returns a function that builds the response to a read
+// by type request whose only match is the attribute with handle valuen,
+// given its value and read status.
+func (c *l2cap) readByTypeResp(valuen uint16) func(data []byte, status byte) []byte {
+	mtu := c.conn.mtu
+	return func(data []byte, status byte) []byte {
+		if status != StatusSuccess {
+			return attErr{opcode: attOpReadByTypeReq, handle: valuen, status: status}.Marshal()
+		}
+		w := newL2capWriter(mtu)
+		w.WriteUint8(attOpReadByTypeResp)
+		datalen := readByTypeValueLen(w, data)
+		w.WriteUint8(byte(datalen + 2))
+		w.WriteUint16(valuen)
+		w.WriteFit(data[:datalen])
+		return w.Bytes()
 	}
+}
 
-	valueh, ok := c.handles.At(valuen)
-	if !ok {
-		// This can only happen (I think) if we've done
-		// a bad job constructing our handles.
-		panic(fmt.Errorf("bad value handle reading %x: %v\n\nHandles: %#v", uuid, valuen, c.handles))
+// readByTypeValueLen returns the length of the prefix of data that
+// fits in the read by type response being written to w, which holds
+// just the opcode, after the length byte and the attribute handle.
+// The length byte can describe at most attReadByTypeMaxValueLen bytes.
+func readByTypeValueLen(w *l2capWriter, data []byte) int {
+	n := w.Writeable(3, data)
+	if n > attReadByTypeMaxValueLen {
+		n = attReadByTypeMaxValueLen
 	}
-	w := newL2capWriter(c.mtu)
-	datalen := w.Writeable(4, valueh.value)
-	w.WriteByte(attOpReadByTypeResp)
-	w.WriteByte(byte(datalen + 2))
-	w.WriteUint16(valuen)
-	w.WriteFit(valueh.value)
+	return n
+}
 
-	return w.Bytes()
+// readPerm reports whether the attribute whose permissions are
+// described by h may be read over the current connection.
+// h is a characteristic declaration or a descriptor; reads of
+// characteristic values must also be authorized by the handler.
+// It returns attEcodeSuccess or the appropriate ATT error code.
+// All read requests must check permissions using readPerm,
+// so that a value is equally readable regardless of opcode.
+func (c *l2cap) readPerm(h handle) byte {
+	if h.props&charRead == 0 {
+		return attEcodeReadNotPerm
+	}
+	if status := c.securityPerm(h, charRead); status != attEcodeSuccess {
+		return status
+	}
+	if char, ok := h.attr.(*Characteristic); ok && h.typ == "characteristic" {
+		if !c.handler.authorizeRead(char, c.conn.addr) {
+			return attEcodeAuthorization
+		}
+	}
+	return attEcodeSuccess
+}
+
+// securityPerm reports whether the property flag of the attribute
+// described by h may be used at the connection's security level.
+// Links that are not encrypted, when encryption is all that is
+// required, fail with attEcodeInsuffEnc; links lacking authentication
+// fail with attEcodeAuthentication.
+func (c *l2cap) securityPerm(h handle, flag uint) byte {
+	if h.secure&flag == 0 || c.conn.security >= h.security {
+		return attEcodeSuccess
+	}
+	if h.security == SecurityMedium {
+		return attEcodeInsuffEnc
+	}
+	return attEcodeAuthentication
 }
 
 func (c *l2cap) handleRead(reqType byte, b []byte) []byte {
+	if len(b) < 2 || reqType == attOpReadBlobReq && len(b) < 4 {
+		return c.errResp(attErr{opcode: reqType, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
 	valuen := binary.LittleEndian.Uint16(b)
 	var offset uint16
 	if reqType == attOpReadBlobReq {
 		offset = binary.LittleEndian.Uint16(b[2:])
 	}
 	respType := attRespFor[reqType]
-	_ = offset
 
 	h, ok := c.handles.At(valuen)
 	if !ok {
-		return attErr{opcode: reqType, handle: valuen, status: attEcodeInvalidHandle}.Marshal()
+		return c.errResp(attErr{opcode: reqType, handle: valuen, status: attEcodeInvalidHandle})
 	}
 
-	w := newL2capWriter(c.mtu)
-	w.WriteByte(respType)
+	w := c.respWriter(c.conn.mtu)
+	w.WriteUint8(respType)
 	w.Chunk()
 
 	switch h.typ {
 	case "service", "includedService":
 		w.WriteUUID(h.uuid)
+	case "include":
+		w.WriteFit(h.value)
 	case "characteristic":
-		w.WriteByte(byte(h.props))
+		w.WriteUint8(byte(h.props))
 		w.WriteUint16(h.valuen)
 		w.WriteUUID(h.uuid)
 	case "characteristicValue", "descriptor":
 		valueh := h
 		if h.typ == "characteristicValue" {
-			vh, ok := c.handles.At(valuen - 1) // TODO: Store a cross-reference explicitly instead of this -1 nonsense.
+			vh, ok := c.handles.At(h.decln)
 			if !ok {
-				panic(fmt.Errorf("invalid handle reference reading characteristicValue handle %d: %v\n\nHandles: %#v", valuen-1, c.handles))
+				// A bad handle table; see handleReadByType.
+				return c.errResp(attErr{opcode: reqType, handle: valuen, status: attEcodeUnlikely})
 			}
 			valueh = vh
 		}
-		if valueh.props&charRead == 0 {
-			return attErr{opcode: reqType, handle: valuen, status: attEcodeReadNotPerm}.Marshal()
-		}
-		if valueh.secure&charRead != 0 && c.security > securityLow {
-			return attErr{opcode: reqType, handle: valuen, status: attEcodeAuthentication}.Marshal()
+		if status := c.readPerm(valueh); status != attEcodeSuccess {
+			return c.errResp(attErr{opcode: reqType, handle: valuen, status: status})
 		}
-		if h.value != nil {
-			w.WriteFit(h.value)
+		char, ischar := valueh.attr.(*Characteristic) // TODO: Rethink attr being interface{}
+		if v := c.attrValue(h); v != nil || !ischar {
+			// Descriptors without a value are empty.
+			w.WriteFit(v)
 		} else {
 			// Ask server for data
-			char := valueh.attr.(*Characteristic) // TODO: Rethink attr being interface{}
-			data, status := c.handler.readChar(char, int(c.mtu-1), int(offset))
+			if readsAsync(char) {
+				// The response is built after this request has been
+				// handled, so it cannot use w; see respWriter.
+				mtu := c.conn.mtu
+				return c.readAsync(char, int(mtu-1), int(offset), func(data []byte, status byte) []byte {
+					if status != StatusSuccess {
+						return attErr{opcode: reqType, handle: valuen, status: status}.Marshal()
+					}
+					w := newL2capWriter(mtu)
+					w.WriteUint8(respType)
+					w.WriteFit(data)
+					return w.Bytes()
+				})
+			}
+			data, status := c.charReader(char)(char, int(c.conn.mtu-1), int(offset))
 			if status != StatusSuccess {
-				return attErr{opcode: reqType, handle: valuen, status: byte(status)}.Marshal()
+				return c.errResp(attErr{opcode: reqType, handle: valuen, status: byte(status)})
 			}
 			w.WriteFit(data)
 			offset = 0 // the handler has already adjusted for the offset
 		}
 	default:
 		// Shouldn't happen?
-		return attErr{opcode: reqType, handle: valuen, status: attEcodeInvalidHandle}.Marshal()
+		return c.errResp(attErr{opcode: reqType, handle: valuen, status: attEcodeInvalidHandle})
 	}
 
 	if ok := w.ChunkSeek(offset); !ok {
-		return attErr{opcode: reqType, handle: valuen, status: attEcodeInvalidOffset}.Marshal()
+		return c.errResp(attErr{opcode: reqType, handle: valuen, status: attEcodeInvalidOffset})
 	}
 
 	w.CommitFit()
 	return w.Bytes()
 }
 
+// handleReadMulti handles a Read Multiple Request, which reads the
+// values of two or more attributes at once. The values are concatenated,
+// so the central must know their lengths; if they do not all fit, the
+// response is truncated. If any attribute cannot be read, the request
+// fails, reporting the first such attribute.
+func (c *l2cap) handleReadMulti(b []byte) []byte {
+	if len(b) < 4 || len(b)%2 != 0 {
+		return c.errResp(attErr{opcode: attOpReadMultiReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
+
+	w := c.respWriter(c.conn.mtu)
+	w.WriteUint8(attOpReadMultiResp)
+	room := int(c.conn.mtu - 1)
+	for ; len(b) > 0; b = b[2:] {
+		n := binary.LittleEndian.Uint16(b)
+		// Read as much as a single value could use; later
+		// values are truncated if earlier ones fill the response.
+		data, status := c.readMultiValue(n, int(c.conn.mtu-1))
+		if status != attEcodeSuccess {
+			return c.errResp(attErr{opcode: attOpReadMultiReq, handle: n, status: status})
+		}
+		if len(data) > room {
+			data = data[:room]
+		}
+		room -= len(data)
+		w.WriteFit(data)
+	}
+	return w.Bytes()
+}
+
+// readMultiValue reads up to maxlen bytes of the value of the attribute
+// with handle n, for a Read Multiple or Find By Type Value Request.
+// Reading the values of characteristics that must be read using
+// readAsync would hold up the eventloop, so those reads fail with
+// attEcodeReqNotSupp; centrals can read such values one at a time.
+func (c *l2cap) readMultiValue(n uint16, maxlen int) (data []byte, status byte) {
+	h, ok := c.handles.At(n)
+	if !ok {
+		return nil, attEcodeInvalidHandle
+	}
+
+	switch h.typ {
+	case "service", "includedService":
+		w := c.respWriter(attMaxValueLen)
+		w.WriteUUID(h.uuid)
+		return w.Bytes(), attEcodeSuccess
+	case "include":
+		return h.value, attEcodeSuccess
+	case "characteristic":
+		w := c.respWriter(attMaxValueLen)
+		w.WriteUint8(byte(h.props))
+		w.WriteUint16(h.valuen)
+		w.WriteUUID(h.uuid)
+		return w.Bytes(), attEcodeSuccess
+	case "characteristicValue", "descriptor":
+	default:
+		return nil, attEcodeInvalidHandle
+	}
+
+	valueh := h
+	if h.typ == "characteristicValue" {
+		if valueh, ok = c.handles.At(h.decln); !ok {
+			// A bad handle table; see handleReadByType.
+			return nil, attEcodeUnlikely
+		}
+	}
+	if status := c.readPerm(valueh); status != attEcodeSuccess {
+		return nil, status
+	}
+	char, ischar := valueh.attr.(*Characteristic)
+	if v := c.attrValue(h); v != nil || !ischar {
+		return v, attEcodeSuccess
+	}
+	if readsAsync(char) {
+		return nil, attEcodeReqNotSupp
+	}
+	return c.charReader(char)(char, maxlen, 0)
+}
+
+// readsAsync reports whether reads of char's value
+// must be performed using readAsync.
+func readsAsync(char *Characteristic) bool {
+	return char.arhandler != nil
+}
+
+// charReader returns the function with which to read
+// up to maxlen bytes of char's value, starting at offset,
+// unless readsAsync(char).
+func (c *l2cap) charReader(char *Characteristic) func(char *Characteristic, maxlen int, offset int) ([]byte, byte) {
+	switch {
+	case char.mustFit:
+		return c.readWhole
+	case char.snapshot > 0:
+		return c.readSnapshot
+	}
+	return c.readChar
+}
+
+// readChar reads up to maxlen bytes of char's value, starting
+// at offset, on behalf of the connected central.
+func (c *l2cap) readChar(char *Characteristic, maxlen int, offset int) (data []byte, status byte) {
+	pmaxlen, poffset := probeOffset(maxlen, offset)
+	data, status = c.handler.readChar(char, c.conn.addr, pmaxlen, poffset)
+	return probed(data, status, offset)
+}
+
+// probeOffset returns the maxlen and offset with which to ask a read
+// handler for up to maxlen bytes of a value, starting at offset, so
+// that the server can tell whether offset is past the end of the value,
+// which only the handler knows. Reads at an offset other than 0 start
+// a byte early: if the handler has no byte to return there, offset is
+// past the end. See probed.
+func probeOffset(maxlen, offset int) (pmaxlen, poffset int) {
+	if offset == 0 {
+		return maxlen, 0
+	}
+	return maxlen + 1, offset - 1
+}
+
+// probed returns the value read by a handler as arranged by
+// probeOffset, starting at offset, or StatusInvalidOffset
+// if offset is past the end of the value.
+func probed(data []byte, status byte, offset int) ([]byte, byte) {
+	if status != StatusSuccess || offset == 0 {
+		return data, status
+	}
+	if len(data) == 0 {
+		return nil, StatusInvalidOffset
+	}
+	return data[1:], StatusSuccess
+}
+
+// readWhole reads char's value, starting at offset. If the whole value
+// is longer than maxlen, so that a central cannot read it in one PDU,
+// readWhole fails with StatusInvalidValueLength. See Characteristic.MustFitMTU.
+func (c *l2cap) readWhole(char *Characteristic, maxlen int, offset int) (data []byte, status byte) {
+	data, status = c.handler.readChar(char, c.conn.addr, attMaxValueLen, 0)
+	if status != StatusSuccess {
+		return nil, status
+	}
+	if len(data) > maxlen {
+		if char.tooLong != nil {
+			char.tooLong(len(data), int(c.conn.mtu))
+		}
+		return nil, StatusInvalidValueLength
+	}
+	if offset > len(data) {
+		return nil, StatusInvalidOffset
+	}
+	return data[offset:], StatusSuccess
+}
+
+// An asyncRead is an outstanding asynchronous read.
+type asyncRead struct {
+	conn   *attConn      // the central that made the read
+	done   chan struct{} // closed once the read is complete
+	cancel chan struct{} // closed to abandon the read
+}
+
+// readAsync reads up to maxlen bytes of char's value, starting at offset,
+// using its AsyncReadHandler, without blocking the eventloop. Once the
+// value is available, or attTimeout elapses, the response built by
+// respond is sent. readAsync returns nil, since there is no response
+// to send yet.
+func (c *l2cap) readAsync(char *Characteristic, maxlen int, offset int, respond func(data []byte, status byte) []byte) []byte {
+	conn := c.conn
+	pmaxlen, poffset := probeOffset(maxlen, offset)
+	resc := c.handler.readCharAsync(char, conn.addr, pmaxlen, poffset)
+	a := &asyncRead{conn: conn, done: make(chan struct{}), cancel: make(chan struct{})}
+	c.async = a
+	quit := c.quit
+	go func() {
+		defer close(a.done)
+		var res ReadResult
+		select {
+		case res = <-resc:
+		case <-time.After(attTimeout):
+			res.Status = StatusUnexpectedError
+		case <-a.cancel:
+			return
+		case <-quit:
+			return
+		}
+		select {
+		case <-a.cancel:
+			// Abandoned while the result arrived.
+			return
+		default:
+		}
+		if len(res.Value) > pmaxlen {
+			res.Value = res.Value[:pmaxlen]
+		}
+		res.Value, res.Status = probed(res.Value, res.Status, offset)
+		// Errors sending to the shim also surface
+		// in the eventloop, which reads from it.
+		c.sendTo(conn, respond(res.Value, res.Status))
+	}()
+	return nil
+}
+
+// waitAsync waits for the outstanding asynchronous read, if any,
+// to complete.
+func (c *l2cap) waitAsync() {
+	if c.async != nil {
+		<-c.async.done
+		c.async = nil
+	}
+}
+
+// cancelAsync abandons the outstanding asynchronous read, if any;
+// its response will not be sent.
+func (c *l2cap) cancelAsync() {
+	if c.async != nil {
+		close(c.async.cancel)
+		c.async = nil
+	}
+}
+
+// A snapshot is a characteristic value held for a long read.
+type snapshot struct {
+	value   []byte
+	expires time.Time
+}
+
+// readSnapshot reads up to maxlen bytes of char's value, starting at offset,
+// from a snapshot of the full value taken when it was read from offset 0,
+// or, if no read sequence is in progress, when it was read at offset.
+// See Characteristic.SnapshotLongReads.
+func (c *l2cap) readSnapshot(char *Characteristic, maxlen int, offset int) (data []byte, status byte) {
+	now := c.now()
+	n := c.valuens[char]
+	snaps := c.conn.snaps // each central reads in its own sequence
+	snap, ok := snaps[n]
+	if offset == 0 || !ok || now.After(snap.expires) {
+		// Start a new read sequence.
+		value, status := c.handler.readChar(char, c.conn.addr, attMaxValueLen, 0)
+		if status != StatusSuccess {
+			delete(snaps, n)
+			return nil, status
+		}
+		snap = snapshot{value: value, expires: now.Add(char.snapshot)}
+	}
+
+	if offset > len(snap.value) {
+		delete(snaps, n)
+		return nil, StatusInvalidOffset
+	}
+	data = snap.value[offset:]
+	if len(data) < maxlen {
+		// This is the last piece; the read sequence is complete.
+		delete(snaps, n)
+		return data, StatusSuccess
+	}
+	snaps[n] = snap
+	return data[:maxlen], StatusSuccess
+}
+
 func (c *l2cap) handleReadByGroup(b []byte) []byte {
+	if len(b) != 6 && len(b) != 20 {
+		// The group type is a 16-bit or 128-bit UUID.
+		return c.errResp(attErr{opcode: attOpReadByGroupReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
 	start, end := readHandleRange(b)
 	uuid := UUID{reverse(b[4:])}
 
@@ -469,14 +1825,16 @@ func (c *l2cap) handleReadByGroup(b []byte) []byte {
 	switch {
 	case uuidEqual(uuid, gattAttrPrimaryServiceUUID):
 		typ = "service"
-	case uuidEqual(uuid, gattAttrIncludeUUID):
+	case uuidEqual(uuid, gattAttrSecondaryServiceUUID):
 		typ = "includedService"
 	default:
-		return attErr{opcode: attOpReadByGroupReq, handle: start, status: attEcodeUnsuppGrpType}.Marshal()
+		// Include declarations are not groups; centrals
+		// discover them using Read By Type Requests.
+		return c.errResp(attErr{opcode: attOpReadByGroupReq, handle: start, status: attEcodeUnsuppGrpType})
 	}
 
-	w := newL2capWriter(c.mtu)
-	w.WriteByte(attOpReadByGroupResp)
+	w := c.respWriter(c.conn.mtu)
+	w.WriteUint8(attOpReadByGroupResp)
 	uuidLen := -1
 	for _, h := range c.handles.Subrange(start, end) {
 		if h.typ != typ {
@@ -484,7 +1842,7 @@ func (c *l2cap) handleReadByGroup(b []byte) []byte {
 		}
 		if uuidLen == -1 {
 			uuidLen = h.uuid.Len()
-			w.WriteByte(byte(uuidLen + 4))
+			w.WriteUint8(byte(uuidLen + 4))
 		}
 		if uuidLen != h.uuid.Len() {
 			break
@@ -498,88 +1856,693 @@ func (c *l2cap) handleReadByGroup(b []byte) []byte {
 		}
 	}
 	if uuidLen == -1 {
-		return attErr{opcode: attOpReadByGroupReq, handle: start, status: attEcodeAttrNotFound}.Marshal()
+		return c.errResp(attErr{opcode: attOpReadByGroupReq, handle: start, status: attEcodeAttrNotFound})
 	}
 
 	return w.Bytes()
 }
 
 func (c *l2cap) handleWrite(reqType byte, b []byte) []byte {
+	// Write Commands never get a response, not even an error.
+	noResp := reqType == attOpWriteCmd
+	if len(b) < 2 {
+		if noResp {
+			return nil
+		}
+		return c.errResp(attErr{opcode: reqType, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
 	valuen := binary.LittleEndian.Uint16(b)
+	// A zero-length write is legitimate; some profiles use them
+	// as triggers. data is then empty, but never nil.
 	data := b[2:]
 
-	h, ok := c.handles.At(valuen)
+	h, status := c.writeTarget(reqType, valuen)
+	if status == attEcodeSuccess {
+		status = c.checkWrite(h, data)
+	}
+	if status == attEcodeSuccess {
+		status = c.write(h, data, noResp)
+	}
+	if noResp {
+		return nil
+	}
+	if status != StatusSuccess {
+		return c.errResp(attErr{opcode: reqType, handle: valuen, status: status})
+	}
+	return []byte{attOpWriteResp}
+}
+
+// writeTarget returns the handle that governs writes to the attribute
+// with handle n: the characteristic declaration for characteristic
+// values, or the descriptor itself. status reports whether a request of
+// type reqType may write to the attribute, including whether the handler
+// authorizes writes of the characteristic value.
+func (c *l2cap) writeTarget(reqType byte, n uint16) (h handle, status byte) {
+	h, ok := c.handles.At(n)
 	if !ok {
-		return attErr{opcode: reqType, handle: valuen, status: attEcodeInvalidHandle}.Marshal()
+		return h, attEcodeInvalidHandle
 	}
 
-	if h.typ == "characteristicValue" {
-		vh, ok := c.handles.At(valuen - 1) // TODO: Clean this up somehow by storing a better ref explicitly.
+	switch h.typ {
+	case "characteristicValue":
+		vh, ok := c.handles.At(h.decln)
 		if !ok {
-			panic(fmt.Errorf("invalid handle reference writing characteristicValue handle %d: %v\n\nHandles: %#v", valuen-1, c.handles))
+			// A bad handle table; see handleReadByType.
+			return h, attEcodeUnlikely
 		}
 		h = vh
+	case "descriptor":
+	default:
+		// Declarations are read-only.
+		return h, attEcodeWriteNotPerm
 	}
 
-	noResp := reqType == attOpWriteCmd
+	// The CCC may be written with either a Write Request or a
+	// Write Command; some centrals use the latter.
 	charFlag := uint(charWrite)
-	if noResp {
+	if reqType == attOpWriteCmd && !h.isDescriptor(gattAttrClientCharacteristicConfigUUID) {
 		charFlag = charWriteNR
 	}
 
 	if h.props&charFlag == 0 {
-		return attErr{opcode: reqType, handle: valuen, status: attEcodeWriteNotPerm}.Marshal()
+		return h, attEcodeWriteNotPerm
 	}
-	if h.secure&charFlag == 0 && c.security > securityLow {
-		return attErr{opcode: reqType, handle: valuen, status: attEcodeAuthentication}.Marshal()
+	if status := c.securityPerm(h, charFlag); status != attEcodeSuccess {
+		return h, status
 	}
+	if char, ok := h.attr.(*Characteristic); ok && h.typ == "characteristic" {
+		if !c.handler.authorizeWrite(char, c.conn.addr) {
+			return h, attEcodeAuthorization
+		}
+	}
+	return h, attEcodeSuccess
+}
+
+// checkWrite reports whether data may be written to the attribute
+// governed by h, as returned by writeTarget, before it is written.
+// Characteristic values must fit the characteristic's maximum or fixed
+// length and pass its validator, if any; see Characteristic.ValidateWrite.
+func (c *l2cap) checkWrite(h handle, data []byte) (status byte) {
+	if h.typ == "descriptor" {
+		return StatusSuccess
+	}
+	char := h.attr.(*Characteristic)
+	if len(data) > char.maxLength() || char.fixedLen && len(data) != char.maxLen {
+		return attEcodeInvalAttrValueLen
+	}
+	return c.handler.validateWrite(char, data)
+}
 
-	if h.typ != "descriptor" && !uuidEqual(h.uuid, gattAttrClientCharacteristicConfigUUID) {
+// write writes data to the attribute governed by h,
+// as returned by writeTarget, and returns the resulting status.
+func (c *l2cap) write(h handle, data []byte, noResp bool) (status byte) {
+	if h.typ != "descriptor" {
 		// Regular write, not CCC
-		result := c.handler.writeChar(h.attr.(*Characteristic), data, noResp)
-		if noResp {
-			return nil
-		}
-		if result != StatusSuccess {
-			return attErr{opcode: reqType, handle: valuen, status: byte(result)}.Marshal()
-		}
-		return []byte{attOpWriteResp}
+		return c.handler.writeChar(h.attr.(*Characteristic), c.conn.addr, data, noResp)
+	}
+	if !h.isDescriptor(gattAttrClientCharacteristicConfigUUID) {
+		// Only descriptors with a write handler get past writeTarget.
+		return c.handler.writeDesc(h.attr.(*desc), c.conn.addr, data)
 	}
 
-	// CCC/descriptor write
+	// CCC write
 	if len(data) != 2 {
-		return attErr{opcode: reqType, handle: valuen, status: attEcodeInvalAttrValueLen}.Marshal()
+		return attEcodeInvalAttrValueLen
 	}
 
-	ccc := binary.LittleEndian.Uint16(data)
-	char := h.attr.(*Characteristic)
-	h.value = data
+	c.setCCC(c.conn.addr, h.attr.(*Characteristic), binary.LittleEndian.Uint16(data))
+	return StatusSuccess
+}
 
+// setCCC sets the client characteristic configuration of char for the
+// central at addr to ccc. Each central has its own configurations;
+// notifications and indications of char are started when the first
+// central enables them, and stopped when the last one disables them.
+// Only the eventloop may call setCCC.
+func (c *l2cap) setCCC(addr net.HardwareAddr, char *Characteristic, ccc uint16) {
+	c.connmu.Lock()
+	prev := c.cccUnion(char)
+	cccs := c.cccs[addr.String()]
+	if cccs == nil {
+		cccs = make(map[*Characteristic]uint16)
+		c.cccs[addr.String()] = cccs
+	}
+	if ccc == 0 {
+		delete(cccs, char)
+	} else {
+		cccs[char] = ccc
+	}
+	now := c.cccUnion(char)
+	maxlen := int(c.conn.mtu - 3)
+	c.connmu.Unlock()
 	if ccc&gattCCCNotifyFlag == 0 {
-		// TODO: Suppress these calls if the notification state hasn't actually changed
+		// A central that subscribes again gets the current value.
+		c.forgetNotified(addr, char)
+	}
+
+	if char == c.svcchg {
+		// Sent by the l2cap itself; see indicateServiceChanged.
+		return
+	}
+
+	switch {
+	case now&gattCCCIndicateFlag != 0 && prev&gattCCCIndicateFlag == 0:
+		c.handler.startIndicate(char, maxlen)
+	case now&gattCCCIndicateFlag == 0 && prev&gattCCCIndicateFlag != 0:
+		c.handler.stopIndicate(char)
+	}
+	switch {
+	case now&gattCCCNotifyFlag != 0 && prev&gattCCCNotifyFlag == 0:
+		c.handler.startNotify(char, maxlen)
+	case now&gattCCCNotifyFlag == 0 && prev&gattCCCNotifyFlag != 0:
 		c.handler.stopNotify(char)
-		if noResp {
-			return nil
+	}
+}
+
+// cccUnion returns the combined client characteristic configurations
+// of char of all centrals. c.connmu must be held.
+func (c *l2cap) cccUnion(char *Characteristic) (ccc uint16) {
+	for _, cccs := range c.cccs {
+		ccc |= cccs[char]
+	}
+	return ccc
+}
+
+// dropCCCs clears the client characteristic configurations of the
+// central at addr, and forgets it. Only the eventloop may call dropCCCs.
+func (c *l2cap) dropCCCs(addr net.HardwareAddr) {
+	for char := range c.cccs[addr.String()] {
+		c.setCCC(addr, char, 0)
+	}
+	c.connmu.Lock()
+	delete(c.cccs, addr.String())
+	c.connmu.Unlock()
+}
+
+// A prepWrite is a queued prepared write fragment.
+type prepWrite struct {
+	n      uint16 // attribute handle
+	h      handle // governing handle, as returned by writeTarget
+	offset uint16
+	value  []byte
+}
+
+func (c *l2cap) handlePrepWrite(b []byte) []byte {
+	if len(b) < 4 {
+		return c.errResp(attErr{opcode: attOpPrepWriteReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
+	n := binary.LittleEndian.Uint16(b)
+	offset := binary.LittleEndian.Uint16(b[2:])
+	value := b[4:]
+
+	// Permissions are checked as each fragment is queued.
+	h, status := c.writeTarget(attOpPrepWriteReq, n)
+	if status != attEcodeSuccess {
+		return c.errResp(attErr{opcode: attOpPrepWriteReq, handle: n, status: status})
+	}
+
+	// Refuse to queue fragments beyond the end of the longest
+	// value that the attribute accepts.
+	maxLen := attMaxValueLen
+	if h.typ != "descriptor" {
+		maxLen = h.attr.(*Characteristic).maxLength()
+	}
+	if int(offset)+len(value) > maxLen || len(c.conn.prepq) >= attMaxPrepQueueLen {
+		return c.errResp(attErr{opcode: attOpPrepWriteReq, handle: n, status: attEcodePrepQueueFull})
+	}
+
+	c.conn.prepq = append(c.conn.prepq, prepWrite{n: n, h: h, offset: offset, value: append([]byte(nil), value...)})
+	if h.typ != "descriptor" {
+		var queued, frags int
+		for _, p := range c.conn.prepq {
+			if p.n == n {
+				queued += len(p.value)
+				frags++
+			}
 		}
-		return []byte{attOpWriteResp}
+		c.handler.prepareProgress(h.attr.(*Characteristic), queued, frags)
 	}
 
-	c.handler.startNotify(char, int(c.mtu-3))
-	if noResp {
+	// The response echoes the request, so that
+	// the central can verify what was queued.
+	w := c.respWriter(c.conn.mtu)
+	w.WriteUint8(attOpPrepWriteResp)
+	w.WriteFit(b)
+	return w.Bytes()
+}
+
+func (c *l2cap) handleExecWrite(b []byte) []byte {
+	if len(b) != 1 {
+		return c.errResp(attErr{opcode: attOpExecWriteReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
+	q := c.conn.prepq
+	c.conn.prepq = nil
+
+	switch b[0] {
+	case attExecWriteCancel:
+		return []byte{attOpExecWriteResp}
+	case attExecWriteCommit:
+	default:
+		return c.errResp(attErr{opcode: attOpExecWriteReq, handle: 0x0000, status: attEcodeInvalidPDU})
+	}
+
+	writes, errn, status := reassemble(q)
+	if status != attEcodeSuccess {
+		return c.errResp(attErr{opcode: attOpExecWriteReq, handle: errn, status: status})
+	}
+	if len(writes) == 0 {
+		return []byte{attOpExecWriteResp}
+	}
+
+	// Check each value, then let the application veto
+	// the whole set, before applying any of it.
+	for _, w := range writes {
+		if status := c.checkWrite(w.h, w.value); status != StatusSuccess {
+			return c.errResp(attErr{opcode: attOpExecWriteReq, handle: w.n, status: status})
+		}
+	}
+	pw := make([]PreparedWrite, len(writes))
+	for i, w := range writes {
+		pw[i] = PreparedWrite{Characteristic: w.h.owner(), Handle: w.n, Value: w.value}
+	}
+	if status := c.handler.validateWrites(pw); status != StatusSuccess {
+		return c.errResp(attErr{opcode: attOpExecWriteReq, handle: writes[0].n, status: status})
+	}
+
+	for _, w := range writes {
+		if status := c.write(w.h, w.value, false); status != StatusSuccess {
+			return c.errResp(attErr{opcode: attOpExecWriteReq, handle: w.n, status: status})
+		}
+	}
+	return []byte{attOpExecWriteResp}
+}
+
+// reassemble combines the fragments in q into one complete write per
+// attribute, in the order in which the attributes were first queued.
+// Each attribute's fragments are applied in offset order. If an offset
+// would leave a gap in the value, reassemble returns the handle of the
+// offending attribute and attEcodeInvalidOffset.
+func reassemble(q []prepWrite) (writes []prepWrite, errn uint16, status byte) {
+	idx := make(map[uint16]int) // handle -> index in writes
+	var frags [][]prepWrite
+	for _, f := range q {
+		i, ok := idx[f.n]
+		if !ok {
+			i = len(writes)
+			idx[f.n] = i
+			writes = append(writes, prepWrite{n: f.n, h: f.h})
+			frags = append(frags, nil)
+		}
+		frags[i] = append(frags[i], f)
+	}
+
+	for i := range writes {
+		ff := frags[i]
+		sort.Stable(byOffset(ff))
+		value := []byte{}
+		for _, f := range ff {
+			if int(f.offset) > len(value) {
+				return nil, f.n, attEcodeInvalidOffset
+			}
+			if end := int(f.offset) + len(f.value); end > len(value) {
+				value = append(value, make([]byte, end-len(value))...)
+			}
+			copy(value[f.offset:], f.value)
+		}
+		writes[i].value = value
+	}
+	return writes, 0, attEcodeSuccess
+}
+
+type byOffset []prepWrite
+
+func (b byOffset) Len() int           { return len(b) }
+func (b byOffset) Less(i, j int) bool { return b[i].offset < b[j].offset }
+func (b byOffset) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// sendNotification sends a notification of data for char to each
+// central that has subscribed to them, and returns the number of bytes
+// of data sent. data is truncated to fit in each central's MTU, as the
+// spec requires, so n may be less than len(data); if the centrals'
+// MTUs differ, n is the least sent to any of them. It returns an error
+// if char does not support notifications, or else the first error
+// sending to a central, having tried them all.
+func (c *l2cap) sendNotification(char *Characteristic, data []byte) (n int, err error) {
+	if char.props&charNotify == 0 {
+		return 0, errors.New("characteristic does not support notifications")
+	}
+	// Only notify centrals that have asked for it.
+	c.connmu.RLock()
+	subs := c.subscribers(char, gattCCCNotifyFlag)
+	c.connmu.RUnlock()
+
+	n = -1
+	for _, conn := range subs {
+		sent, serr := c.notifyTo(conn, char, data)
+		if serr != nil {
+			if err == nil {
+				err = serr
+			}
+			continue
+		}
+		if n < 0 || sent < n {
+			n = sent
+		}
+	}
+	if err != nil || n < 0 {
+		return 0, err
+	}
+	return n, nil
+}
+
+// notifyConn sends a notification of data for char to the
+// central at addr, truncated to fit that connection's MTU, if it has
+// subscribed to them. It returns an error if char does not support
+// notifications, or if addr is not connected.
+func (c *l2cap) notifyConn(addr net.HardwareAddr, char *Characteristic, data []byte) error {
+	if char.props&charNotify == 0 {
+		return errors.New("characteristic does not support notifications")
+	}
+	c.connmu.RLock()
+	conn, ok := c.conns[addr.String()]
+	subscribed := c.cccs[addr.String()][char]&gattCCCNotifyFlag != 0
+	c.connmu.RUnlock()
+	if !ok {
+		return errors.New(addr.String() + " is not connected")
+	}
+	if !subscribed {
+		// Only notify a central that has asked for it.
 		return nil
 	}
-	return []byte{attOpWriteResp}
+	_, err := c.notifyTo(conn, char, data)
+	return err
+}
+
+// subscriberMTU returns the least MTU of the centrals whose client
+// characteristic configurations of char have flag set, or the minimum
+// MTU of 23 if there are none.
+// It may be called concurrently with the eventloop.
+func (c *l2cap) subscriberMTU(char *Characteristic, flag uint16) uint16 {
+	c.connmu.RLock()
+	defer c.connmu.RUnlock()
+	var mtu uint16
+	for _, conn := range c.subscribers(char, flag) {
+		if mtu == 0 || conn.mtu < mtu {
+			mtu = conn.mtu
+		}
+	}
+	if mtu == 0 {
+		return 23
+	}
+	return mtu
+}
+
+// subscribers returns the connections of the centrals whose client
+// characteristic configurations of char have flag set, in address
+// order. c.connmu must be held.
+func (c *l2cap) subscribers(char *Characteristic, flag uint16) []*attConn {
+	var addrs []string
+	for addr, cccs := range c.cccs {
+		if cccs[char]&flag != 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	var conns []*attConn
+	for _, addr := range addrs {
+		if conn, ok := c.conns[addr]; ok {
+			conns = append(conns, conn)
+		} else if c.conn.addr.String() == addr {
+			// A central that the shim never announced.
+			conns = append(conns, c.conn)
+		}
+	}
+	return conns
+}
+
+// notifyTo sends a notification of data for char to the central of
+// conn, truncated to fit its MTU, unless char suppresses duplicates
+// and data is one (see duplicate). It returns the number of bytes of
+// data sent.
+func (c *l2cap) notifyTo(conn *attConn, char *Characteristic, data []byte) (n int, err error) {
+	c.connmu.RLock()
+	mtu := conn.mtu
+	c.connmu.RUnlock()
+	if c.duplicate(conn.addr, mtu, char, data) {
+		return 0, nil
+	}
+	n, err = c.notify(conn, mtu, char, data)
+	if err != nil {
+		c.forgetNotified(conn.addr, char)
+	}
+	return n, err
+}
+
+// duplicate reports whether data, truncated to fit in mtu, is the value
+// of char last notified to the central at addr, if char suppresses
+// duplicate notifications. If not, it records data as the last value.
+// See Characteristic.SuppressDuplicateNotifications.
+func (c *l2cap) duplicate(addr net.HardwareAddr, mtu uint16, char *Characteristic, data []byte) bool {
+	if !char.dedupe {
+		return false
+	}
+	if max := int(mtu) - 3; len(data) > max {
+		data = data[:max]
+	}
+	c.notifiedmu.Lock()
+	defer c.notifiedmu.Unlock()
+	last := c.notified[addr.String()]
+	if prev, ok := last[char]; ok && bytes.Equal(prev, data) {
+		return true
+	}
+	if last == nil {
+		last = make(map[*Characteristic][]byte)
+		c.notified[addr.String()] = last
+	}
+	last[char] = append([]byte(nil), data...)
+	return false
+}
+
+// forgetNotified forgets the value of char last notified to the
+// central at addr, so that the next notification is always sent.
+// If char is nil, it forgets all the central's values.
+func (c *l2cap) forgetNotified(addr net.HardwareAddr, char *Characteristic) {
+	c.notifiedmu.Lock()
+	defer c.notifiedmu.Unlock()
+	if char == nil {
+		delete(c.notified, addr.String())
+		return
+	}
+	delete(c.notified[addr.String()], char)
 }
 
-func (c *l2cap) sendNotification(char *Characteristic, data []byte) error {
-	w := newL2capWriter(c.mtu)
-	w.WriteByte(attOpHandleNotify)
-	w.WriteUint16(char.valuen)
+// notify sends a notification of data for char to the central of
+// conn, truncated to fit in mtu, and returns the number of bytes of
+// data sent. Notifications for a given characteristic are sent in the
+// order in which notify was called.
+func (c *l2cap) notify(conn *attConn, mtu uint16, char *Characteristic, data []byte) (n int, err error) {
+	w := newL2capWriter(mtu)
+	defer w.Release()
+	w.WriteUint8(attOpHandleNotify)
+	w.WriteUint16(c.valuens[char])
 	w.WriteFit(data)
 	b := w.Bytes()
-	return c.send(b)
+
+	c.beginSend()
+	defer c.endSend()
+	turn, done := c.notifyTurn(c.valuens[char])
+	<-turn
+	err = c.sendTo(conn, b)
+	done()
+	if err != nil {
+		return 0, err
+	}
+	return len(b) - 3, nil
+}
+
+// beginSend and endSend bracket the sending of a
+// notification or indication; see flush.
+func (c *l2cap) beginSend() {
+	c.notifymu.Lock()
+	defer c.notifymu.Unlock()
+	if c.sending == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.sending++
+}
+
+func (c *l2cap) endSend() {
+	c.notifymu.Lock()
+	defer c.notifymu.Unlock()
+	c.sending--
+	if c.sending == 0 {
+		close(c.idle)
+	}
+}
+
+// flush blocks until no notifications or indications are being sent,
+// including indications awaiting confirmation, or until ctx is done.
+func (c *l2cap) flush(ctx context.Context) error {
+	for {
+		c.notifymu.Lock()
+		sending, idle := c.sending, c.idle
+		c.notifymu.Unlock()
+		if sending == 0 {
+			return nil
+		}
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyTurn joins the queue for notifications of the characteristic
+// with value handle n. It returns a channel that is closed once the
+// callers that joined before have left, and a function with which to
+// leave the queue, which must be called exactly once. Callers thus
+// send in the order in which they called notifyTurn.
+func (c *l2cap) notifyTurn(n uint16) (turn <-chan struct{}, done func()) {
+	c.notifymu.Lock()
+	defer c.notifymu.Unlock()
+	prev, ok := c.notifyq[n]
+	if !ok {
+		prev = make(chan struct{})
+		close(prev)
+	}
+	next := make(chan struct{})
+	c.notifyq[n] = next
+	return prev, func() {
+		c.notifymu.Lock()
+		defer c.notifymu.Unlock()
+		if c.notifyq[n] == next {
+			// No one is waiting.
+			delete(c.notifyq, n)
+		}
+		close(next)
+	}
+}
+
+// errNotSubscribed reports an indication that was not sent,
+// because no central has subscribed to indications of its characteristic.
+var errNotSubscribed = errors.New("no central has subscribed to indications")
+
+// sendIndication sends an indication of data for char to each central
+// that has subscribed to them, in turn; see indicate. It returns
+// errNotSubscribed if none has, and an error if char does not support
+// indications. Otherwise, it returns the first error indicating a
+// central, having tried them all.
+func (c *l2cap) sendIndication(char *Characteristic, data []byte) error {
+	if char.props&charIndicate == 0 {
+		return errors.New("characteristic does not support indications")
+	}
+	c.connmu.RLock()
+	subs := c.subscribers(char, gattCCCIndicateFlag)
+	c.connmu.RUnlock()
+	if len(subs) == 0 {
+		return errNotSubscribed
+	}
+	var err error
+	for _, conn := range subs {
+		if ierr := c.indicate(conn, char, data); ierr != nil && err == nil {
+			err = ierr
+		}
+	}
+	return err
+}
+
+// indicate sends an indication of data for char to the central of
+// conn, truncated to fit its MTU, and blocks until the central confirms
+// it. It returns an error if no confirmation arrives within cnfTimeout.
+func (c *l2cap) indicate(conn *attConn, char *Characteristic, data []byte) error {
+	c.beginSend()
+	defer c.endSend()
+	conn.indmu.Lock()
+	defer conn.indmu.Unlock()
+
+	c.connmu.RLock()
+	mtu := conn.mtu
+	c.connmu.RUnlock()
+
+	w := newL2capWriter(mtu)
+	w.WriteUint8(attOpHandleInd)
+	w.WriteUint16(c.valuens[char])
+	w.WriteFit(data)
+
+	// Discard any stale confirmation.
+	select {
+	case <-conn.cnfc:
+	default:
+	}
+
+	err := c.sendTo(conn, w.Bytes())
+	w.Release()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-conn.cnfc:
+		return nil
+	case <-time.After(c.cnfTimeout):
+		return errors.New("timed out waiting for confirmation")
+	case <-c.quit:
+		return errors.New("l2cap closed")
+	}
+}
+
+// indicateServiceChanged indicates the handle range [start, end]
+// using the Service Changed characteristic to each central that has
+// subscribed to it, if any.
+func (c *l2cap) indicateServiceChanged(start, end uint16) error {
+	if c.svcchg == nil {
+		return errors.New("service changed characteristic not served")
+	}
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, start)
+	binary.LittleEndian.PutUint16(b[2:], end)
+	if err := c.sendIndication(c.svcchg, b); err != errNotSubscribed {
+		return err
+	}
+	return nil
+}
+
+// indicateSequence sends each of items as an indication in turn,
+// waiting for each to be confirmed before sending the next.
+// It stops at the first failure.
+func (c *l2cap) indicateSequence(items []IndicateItem) error {
+	for i, item := range items {
+		if err := c.sendIndication(item.Characteristic, item.Value); err != nil {
+			return &IndicateSequenceError{Confirmed: i, Err: err}
+		}
+		if item.Confirmed != nil {
+			item.Confirmed()
+		}
+	}
+	return nil
+}
+
+// attrValue returns the static value of h, if any.
+// For client characteristic configuration descriptors,
+// this is the configuration set by the connected central.
+func (c *l2cap) attrValue(h handle) []byte {
+	if h.isDescriptor(gattAttrClientCharacteristicConfigUUID) {
+		b := make([]byte, 2)
+		binary.LittleEndian.PutUint16(b, c.cccs[c.conn.addr.String()][h.attr.(*Characteristic)])
+		return b
+	}
+	return h.value
 }
 
+// readHandleRange reads a handle range from b, which
+// must be at least 4 bytes long.
+// Handle 0x0000 is invalid; ranges starting at
+// 0x0000 are treated as starting at 0x0001.
 func readHandleRange(b []byte) (start, end uint16) {
-	return binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:])
+	start, end = binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:])
+	if start == 0x0000 {
+		start = 0x0001
+	}
+	return start, end
 }
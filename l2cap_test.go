@@ -1,10 +1,19 @@
 package gatt
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -12,10 +21,14 @@ import (
 type testL2CShim struct {
 	readc  chan []byte
 	writec chan []byte
+	cmdc   chan Command // if non-nil, receives commands
 }
 
 func (t *testL2CShim) Read(b []byte) (int, error) {
-	r := <-t.readc
+	r, ok := <-t.readc
+	if !ok {
+		return 0, io.EOF
+	}
 	if len(r) > len(b) {
 		panic("fix this annoyance properly")
 	}
@@ -24,51 +37,236 @@ func (t *testL2CShim) Read(b []byte) (int, error) {
 }
 
 func (t *testL2CShim) Write(b []byte) (int, error) {
-	t.writec <- b
+	t.writec <- append([]byte(nil), b...) // writers may not retain b
 	return len(b), nil
 }
 
-func (t *testL2CShim) Close() error           { return nil }
-func (t *testL2CShim) Wait() error            { return nil }
-func (t *testL2CShim) Signal(os.Signal) error { return nil }
+func (t *testL2CShim) Close() error { return nil }
+func (t *testL2CShim) Wait() error  { return nil }
+func (t *testL2CShim) Control(cmd Command) error {
+	if t.cmdc != nil {
+		t.cmdc <- cmd
+	}
+	return nil
+}
 
 type testL2CapHandler struct {
 	l2c *l2cap
+
+	// number of calls to startNotify and stopNotify
+	started, stopped int
+	// number of calls to startIndicate and stopIndicate
+	startedInd, stoppedInd int
+
+	// validate, if non-nil, validates prepared writes
+	validate func(writes []PreparedWrite) byte
+
+	// phyc, if non-nil, receives PHY updates
+	phyc chan [2]PHY
+
+	// mtuc, if non-nil, receives MTU changes
+	mtuc chan int
+	// addrc, if non-nil, receives own address changes
+	addrc chan string
+	// securityc, if non-nil, receives security level changes
+	securityc chan SecurityLevel
+	// datalenc, if non-nil, receives data length changes
+	datalenc chan [2]int
+	// rssic, if non-nil, receives RSSI measurements
+	rssic chan int
+	// reopened is the number of calls to transportReopened
+	reopened int
+	// progress records prepared write progress
+	progress []string
+	// disconnects records the address and reason of each disconnection
+	disconnects []string
+	// peers records the kind and peer address of each read and write
+	peers []string
+	// authRead and authWrite, if non-nil, authorize reads and writes
+	authRead, authWrite func(c *Characteristic, hw net.HardwareAddr) bool
+	// notifiers and indicators are the running notifiers and indicators
+	notifiers, indicators map[*Characteristic]*notifier
 }
 
-func (testL2CapHandler) readChar(c *Characteristic, maxlen int, offset int) ([]byte, byte) {
+func (t *testL2CapHandler) readChar(c *Characteristic, hw net.HardwareAddr, maxlen int, offset int) ([]byte, byte) {
+	t.peers = append(t.peers, "read "+hw.String())
 	resp := newReadResponseWriter(maxlen)
-	c.rhandler.ServeRead(resp, new(ReadRequest))
+	c.serveRead(nil, resp, &ReadRequest{Cap: maxlen, Offset: offset})
 	return resp.bytes(), resp.status
 }
 
-func (testL2CapHandler) writeChar(c *Characteristic, data []byte, noResponse bool) byte {
-	return c.whandler.ServeWrite(Request{}, data)
+func (t *testL2CapHandler) readCharAsync(c *Characteristic, hw net.HardwareAddr, maxlen int, offset int) <-chan ReadResult {
+	t.peers = append(t.peers, "read async "+hw.String())
+	return c.arhandler.ServeReadAsync(&ReadRequest{Cap: maxlen, Offset: offset})
+}
+
+func (t *testL2CapHandler) writeChar(c *Characteristic, hw net.HardwareAddr, data []byte, noResponse bool) byte {
+	t.peers = append(t.peers, "write "+hw.String())
+	return c.serveWrite(nil, Request{}, data)
+}
+
+func (t *testL2CapHandler) writeDesc(d *desc, hw net.HardwareAddr, data []byte) byte {
+	t.peers = append(t.peers, "write desc "+hw.String())
+	return d.whandler.ServeWrite(Request{Characteristic: d.char}, data)
 }
 
 func (t *testL2CapHandler) startNotify(c *Characteristic, maxlen int) {
-	if c.notifier != nil {
+	t.started++
+	if t.notifiers[c] != nil {
 		return
 	}
-	c.notifier = newNotifier(t.l2c, c, maxlen)
-	c.nhandler.ServeNotify(Request{}, c.notifier)
+	n := newNotifier(t.l2c, c, maxlen)
+	t.notifiers[c] = n
+	c.serveNotify(Request{}, n)
 }
 
-func (testL2CapHandler) stopNotify(c *Characteristic) {
-	c.notifier.stop()
-	c.notifier = nil
+func (t *testL2CapHandler) startIndicate(c *Characteristic, maxlen int) {
+	t.startedInd++
+	if t.indicators[c] != nil {
+		return
+	}
+	n := newIndicator(t.l2c, c, maxlen)
+	t.indicators[c] = n
+	c.serveNotify(Request{}, n)
 }
 
-func (testL2CapHandler) connected(hw net.HardwareAddr)    {}
-func (testL2CapHandler) disconnected(hw net.HardwareAddr) {}
-func (testL2CapHandler) receivedRSSI(rssi int)            {}
-func (testL2CapHandler) receivedBDAddr(bdaddr string)     {}
+func (t *testL2CapHandler) stopIndicate(c *Characteristic) {
+	t.stoppedInd++
+	if n := t.indicators[c]; n != nil {
+		n.stop()
+		delete(t.indicators, c)
+	}
+}
 
-func TestServing(t *testing.T) {
-	h := new(testL2CapHandler)
+func (t *testL2CapHandler) stopNotify(c *Characteristic) {
+	t.stopped++
+	if n := t.notifiers[c]; n != nil {
+		n.stop()
+		delete(t.notifiers, c)
+	}
+}
+
+func (testL2CapHandler) connected(hw net.HardwareAddr) {}
+func (testL2CapHandler) switched(hw net.HardwareAddr)  {}
+func (t *testL2CapHandler) disconnected(hw net.HardwareAddr, reason DisconnectReason) {
+	t.disconnects = append(t.disconnects, hw.String()+" "+reason.String())
+}
+func (t *testL2CapHandler) receivedRSSI(rssi int) {
+	if t.rssic != nil {
+		t.rssic <- rssi
+	}
+}
+func (testL2CapHandler) receivedBDAddr(bdaddr string) {}
+func (t *testL2CapHandler) transportReopened()        { t.reopened++ }
+
+func (t *testL2CapHandler) ownAddressChanged(addr string) {
+	if t.addrc != nil {
+		t.addrc <- addr
+	}
+}
+
+func (t *testL2CapHandler) mtuChanged(mtu int) {
+	if t.mtuc != nil {
+		t.mtuc <- mtu
+	}
+}
+
+func (t *testL2CapHandler) securityChanged(level SecurityLevel) {
+	if t.securityc != nil {
+		t.securityc <- level
+	}
+}
+
+func (t *testL2CapHandler) dataLengthChanged(tx, rx int) {
+	if t.datalenc != nil {
+		t.datalenc <- [2]int{tx, rx}
+	}
+}
+
+func (t *testL2CapHandler) phyUpdated(tx, rx PHY) {
+	if t.phyc != nil {
+		t.phyc <- [2]PHY{tx, rx}
+	}
+}
+
+func (t *testL2CapHandler) prepareProgress(c *Characteristic, bytesQueued, fragments int) {
+	t.progress = append(t.progress, fmt.Sprintf("%v: %d bytes, %d fragments", c.uuid, bytesQueued, fragments))
+}
+
+func (t *testL2CapHandler) authorizeRead(c *Characteristic, hw net.HardwareAddr) bool {
+	return t.authRead == nil || t.authRead(c, hw)
+}
+
+func (t *testL2CapHandler) authorizeWrite(c *Characteristic, hw net.HardwareAddr) bool {
+	return t.authWrite == nil || t.authWrite(c, hw)
+}
+
+func (testL2CapHandler) validateWrite(c *Characteristic, data []byte) byte {
+	if c.validate == nil {
+		return StatusSuccess
+	}
+	return c.validate(data)
+}
+
+func (t *testL2CapHandler) validateWrites(writes []PreparedWrite) byte {
+	if t.validate == nil {
+		return StatusSuccess
+	}
+	return t.validate(writes)
+}
+
+// newTestL2cap returns an l2cap connected to a test shim and handler.
+func newTestL2cap() (*l2cap, *testL2CShim) {
+	h := &testL2CapHandler{
+		notifiers:  make(map[*Characteristic]*notifier),
+		indicators: make(map[*Characteristic]*notifier),
+	}
 	shim := &testL2CShim{readc: make(chan []byte), writec: make(chan []byte)}
 	l2c := newL2cap(shim, h)
 	h.l2c = l2c
+	return l2c, shim
+}
+
+// An rxtx is a single request/response exchange with an l2cap.
+// If send is empty, nothing is sent; the exchange just waits for want.
+// If event is set, it is sent as a raw shim line, and no response is expected.
+type rxtx struct {
+	name  string
+	event string
+	send  string
+	want  string
+	after func()
+}
+
+// runRxTx feeds each request in rr to shim,
+// and checks the responses against the expected ones.
+func runRxTx(t *testing.T, shim *testL2CShim, rr []rxtx) {
+	for _, tt := range rr {
+		if tt.event != "" {
+			shim.readc <- []byte(tt.event + "\n")
+			continue
+		}
+		if tt.send != "" {
+			shim.readc <- []byte("data " + tt.send + "\n")
+		}
+		resp := <-shim.writec
+		if resp[len(resp)-1] != '\n' {
+			t.Errorf("%s: sent %q, response %q does not end in \\n", tt.name, tt.send, resp)
+			continue
+		}
+		got := string(resp[:len(resp)-1]) // trim \n
+		if got != tt.want {
+			t.Errorf("%s: sent %q got %q want %q", tt.name, tt.send, got, tt.want)
+			continue
+		}
+		if tt.after != nil {
+			tt.after()
+		}
+	}
+}
+
+func TestServing(t *testing.T) {
+	l2c, shim := newTestL2cap()
 
 	var wrote []byte
 
@@ -125,24 +323,21 @@ func TestServing(t *testing.T) {
 	//   {3 0 0 0 characteristicValue [42 0] <nil> 0 0 []}
 	//   {4 4 5 0 characteristic [42 1] <ptr> 2 2 []}
 	//   {5 0 0 0 characteristicValue [42 1] <nil> 0 0 [0 128]}
-	//   {6 6 0 6 service [24 1] <ptr> 0 0 []}
-	//   {7 7 0 14 service [9 252 149 192 193 17 17 227 153 4 0 2 165 213 197 27] <ptr> 0 0 []}
-	//   {8 8 9 0 characteristic [17 250 201 224 193 17 17 227 146 70 0 2 165 213 197 27] <ptr> 2 2 []}
-	//   {9 0 0 0 characteristicValue [17 250 201 224 193 17 17 227 146 70 0 2 165 213 197 27] <nil> 0 0 []}
-	//   {10 10 11 0 characteristic [22 254 13 128 193 17 17 227 184 200 0 2 165 213 197 27] <ptr> 12 12 []}
-	//   {11 0 0 0 characteristicValue [22 254 13 128 193 17 17 227 184 200 0 2 165 213 197 27] <nil> 0 0 []}
-	//   {12 12 13 0 characteristic [28 146 123 80 193 22 17 227 138 51 8 0 32 12 154 102] <ptr> 16 16 []}
-	//   {13 0 0 0 characteristicValue [28 146 123 80 193 22 17 227 138 51 8 0 32 12 154 102] <nil> 0 0 []}
-	//   {14 0 0 0 descriptor [41 2] <ptr> 10 10 [0 0]}] 1}
+	//   {6 6 0 8 service [24 1] <ptr> 0 0 []}
+	//   {7 7 8 0 characteristic [43 58] <ptr> 2 2 []}
+	//   {8 0 0 0 characteristicValue [43 58] <nil> 0 0 [0]}
+	//   {9 9 0 16 service [9 252 149 192 193 17 17 227 153 4 0 2 165 213 197 27] <ptr> 0 0 []}
+	//   {10 10 11 0 characteristic [17 250 201 224 193 17 17 227 146 70 0 2 165 213 197 27] <ptr> 2 2 []}
+	//   {11 0 0 0 characteristicValue [17 250 201 224 193 17 17 227 146 70 0 2 165 213 197 27] <nil> 0 0 []}
+	//   {12 12 13 0 characteristic [22 254 13 128 193 17 17 227 184 200 0 2 165 213 197 27] <ptr> 12 12 []}
+	//   {13 0 0 0 characteristicValue [22 254 13 128 193 17 17 227 184 200 0 2 165 213 197 27] <nil> 0 0 []}
+	//   {14 14 15 0 characteristic [28 146 123 80 193 22 17 227 138 51 8 0 32 12 154 102] <ptr> 16 16 []}
+	//   {15 0 0 0 characteristicValue [28 146 123 80 193 22 17 227 138 51 8 0 32 12 154 102] <nil> 0 0 []}
+	//   {16 0 0 0 descriptor [41 2] <ptr> 10 10 [0 0]}] 1}
 
 	go l2c.listenAndServe()
 
-	rxtx := []struct {
-		name  string
-		send  string
-		want  string
-		after func()
-	}{
+	runRxTx(t, shim, []rxtx{
 		{
 			name: "set mtu to 135 -- mtu is 135",
 			send: "028700",
@@ -155,8 +350,8 @@ func TestServing(t *testing.T) {
 		},
 		{
 			name: "bad req -- unsupported",
-			send: "FF1234567890",
-			want: "01ff000006",
+			send: "3F1234567890",
+			want: "013f000006",
 		},
 		{
 			name: "find info [1,10] -- 1: 0x2800, 2: 0x2803, 3: 0x2a00, 4: 0x2803, 5: 0x2a01",
@@ -169,9 +364,9 @@ func TestServing(t *testing.T) {
 			want: "05010100002802000328",
 		},
 		{
-			name: "find by type [1,11] svc uuid -- handle range [7,14]",
+			name: "find by type [1,11] svc uuid -- handle range [9,16]",
 			send: "0601000B0000281bc5d5a502000499e31111c1c095fc09",
-			want: "0707000e00",
+			want: "0709001000",
 		},
 		{
 			name: "read by group [1,3] svc uuid -- unsupported group type at handle 1",
@@ -184,9 +379,9 @@ func TestServing(t *testing.T) {
 			want: "1106010005000018",
 		},
 		{
-			name: "read by group [1,14] 0x2800 -- group at [1,5]: 0x1800, [6,6]: 0x1801",
+			name: "read by group [1,14] 0x2800 -- group at [1,5]: 0x1800, [6,8]: 0x1801",
 			send: "1001000E000028",
-			want: "1106010005000018060006000118",
+			want: "1106010005000018060008000118",
 		},
 		{
 			name: "read by type [1,5] 0x2a00 (device name) -- found 2, 3",
@@ -205,12 +400,12 @@ func TestServing(t *testing.T) {
 		},
 		{
 			name: "read char -- 'count: 1'",
-			send: "0a0900",
+			send: "0a0b00",
 			want: "0b636f756e743a2031",
 		},
 		{
 			name: "write char 'abcdef' -- ok",
-			send: "120b00616263646566",
+			send: "120d00616263646566",
 			want: "13",
 			after: func() {
 				if string(wrote) != "abcdef" {
@@ -220,48 +415,3503 @@ func TestServing(t *testing.T) {
 		},
 		{
 			name: "start notify -- ok",
-			send: "120e000100",
+			send: "1210000100",
 			want: "13",
 		},
 		{
 			name: "-- notified 'Count: 0'",
-			want: "1b0d00436f756e743a2030",
+			want: "1b0f00436f756e743a2030",
 		},
 		{
 			name: "-- notified 'Count: 1'",
-			want: "1b0d00436f756e743a2031",
+			want: "1b0f00436f756e743a2031",
 		},
 		{
 			name: "-- notified 'Count: 2'",
-			want: "1b0d00436f756e743a2032",
+			want: "1b0f00436f756e743a2032",
 		},
 		{
 			name: "-- notified 'Count: 3'",
-			want: "1b0d00436f756e743a2033",
+			want: "1b0f00436f756e743a2033",
 		},
 		{
 			name: "stop notify -- ok",
-			send: "120e000000",
+			send: "1210000000",
 			want: "13",
 		},
+	})
+}
+
+func TestServerSupportedFeatures(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.features = gattServerFeatureEATT
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{
+			name: "find info [7,8] -- 7: 0x2803, 8: 0x2b3a",
+			send: "0407000800",
+			want: "05010700032808003a2b",
+		},
+		{
+			name: "read by type [1,ffff] 0x2b3a -- found 8: eatt",
+			send: "080100ffff3a2b",
+			want: "0903080001",
+		},
+		{
+			name: "read 8 -- eatt",
+			send: "0a0800",
+			want: "0b01",
+		},
+	})
+}
+
+func TestReadWriteOnly(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.chars = []*Characteristic{
+		&Characteristic{
+			service:  svc,
+			uuid:     UUID16(0xfff1),
+			props:    charWrite | charWriteNR,
+			secure:   charWrite | charWriteNR,
+			whandler: WriteHandlerFunc(func(r Request, data []byte) byte { return StatusSuccess }),
+		},
 	}
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
 
-	for _, tt := range rxtx {
-		if tt.send != "" {
-			shim.readc <- []byte("data " + tt.send + "\n")
+	runRxTx(t, shim, []rxtx{
+		{
+			name: "read 11 (write-only) -- read not permitted",
+			send: "0a0b00",
+			want: "010a0b0002",
+		},
+		{
+			name: "read by type [1,ffff] 0xfff1 (write-only) -- read not permitted",
+			send: "080100fffff1ff",
+			want: "01080b0002",
+		},
+	})
+}
+
+func TestReadPermConsistent(t *testing.T) {
+	newService := func() *Service {
+		svc := &Service{uuid: UUID16(0xfff0)}
+		read := ReadHandlerFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+			io.WriteString(resp, "hi")
+		})
+		svc.chars = []*Characteristic{
+			&Characteristic{
+				service:  svc,
+				uuid:     UUID16(0xfff1),
+				props:    charWrite,
+				secure:   charWrite,
+				whandler: WriteHandlerFunc(func(r Request, data []byte) byte { return StatusSuccess }),
+			},
+			&Characteristic{
+				service:  svc,
+				uuid:     UUID16(0xfff2),
+				props:    charRead,
+				secure:   charRead,
+				security: SecurityMedium,
+				rhandler: read,
+			},
+			&Characteristic{
+				service:  svc,
+				uuid:     UUID16(0xfff3),
+				props:    charRead,
+				secure:   charRead,
+				security: SecurityHigh,
+				rhandler: read,
+			},
 		}
-		resp := <-shim.writec
-		if resp[len(resp)-1] != '\n' {
-			t.Errorf("%s: sent %q, response %q does not end in \\n", tt.name, tt.send, resp)
-			continue
+		return svc
+	}
+
+	cases := []struct {
+		security SecurityLevel
+		rr       []rxtx
+	}{
+		{
+			security: SecurityLow,
+			rr: []rxtx{
+				{name: "read 11 (write-only)", send: "0a0b00", want: "010a0b0002"},
+				{name: "read by type 0xfff1 (write-only)", send: "080100fffff1ff", want: "01080b0002"},
+				{name: "read 13 (encrypted)", send: "0a0d00", want: "010a0d000f"},
+				{name: "read by type 0xfff2 (encrypted)", send: "080100fffff2ff", want: "01080d000f"},
+				{name: "read multiple 13 (encrypted)", send: "0e0d000f00", want: "010e0d000f"},
+				{name: "read 15 (authenticated)", send: "0a0f00", want: "010a0f0005"},
+				{name: "read by type 0xfff3 (authenticated)", send: "080100fffff3ff", want: "01080f0005"},
+			},
+		},
+		{
+			security: SecurityMedium,
+			rr: []rxtx{
+				{name: "read 11 (write-only)", send: "0a0b00", want: "010a0b0002"},
+				{name: "read 13 (encrypted)", send: "0a0d00", want: "0b6869"},
+				{name: "read by type 0xfff2 (encrypted)", send: "080100fffff2ff", want: "09040d006869"},
+				{name: "read 15 (authenticated)", send: "0a0f00", want: "010a0f0005"},
+				{name: "read by type 0xfff3 (authenticated)", send: "080100fffff3ff", want: "01080f0005"},
+			},
+		},
+		{
+			security: SecurityHigh,
+			rr: []rxtx{
+				{name: "read 11 (write-only)", send: "0a0b00", want: "010a0b0002"},
+				{name: "read 13 (encrypted)", send: "0a0d00", want: "0b6869"},
+				{name: "read 15 (authenticated)", send: "0a0f00", want: "0b6869"},
+				{name: "read by type 0xfff3 (authenticated)", send: "080100fffff3ff", want: "09040f006869"},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		l2c, shim := newTestL2cap()
+		l2c.conn.security = tt.security
+		l2c.setServices("", []*Service{newService()})
+		go l2c.listenAndServe()
+		runRxTx(t, shim, tt.rr)
+	}
+}
+
+func TestWriteSecurity(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	write := func(r Request, data []byte) byte { return StatusSuccess }
+	encrypted := svc.AddCharacteristic(UUID16(0xfff1))
+	encrypted.HandleWriteFunc(write)
+	encrypted.HandleNotifyFunc(func(r Request, n Notifier) {})
+	encrypted.RequireSecurity(SecurityMedium)
+	authenticated := svc.AddCharacteristic(UUID16(0xfff2))
+	authenticated.HandleWriteFunc(write)
+	authenticated.RequireSecurity(SecurityHigh)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "write 11 (encrypted)", send: "120b00ab", want: "01120b000f"},
+		{name: "write ccc 12 (encrypted)", send: "120c000100", want: "01120c000f"},
+		{name: "write 14 (authenticated)", send: "120e00ab", want: "01120e0005"},
+		{name: "security medium", event: "security medium"},
+		{name: "write 11", send: "120b00ab", want: "13"},
+		{name: "write ccc 12", send: "120c000100", want: "13"},
+		{name: "write 14 (authenticated)", send: "120e00ab", want: "01120e0005"},
+		{name: "security high", event: "security high"},
+		{name: "write 14", send: "120e00ab", want: "13"},
+	})
+}
+
+func TestAuthorization(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	denied := "01:02:03:04:05:06"
+	deny := func(c *Characteristic, hw net.HardwareAddr) bool {
+		return hw.String() != denied || !uuidEqual(c.uuid, UUID16(0xfff1))
+	}
+	h.authRead, h.authWrite = deny, deny
+
+	var writes int
+	svc := &Service{uuid: UUID16(0xfff0)}
+	for _, u := range []uint16{0xfff1, 0xfff2} {
+		char := svc.AddCharacteristic(UUID16(u))
+		char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+			io.WriteString(resp, "hi")
+		})
+		char.HandleWriteFunc(func(r Request, data []byte) byte {
+			writes++
+			return StatusSuccess
+		})
+	}
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	sync := rxtx{name: "sync", send: "021700", want: "031700"}
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept " + denied},
+		{name: "read 11 (denied)", send: "0a0b00", want: "010a0b0008"},
+		{name: "read blob 11 (denied)", send: "0c0b000000", want: "010c0b0008"},
+		{name: "read by type 0xfff1 (denied)", send: "080100fffff1ff", want: "01080b0008"},
+		{name: "read multiple 13, 11 (denied)", send: "0e0d000b00", want: "010e0b0008"},
+		{name: "read 13", send: "0a0d00", want: "0b6869"},
+		{name: "read declaration 10", send: "0a0a00", want: "0b0e0b00f1ff"},
+		{name: "write 11 (denied)", send: "120b00ab", want: "01120b0008"},
+		{name: "write cmd 11 (denied)", event: "data 520b00ab"},
+		sync,
+		{name: "write 13", send: "120d00ab", want: "13"},
+		{name: "disconnect", event: "disconnect " + denied},
+		{name: "reconnect", event: "accept 11:22:33:44:55:66"},
+		{name: "read 11", send: "0a0b00", want: "0b6869"},
+		{name: "write 11", send: "120b00ab", want: "13"},
+	})
+	if writes != 2 {
+		t.Errorf("writes: got %d want 2", writes)
+	}
+}
+
+func TestUserDescription(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	fan := svc.AddCharacteristic(UUID16(0xfff1))
+	fan.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	fan.HandleNotifyFunc(func(r Request, n Notifier) {})
+	fan.SetDescription("Fan speed")
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	desc := fmt.Sprintf("%x", "Fan speed")
+	runRxTx(t, shim, []rxtx{
+		{
+			name: "find info [12,ffff] -- 12: 0x2902, 13: 0x2901, 14: 0x2803, 15: 0xfff2",
+			send: "040c00ffff",
+			want: "05010c0002290d0001290e0003280f00f2ff",
+		},
+		{name: "read 13", send: "0a0d00", want: "0b" + desc},
+		{name: "read blob 13 at 4", send: "0c0d000400", want: "0d" + fmt.Sprintf("%x", "speed")},
+		{name: "read by type 0x2901", send: "080100ffff0129", want: "090b0d00" + desc},
+		{name: "write 13 -- read-only", send: "120d00ab", want: "01120d0003"},
+	})
+}
+
+func TestPeerAddress(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	char.HandleWriteFunc(func(r Request, data []byte) byte { return StatusSuccess })
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept 01:02:03:04:05:06"},
+		{name: "read 11", send: "0a0b00", want: "0b"},
+		{name: "write 11", send: "120b00ab", want: "13"},
+		{name: "read by type 0xfff1", send: "080100fffff1ff", want: "09020b00"},
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "prepare write 11 -- target b", send: "160b000000ab", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "prepare write 11", want: "170b000000ab"},
+		{name: "execute writes", send: "1801", want: "19"},
+	})
+	want := []string{
+		"read 01:02:03:04:05:06",
+		"write 01:02:03:04:05:06",
+		"read 01:02:03:04:05:06",
+		"write 0a:0b:0c:0d:0e:0f",
+	}
+	if fmt.Sprint(h.peers) != fmt.Sprint(want) {
+		t.Errorf("reads and writes: got %q want %q", h.peers, want)
+	}
+}
+
+func TestReadCCC(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 11:22:33:44:55:66"},
+		{
+			name: "find info [10,ffff] -- 10: 0x2803, 11: 0xfff1, 12: 0x2902",
+			send: "040a00ffff",
+			want: "05010a0003280b00f1ff0c000229",
+		},
+		{name: "read ccc -- 0x0000", send: "0a0c00", want: "0b0000"},
+		{name: "write ccc notify", send: "120c000100", want: "13"},
+		{name: "read ccc -- 0x0001", send: "0a0c00", want: "0b0100"},
+		{name: "read by type 0x2902 -- 0x0001", send: "080a00ffff0229", want: "09040c000100"},
+		{name: "reconnect", event: "accept 11:22:33:44:55:66"},
+		{name: "read ccc after reconnect -- 0x0000", send: "0a0c00", want: "0b0000"},
+	})
+}
+
+func TestWriteCCCCommand(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// Some centrals write the CCC with a Write Command. It gets
+	// no response; the MTU exchange would read one in its place.
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 11:22:33:44:55:66"},
+		{name: "write command ccc notify -- no response", event: "data 520c000100"},
+		{name: "sync", send: "021700", want: "031700"},
+		{name: "read ccc -- 0x0001", send: "0a0c00", want: "0b0100"},
+	})
+	if h.started != 1 {
+		t.Errorf("startNotify called %d times, want 1", h.started)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "write command ccc 0 -- no response", event: "data 520c000000"},
+		{name: "read ccc -- 0x0000", send: "0a0c00", want: "0b0000"},
+	})
+	if h.stopped != 1 {
+		t.Errorf("stopNotify called %d times, want 1", h.stopped)
+	}
+}
+
+func TestBadHandleTable(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	// A value handle without a declaration,
+	// and a declaration without a value handle.
+	char := &Characteristic{uuid: UUID16(0xfff1)}
+	l2c.handles = &handleRange{base: 1, hh: []handle{
+		{typ: "characteristicValue", n: 1, uuid: UUID16(0xfff1)},
+		{typ: "characteristic", n: 2, uuid: UUID16(0xfff1), props: charRead, startn: 2, valuen: 9, attr: char},
+	}}
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "read 1 -- unlikely", send: "0a0100", want: "010a01000e"},
+		{name: "read blob 1 -- unlikely", send: "0c01000000", want: "010c01000e"},
+		{name: "write 1 -- unlikely", send: "12010001", want: "011201000e"},
+		{name: "read multiple 1, 2 -- unlikely", send: "0e01000200", want: "010e01000e"},
+		{name: "read by type [1,ffff] 0xfff1 -- unlikely", send: "080100fffff1ff", want: "010809000e"},
+		{name: "still serving", send: "021700", want: "031700"},
+	})
+}
+
+func TestNonAdjacentValue(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	var written []byte
+	char := &Characteristic{uuid: UUID16(0xfff1)}
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) { resp.Write([]byte("hi")[req.Offset:]) })
+	char.HandleWriteFunc(func(r Request, data []byte) byte {
+		written = data
+		return StatusSuccess
+	})
+	// The declaration and the value are linked explicitly,
+	// with a descriptor between them.
+	l2c.handles = &handleRange{base: 1, hh: []handle{
+		{typ: "characteristic", n: 1, uuid: UUID16(0xfff1), props: charRead | charWrite, startn: 1, valuen: 3, attr: char},
+		{typ: "descriptor", n: 2, uuid: UUID16(0x2901), props: charRead, value: []byte("x")},
+		{typ: "characteristicValue", n: 3, uuid: UUID16(0xfff1), decln: 1},
+	}}
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "read 3", send: "0a0300", want: "0b6869"},
+		{name: "read blob 3 at 1", send: "0c03000100", want: "0d69"},
+		{name: "read multiple 3, 2", send: "0e03000200", want: "0f686978"},
+		{name: "read by type [1,ffff] 0xfff1", send: "080100fffff1ff", want: "090403006869"},
+		{name: "write 3", send: "12030041", want: "13"},
+	})
+	if string(written) != "A" {
+		t.Errorf("written: got %q want %q", written, "A")
+	}
+}
+
+func TestUnsupportedHandle(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "unknown request 0x30 -- unsupported", send: "300800ab", want: "0130000006"},
+		// Commands never get a response; the MTU exchange
+		// would read any stray error response in its place.
+		{name: "signed write 8 -- dropped", event: "data d20800ab"},
+		{name: "unknown command 0x7f -- dropped", event: "data 7f0800ab"},
+		{name: "unknown signed opcode 0x90 -- dropped", event: "data 900800ab"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+}
+
+func TestNotifyLifecycle(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	nc := make(chan Notifier, 1)
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleNotifyFunc(func(r Request, n Notifier) { nc <- n })
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	var n Notifier
+	runRxTx(t, shim, []rxtx{
+		{
+			name: "read by type [9,ffff] 0x2803 -- 10: notify, 11, 0xfff1",
+			send: "080900ffff0328",
+			want: "09070a00100b00f1ff",
+		},
+		{
+			name: "find info [12,ffff] -- 12: 0x2902",
+			send: "040c00ffff",
+			want: "05010c000229",
+		},
+		{
+			name: "write ccc notify -- ok",
+			send: "120c000100",
+			want: "13",
+			after: func() {
+				if h.started != 1 {
+					t.Errorf("startNotify called %d times, want 1", h.started)
+				}
+				n = <-nc
+				go n.Write([]byte("hi"))
+			},
+		},
+		{
+			name: "-- notified 'hi'",
+			want: "1b0b006869",
+		},
+		{
+			name: "write ccc 0 -- ok",
+			send: "120c000000",
+			want: "13",
+			after: func() {
+				if h.stopped != 1 {
+					t.Errorf("stopNotify called %d times, want 1", h.stopped)
+				}
+				if !n.Done() {
+					t.Errorf("notifier not done after unsubscribe")
+				}
+				if _, err := n.Write([]byte("hi")); err == nil {
+					t.Errorf("notify after unsubscribe: got nil error")
+				}
+			},
+		},
+		{
+			name: "read ccc -- 0x0000, no notification sent first",
+			send: "0a0c00",
+			want: "0b0000",
+		},
+	})
+}
+
+func TestControl(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	shim.cmdc = make(chan Command, 2)
+	if err := l2c.disconnect(); err != nil {
+		t.Errorf("disconnect: %v", err)
+	}
+	if err := l2c.updateRSSI(); err != nil {
+		t.Errorf("updateRSSI: %v", err)
+	}
+	for _, want := range []Command{CommandDisconnect, CommandUpdateRSSI} {
+		if got := <-shim.cmdc; got != want {
+			t.Errorf("got command %v want %v", got, want)
 		}
-		got := string(resp[:len(resp)-1]) // trim \n
-		if got != tt.want {
-			t.Errorf("%s: sent %q got %q want %q", tt.name, tt.send, got, tt.want)
-			continue
+	}
+	if got, want := Command(0).String(), "Command(0)"; got != want {
+		t.Errorf("unknown command String: got %q want %q", got, want)
+	}
+}
+
+func TestRSSIMonitor(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	shim.cmdc = make(chan Command, 100)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	// drained reports whether no commands arrive for a while.
+	drained := func() bool {
+		time.Sleep(30 * time.Millisecond)
+		for len(shim.cmdc) > 0 {
+			<-shim.cmdc
 		}
-		if tt.after != nil {
-			tt.after()
+		time.Sleep(30 * time.Millisecond)
+		return len(shim.cmdc) == 0
+	}
+
+	l2c.startRSSIMonitor(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if cmd := <-shim.cmdc; cmd != CommandUpdateRSSI {
+			t.Fatalf("got command %v, want %v", cmd, CommandUpdateRSSI)
+		}
+	}
+	l2c.stopRSSIMonitor()
+	if !drained() {
+		t.Errorf("RSSI updates continued after stopRSSIMonitor")
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept 11:22:33:44:55:66"},
+		{name: "a: sync", send: "0a0300", want: "0b"},
+	})
+	l2c.startRSSIMonitor(time.Millisecond)
+	<-shim.cmdc
+	runRxTx(t, shim, []rxtx{
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "b: sync -- target b", send: "0a0300", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "b: sync", want: "0b"},
+		{name: "disconnect b", event: "disconnect 0a:0b:0c:0d:0e:0f"},
+		{name: "sync", send: "0a0300", want: "0b"},
+	})
+	if drained() {
+		t.Errorf("RSSI updates of a stopped after b disconnected")
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "disconnect a", event: "disconnect 11:22:33:44:55:66"},
+		{name: "sync", send: "0a0300", want: "0b"},
+	})
+	if !drained() {
+		t.Errorf("RSSI updates continued after disconnect")
+	}
+
+	l2c.startRSSIMonitor(time.Millisecond)
+	<-shim.cmdc
+	l2c.close()
+	if !drained() {
+		t.Errorf("RSSI updates continued after close")
+	}
+}
+
+func TestRSSIMonitorStream(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.rssic = make(chan int, 100)
+	shim.cmdc = make(chan Command, 100)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	// Answer each RSSI update request like the shim does, with
+	// a fresh measurement.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for rssi := -40; ; rssi-- {
+			select {
+			case cmd := <-shim.cmdc:
+				if cmd == CommandUpdateRSSI {
+					shim.readc <- []byte(fmt.Sprintf("rssi %d\n", rssi))
+				}
+			case <-done:
+				return
+			}
 		}
+	}()
+
+	l2c.startRSSIMonitor(time.Millisecond)
+	for want := -40; want > -45; want-- {
+		select {
+		case got := <-h.rssic:
+			if got != want {
+				t.Errorf("RSSI: got %d want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no RSSI measurement %d", want)
+		}
+	}
+	l2c.stopRSSIMonitor()
+}
+
+func TestDisconnectConn(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	b, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept 01:02:03:04:05:06"},
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "sync -- target b", send: "021700", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "sync", want: "031700"},
+	})
+
+	if err := l2c.disconnectConn(net.HardwareAddr{1, 1, 1, 1, 1, 1}); err == nil {
+		t.Errorf("disconnectConn of an unconnected central: got nil error")
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.disconnectConn(a) }()
+	runRxTx(t, shim, []rxtx{{name: "targeted disconnect", want: "disconnect 01:02:03:04:05:06"}})
+	if err := <-errc; err != nil {
+		t.Errorf("disconnectConn(a): %v", err)
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "a disconnected", event: "disconnect 01:02:03:04:05:06 16"},
+		{name: "sync again", send: "021700", want: "031700"},
+	})
+
+	if want := []string{"01:02:03:04:05:06 " + DisconnectLocalHost.String()}; !reflect.DeepEqual(h.disconnects, want) {
+		t.Errorf("disconnects: got %q want %q", h.disconnects, want)
+	}
+	if err := l2c.disconnectConn(a); err == nil {
+		t.Errorf("disconnectConn of disconnected a: got nil error")
+	}
+	if got := l2c.lastActivity(b); got.IsZero() {
+		t.Errorf("b no longer connected after disconnecting a")
+	}
+}
+
+func TestIncludedService(t *testing.T) {
+	read := func(resp ReadResponseWriter, req *ReadRequest) {}
+	b := &Service{uuid: UUID16(0xfffa)}
+	b.AddCharacteristic(UUID16(0xfffb)).HandleReadFunc(read)
+	c := &Service{uuid: MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b")}
+	c.AddCharacteristic(UUID16(0xfffc)).HandleReadFunc(read)
+	a := &Service{uuid: UUID16(0xfff0)}
+	a.AddIncludedService(b)
+	a.AddIncludedService(c)
+	a.AddCharacteristic(UUID16(0xfff1)).HandleReadFunc(read)
+
+	l2c, _ := newTestL2cap()
+	if err := l2c.setServices("", []*Service{a, b}); err == nil {
+		t.Errorf("setServices including an unserved service: got nil error")
+	}
+
+	l2c, shim := newTestL2cap()
+	if err := l2c.setServices("", []*Service{a, b, c}); err != nil {
+		t.Fatal(err)
+	}
+	go l2c.listenAndServe()
+
+	// 9: a; 10: include b; 11: include c; 12, 13: fff1.
+	// 14: b, [14,16]; 17: c, [17,19].
+	runRxTx(t, shim, []rxtx{
+		{
+			name: "read by type [9,ffff] 0x2802 -- 10: b, with its 16-bit uuid; 11 differs in length",
+			send: "080900ffff0228",
+			want: "09080a000e001000faff",
+		},
+		{
+			name: "read by type [11,ffff] 0x2802 -- 11: c, without its 128-bit uuid",
+			send: "080b00ffff0228",
+			want: "09060b0011001300",
+		},
+		{name: "read by type [12,ffff] 0x2802 -- not found", send: "080c00ffff0228", want: "01080c000a"},
+		{name: "read 11 -- c's uuid is read from its declaration", send: "0a0b00", want: "0b11001300"},
+		{name: "read 17 -- c", send: "0a1100", want: "0b" + fmt.Sprintf("%x", c.uuid.reverseBytes())},
+		{name: "find info [10,11]", send: "040a000b00", want: "05010a0002280b000228"},
+		{name: "read by group [1,ffff] 0x2802 -- not a group", send: "100100ffff0228", want: "0110010010"},
+		{name: "read by group [9,ffff] 0x2800", send: "100900ffff0028", want: "110609000d00f0ff0e001000faff"},
+	})
+}
+
+func TestNotifyConn(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	a, _ := net.ParseMAC("11:22:33:44:55:66")
+	b, _ := net.ParseMAC("66:55:44:33:22:11")
+	data := make([]byte, 40)
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept " + a.String()},
+		{name: "set mtu to 30", send: "021e00", want: "031e00"},
+	})
+
+	if err := l2c.notifyConn(a, char, data); err != nil {
+		t.Errorf("notifyConn, unsubscribed: %v", err)
+	}
+	// Nothing was sent; any stray pdu would be read in place of the response.
+	runRxTx(t, shim, []rxtx{
+		{name: "subscribe", send: "120c000100", want: "13"},
+	})
+
+	go func() {
+		if err := l2c.notifyConn(b, char, data); err == nil {
+			t.Errorf("notifyConn to unconnected central: got nil error")
+		}
+		if err := l2c.notifyConn(a, char, data); err != nil {
+			t.Errorf("notifyConn: %v", err)
+		}
+	}()
+	runRxTx(t, shim, []rxtx{
+		{name: "-- notified 27 bytes", want: "1b0b00" + fmt.Sprintf("%x", data[:27])},
+		{name: "disconnect a", event: "disconnect " + a.String()},
+		{name: "sync", send: "0a0300", want: "0b"},
+	})
+
+	if err := l2c.notifyConn(a, char, data); err == nil {
+		t.Errorf("notifyConn after disconnect: got nil error")
+	}
+}
+
+func TestExchangeMTU(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	cases := []struct {
+		preferred int
+		req       string // expected request
+		resp      string // peer response
+		want      int
+		wanterr   bool
+	}{
+		{preferred: 100, req: "026400", resp: "033000", want: 48},
+		{preferred: 100, req: "026400", resp: "030002", want: 100},
+		{preferred: 30, req: "021e00", resp: "031000", want: 23},
+		{preferred: 100, req: "026400", resp: "0102000006", wanterr: true},
+	}
+
+	for _, tt := range cases {
+		type result struct {
+			mtu int
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			mtu, err := l2c.exchangeMTU(tt.preferred)
+			done <- result{mtu, err}
+		}()
+		if req := string(<-shim.writec); req != tt.req+"\n" {
+			t.Errorf("exchangeMTU(%d): sent %q want %q", tt.preferred, req, tt.req+"\n")
+		}
+		shim.readc <- []byte("data " + tt.resp + "\n")
+		r := <-done
+		if tt.wanterr {
+			if r.err == nil {
+				t.Errorf("exchangeMTU(%d) with response %s: got nil error", tt.preferred, tt.resp)
+			}
+			continue
+		}
+		if r.err != nil || r.mtu != tt.want {
+			t.Errorf("exchangeMTU(%d) with response %s: got %d, %v want %d", tt.preferred, tt.resp, r.mtu, r.err, tt.want)
+		}
+	}
+
+	if _, err := l2c.exchangeMTU(10); err == nil {
+		t.Errorf("exchangeMTU(10): got nil error")
+	}
+}
+
+func TestExchangeMTUEvent(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.mtuc = make(chan int, 10)
+	l2c.maxMTU = 50
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+
+	// The offer is capped at maxMTU, and the
+	// agreed MTU is reported to the handler.
+	done := make(chan int)
+	go func() {
+		mtu, err := l2c.exchangeMTU(100)
+		if err != nil {
+			t.Errorf("exchangeMTU(100): %v", err)
+		}
+		done <- mtu
+	}()
+	runRxTx(t, shim, []rxtx{{name: "mtu request", want: "023200"}})
+	shim.readc <- []byte("data 030002\n")
+	if mtu := <-done; mtu != 50 {
+		t.Errorf("exchangeMTU(100) with maxMTU 50: got %d want 50", mtu)
+	}
+	if mtu := l2c.currentMTU(); mtu != 50 {
+		t.Errorf("currentMTU: got %d want 50", mtu)
+	}
+	select {
+	case mtu := <-h.mtuc:
+		if mtu != 50 {
+			t.Errorf("mtuChanged: got %d want 50", mtu)
+		}
+	default:
+		t.Errorf("mtuChanged not called")
+	}
+
+	// The response concerns the central that was asked,
+	// even if another central's events have since become current.
+	go func() {
+		mtu, err := l2c.exchangeMTU(40)
+		if err != nil {
+			t.Errorf("exchangeMTU(40): %v", err)
+		}
+		done <- mtu
+	}()
+	runRxTx(t, shim, []rxtx{
+		{name: "a: mtu request", want: "022800"},
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "b: stray mtu response -- dropped", event: "data 032000"},
+		{name: "b: sync -- target b", send: "021700", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "b: sync", want: "031700"},
+		{name: "switch to a", event: "conn 01:02:03:04:05:06"},
+		{name: "a: mtu response", event: "data 032a00"},
+	})
+	if mtu := <-done; mtu != 40 {
+		t.Errorf("exchangeMTU(40): got %d want 40", mtu)
+	}
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	b, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	if mtu := l2c.connMTU(a); mtu != 40 {
+		t.Errorf("mtu of a: got %d want 40", mtu)
+	}
+	if mtu := l2c.connMTU(b); mtu != 23 {
+		t.Errorf("mtu of b: got %d want 23", mtu)
+	}
+}
+
+func TestPartialLine(t *testing.T) {
+	cases := []struct {
+		lines   []string
+		wanterr bool
+	}{
+		{lines: []string{"data 0a0"}},
+		{lines: []string{"data 0a0300\n", "data 0a"}},
+		{lines: []string{"data 0a0\n"}, wanterr: true},
+		{lines: []string{"data 0x0300\n"}, wanterr: true},
+	}
+
+	for _, tt := range cases {
+		l2c, shim := newTestL2cap()
+		l2c.setServices("", nil)
+		errc := make(chan error)
+		go func() { errc <- l2c.listenAndServe() }()
+		go func() {
+			for _, line := range tt.lines {
+				shim.readc <- []byte(line)
+			}
+			close(shim.readc)
+		}()
+		var err error
+	loop:
+		for {
+			select {
+			case err = <-errc:
+				break loop
+			case resp := <-shim.writec:
+				if string(resp) != "0b\n" {
+					t.Errorf("lines %q: unexpected response %q", tt.lines, resp)
+				}
+			}
+		}
+		if gotErr := err != nil; gotErr != tt.wanterr {
+			t.Errorf("lines %q: got err %v, want error: %t", tt.lines, err, tt.wanterr)
+		}
+	}
+}
+
+func TestMaxMTU(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.maxMTU = 30
+	name := strings.Repeat("n", 40)
+	l2c.setServices(name, nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "set mtu to 100 -- echoed", send: "026400", want: "036400"},
+		{name: "read device name -- capped at 30", send: "0a0300", want: "0b" + fmt.Sprintf("%x", name[:29])},
+		{name: "set mtu to 25 -- echoed", send: "021900", want: "031900"},
+		{name: "read device name -- capped at 25", send: "0a0300", want: "0b" + fmt.Sprintf("%x", name[:24])},
+	})
+}
+
+func TestNotifyOrder(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	l2c.cccs[""] = map[*Characteristic]uint16{char: gattCCCNotifyFlag}
+
+	// queued waits for a notification to join the queue behind last.
+	queued := func(last chan struct{}) chan struct{} {
+		for {
+			l2c.notifymu.Lock()
+			q := l2c.notifyq[0x0b]
+			l2c.notifymu.Unlock()
+			if q != last {
+				return q
+			}
+			runtime.Gosched()
+		}
+	}
+
+	// The first notification blocks in the shim until the test reads
+	// it; the rest queue up behind it, each joining once the one before
+	// has, and must be sent in that order.
+	const n = 10
+	var last chan struct{}
+	for i := 0; i < n; i++ {
+		go l2c.sendNotification(char, []byte{byte(i)})
+		last = queued(last)
+	}
+
+	for i := 0; i < n; i++ {
+		want := fmt.Sprintf("1b0b00%02x\n", i)
+		if got := string(<-shim.writec); got != want {
+			t.Errorf("notification %d: got %q want %q", i, got, want)
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "gatt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	value := make([]byte, 100)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	if _, err := f.Write(value); err != nil {
+		t.Fatal(err)
+	}
+
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleReadAt(f, int64(len(value)))
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	rr := []rxtx{
+		{name: "read", send: "0a0b00", want: fmt.Sprintf("0b%x", value[:22])},
+	}
+	for off := 22; off < len(value); off += 22 {
+		end := off + 22
+		if end > len(value) {
+			end = len(value)
+		}
+		rr = append(rr, rxtx{
+			name: fmt.Sprintf("read blob at %d", off),
+			send: fmt.Sprintf("0c0b00%02x00", off),
+			want: fmt.Sprintf("0d%x", value[off:end]),
+		})
+	}
+	rr = append(rr,
+		rxtx{name: "read blob at 100 -- empty", send: "0c0b006400", want: "0d"},
+		rxtx{name: "read blob at 101 -- invalid offset", send: "0c0b006500", want: "010c0b0007"},
+	)
+	runRxTx(t, shim, rr)
+}
+
+func TestReadBlobInvalidOffset(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	long := bytes.Repeat([]byte("0123456789"), 3) // 30 bytes
+	// The server reads these values whole, so their
+	// handlers may ignore the offset; it checks it.
+	readWhole := func(v []byte) func(resp ReadResponseWriter, req *ReadRequest) {
+		return func(resp ReadResponseWriter, req *ReadRequest) { resp.Write(v) }
+	}
+	// readLong returns nothing past the end of the
+	// value, rather than reporting an invalid offset.
+	readLong := func(resp ReadResponseWriter, req *ReadRequest) {
+		if req.Offset >= len(long) {
+			return
+		}
+		v := long[req.Offset:]
+		if len(v) > req.Cap {
+			v = v[:req.Cap]
+		}
+		resp.Write(v)
+	}
+
+	svc := &Service{uuid: UUID16(0xfff0)}
+	speed := uint16(0x0102)
+	fan := svc.AddCharacteristic(UUID16(0xfff1))
+	fan.HandleValue(NewValue(&speed))
+	fan.SetDescription("Fan")
+	snap := svc.AddCharacteristic(UUID16(0xfff2))
+	snap.HandleReadFunc(readWhole(long))
+	snap.SnapshotLongReads(time.Minute)
+	svc.AddCharacteristic(UUID16(0xfff3)).HandleReadAsync(AsyncReadHandlerFunc(func(req *ReadRequest) <-chan ReadResult {
+		resc := make(chan ReadResult, 1)
+		resp := newReadResponseWriter(req.Cap)
+		readLong(resp, req)
+		resc <- ReadResult{Value: resp.bytes(), Status: resp.status}
+		return resc
+	}))
+	fit := svc.AddCharacteristic(UUID16(0xfff4))
+	fit.HandleReadFunc(readWhole([]byte("short")))
+	fit.MustFitMTU(nil)
+	svc.AddCharacteristic(UUID16(0xfff5)).HandleReadFunc(readLong)
+	l2c.setServices("gopher", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 3: device name, static; 11: fff1 Value; 12: fff1 user description, static;
+	// 14: fff2, snapshotted; 16: fff3, async; 18: fff4, must fit; 20: fff5.
+	runRxTx(t, shim, []rxtx{
+		{name: "read blob 3 at 6 -- end of static value", send: "0c03000600", want: "0d"},
+		{name: "read blob 3 at 7 -- invalid offset", send: "0c03000700", want: "010c030007"},
+		{name: "read blob 11 at 2 -- end of Value", send: "0c0b000200", want: "0d"},
+		{name: "read blob 11 at 3 -- invalid offset", send: "0c0b000300", want: "010c0b0007"},
+		{name: "read blob 12 at 3 -- end of static descriptor", send: "0c0c000300", want: "0d"},
+		{name: "read blob 12 at 4 -- invalid offset", send: "0c0c000400", want: "010c0c0007"},
+		{name: "read blob 14 at 31 -- invalid offset, no snapshot", send: "0c0e001f00", want: "010c0e0007"},
+		{name: "read 14 -- takes snapshot", send: "0a0e00", want: fmt.Sprintf("0b%x", long[:22])},
+		{name: "read blob 14 at 31 -- invalid offset, snapshot", send: "0c0e001f00", want: "010c0e0007"},
+		{name: "read blob 14 at 25 -- new snapshot", send: "0c0e001900", want: fmt.Sprintf("0d%x", long[25:])},
+		{name: "read blob 16 at 30 -- end of async value", send: "0c10001e00", want: "0d"},
+		{name: "read blob 16 at 31 -- invalid offset, async", send: "0c10001f00", want: "010c100007"},
+		{name: "read blob 18 at 5 -- end of whole value", send: "0c12000500", want: "0d"},
+		{name: "read blob 18 at 6 -- invalid offset, whole value", send: "0c12000600", want: "010c120007"},
+		{name: "read blob 20 at 22", send: "0c14001600", want: fmt.Sprintf("0d%x", long[22:])},
+		{name: "read blob 20 at 30 -- end of value", send: "0c14001e00", want: "0d"},
+		{name: "read blob 20 at 31 -- invalid offset", send: "0c14001f00", want: "010c140007"},
+		{name: "read blob 20 at 1000 -- invalid offset", send: "0c1400e803", want: "010c140007"},
+	})
+}
+
+func TestTruncatedPDUs(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "mtu, 1 byte", send: "0217", want: "0102000004"},
+		{name: "find info, 3 bytes", send: "04010000", want: "0104000004"},
+		{name: "read by type, 1 byte", send: "0801", want: "0108000004"},
+		{name: "read by type, 3 bytes", send: "08010000", want: "0108000004"},
+		{name: "read by type, 5 bytes", send: "080100ffff00", want: "0108000004"},
+		{name: "read, 1 byte", send: "0a03", want: "010a000004"},
+		{name: "read blob, 3 bytes", send: "0c030000", want: "010c000004"},
+		{name: "read by group, 1 byte", send: "1001", want: "0110000004"},
+		{name: "read by group, 4 bytes", send: "10010000ff", want: "0110000004"},
+		{name: "mtu 23 -- still serving", send: "021700", want: "031700"},
+	})
+
+	// Truncated requests are rejected the same way while paused.
+	l2c.pause(nil)
+	runRxTx(t, shim, []rxtx{
+		{name: "paused: read by type, 3 bytes", send: "08010000", want: "0108000004"},
+		{name: "paused: mtu 23 -- still serving", send: "021700", want: "031700"},
+	})
+}
+
+func TestHandleZero(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "read 0 -- invalid handle", send: "0a0000", want: "010a000001"},
+		{name: "read blob 0 -- invalid handle", send: "0c00000000", want: "010c000001"},
+		{name: "write 0 -- invalid handle", send: "1200006162", want: "0112000001"},
+		{
+			name: "find info [0,2] -- as [1,2]",
+			send: "0400000200",
+			want: "05010100002802000328",
+		},
+		{
+			name: "read by group [0,5] 0x2800 -- as [1,5]",
+			send: "10000005000028",
+			want: "1106010005000018",
+		},
+		{
+			name: "read by type [0,0] 0x2a00 -- not found at 1",
+			send: "0800000000002a",
+			want: "010801000a",
+		},
+	})
+}
+
+func TestDiscoveryPastEnd(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	// Attribute not found is how a central learns that discovery is complete.
+	runRxTx(t, shim, []rxtx{
+		{name: "find info [fff0,ffff]", send: "04f0ffffff", want: "0104f0ff0a"},
+		{name: "find by type [fff0,ffff] 0x2800 0x1800", send: "06f0ffffff00280018", want: "0106f0ff0a"},
+		{name: "read by type [fff0,ffff] 0x2803", send: "08f0ffffff0328", want: "0108f0ff0a"},
+		{name: "read by type [fff0,ffff] 0x2a00", send: "08f0ffffff002a", want: "0108f0ff0a"},
+		{name: "read by group [fff0,ffff] 0x2800", send: "10f0ffffff0028", want: "0110f0ff0a"},
+	})
+}
+
+func TestPrepQueueFull(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	var written []string
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleWriteFunc(func(r Request, data []byte) byte {
+		written = append(written, string(data))
+		return StatusSuccess
+	})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// Fragments at the same offset don't lengthen the value,
+	// but each takes up room in the queue.
+	var rr []rxtx
+	for i := 0; i < attMaxPrepQueueLen; i++ {
+		rr = append(rr, rxtx{name: fmt.Sprintf("prepare 11 offset 0, #%d", i), send: "160b00000061", want: "170b00000061"})
+	}
+	rr = append(rr,
+		rxtx{name: "prepare 11 offset 0 -- queue full", send: "160b00000062", want: "01160b0009"},
+		rxtx{name: "execute", send: "1801", want: "19"},
+		rxtx{name: "prepare 11 offset 0 -- queue emptied", send: "160b00000063", want: "170b00000063"},
+		rxtx{name: "execute again", send: "1801", want: "19"},
+	)
+	runRxTx(t, shim, rr)
+
+	if want := []string{"a", "c"}; fmt.Sprint(written) != fmt.Sprint(want) {
+		t.Errorf("written: got %q want %q", written, want)
+	}
+}
+
+func TestPreparedWrites(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+
+	written := make(map[uint16]string) // by characteristic UUID
+	svc := &Service{uuid: UUID16(0xfff0)}
+	for _, u := range []uint16{0xfff1, 0xfff2} {
+		u := u
+		svc.AddCharacteristic(UUID16(u)).HandleWriteFunc(func(r Request, data []byte) byte {
+			written[u] = string(data)
+			return StatusSuccess
+		})
+	}
+	svc.AddCharacteristic(UUID16(0xfff3)).HandleNotifyFunc(func(r Request, n Notifier) {})
+	svc.AddCharacteristic(UUID16(0xfff4)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: fff1 value, 13: fff2 value, 16: fff3 ccc, 18: fff4 value (read-only)
+	var validated []PreparedWrite
+	h.validate = func(writes []PreparedWrite) byte {
+		validated = writes
+		return StatusSuccess
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "prepare 11 offset 3 -- echoed", send: "160b000300646566", want: "170b000300646566"},
+		{name: "prepare 13 offset 0 -- echoed", send: "160d0000007879", want: "170d0000007879"},
+		{name: "prepare 11 offset 0 -- echoed", send: "160b000000616263", want: "170b000000616263"},
+		{name: "prepare 16 offset 0 -- echoed", send: "16100000000100", want: "17100000000100"},
+		{
+			name: "execute -- ok",
+			send: "1801",
+			want: "19",
+			after: func() {
+				if len(validated) != 3 {
+					t.Fatalf("validated %d writes, want 3", len(validated))
+				}
+				for i, want := range []PreparedWrite{
+					{Handle: 11, Value: []byte("abcdef")},
+					{Handle: 13, Value: []byte("xy")},
+					{Handle: 16, Value: []byte{0x01, 0x00}},
+				} {
+					got := validated[i]
+					if got.Handle != want.Handle || !bytes.Equal(got.Value, want.Value) {
+						t.Errorf("validated[%d] = %d %x, want %d %x", i, got.Handle, got.Value, want.Handle, want.Value)
+					}
+				}
+				if written[0xfff1] != "abcdef" || written[0xfff2] != "xy" {
+					t.Errorf("written = %v, want fff1: abcdef, fff2: xy", written)
+				}
+				if h.started != 1 {
+					t.Errorf("startNotify called %d times, want 1", h.started)
+				}
+			},
+		},
+	})
+
+	written = make(map[uint16]string)
+	h.validate = func(writes []PreparedWrite) byte { return 0x80 }
+	runRxTx(t, shim, []rxtx{
+		{name: "prepare 11 -- echoed", send: "160b00000061", want: "170b00000061"},
+		{name: "prepare 13 -- echoed", send: "160d00000062", want: "170d00000062"},
+		{name: "execute -- rejected at 11", send: "1801", want: "01180b0080"},
+		{name: "execute again -- queue was cleared", send: "1801", want: "19"},
+	})
+	if len(written) != 0 {
+		t.Errorf("rejected execute wrote %v", written)
+	}
+
+	h.validate = nil
+	runRxTx(t, shim, []rxtx{
+		{name: "prepare 11 -- echoed", send: "160b00000061", want: "170b00000061"},
+		{name: "cancel -- ok", send: "1800", want: "19"},
+		{name: "execute -- nothing to write", send: "1801", want: "19"},
+		{name: "prepare 11 offset 2 -- echoed", send: "160b00020061", want: "170b00020061"},
+		{name: "execute -- invalid offset at 11", send: "1801", want: "01180b0007"},
+		{name: "prepare 18 (read-only) -- write not permitted", send: "16120000006162", want: "0116120003"},
+		{name: "prepare 10 (declaration) -- write not permitted", send: "160a0000006162", want: "01160a0003"},
+		{name: "prepare 99 -- invalid handle", send: "1663000000", want: "0116630001"},
+		{name: "truncated prepare -- invalid pdu", send: "160b", want: "0116000004"},
+		{name: "execute, bad flags -- invalid pdu", send: "1802", want: "0118000004"},
+	})
+	if len(written) != 0 {
+		t.Errorf("cancelled execute wrote %v", written)
+	}
+}
+
+func TestDescriptorLongWrite(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	var written []string
+	var owner *Characteristic
+	char.AddDescriptor(UUID16(0x2901), []byte("fan"), WriteHandlerFunc(func(r Request, data []byte) byte {
+		written = append(written, string(data))
+		owner = r.Characteristic
+		return StatusSuccess
+	}))
+	char.AddDescriptor(UUID16(0x2904), []byte{0x04}, nil)
+	var validated []PreparedWrite
+	l2c.handler.(*testL2CapHandler).validate = func(writes []PreparedWrite) byte {
+		validated = writes
+		return StatusSuccess
+	}
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 10: declaration, 11: value, 12: writable descriptor, 13: read-only descriptor
+	runRxTx(t, shim, []rxtx{
+		{name: "read 12 -- static value", send: "0a0c00", want: "0b66616e"},
+		{name: "prepare 12 offset 0 -- echoed", send: "160c0000004c6976", want: "170c0000004c6976"},
+		{name: "prepare 12 offset 3 -- echoed", send: "160c000300696e67", want: "170c000300696e67"},
+		{name: "prepare 13 (read-only) -- write not permitted", send: "160d00000061", want: "01160d0003"},
+		{name: "execute -- ok", send: "1801", want: "19"},
+		{name: "write 12 -- ok", send: "120c0061", want: "13"},
+		{name: "write cmd 12 -- dropped", event: "data 520c0062"},
+		{name: "read 12 -- still the static value", send: "0a0c00", want: "0b66616e"},
+	})
+
+	if want := []string{"Living", "a"}; fmt.Sprint(written) != fmt.Sprint(want) {
+		t.Errorf("written: got %q want %q", written, want)
+	}
+	if owner != char {
+		t.Errorf("write handler got characteristic %v, want the owner, %v", owner, char)
+	}
+	if len(validated) != 1 || validated[0].Handle != 12 || validated[0].Characteristic != char || string(validated[0].Value) != "Living" {
+		t.Errorf("validated %+v, want one write of %q to 12 owned by %v", validated, "Living", char)
+	}
+}
+
+func TestDescriptorWriteSecurity(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	char.RequireSecurity(SecurityMedium)
+	char.AddDescriptor(UUID16(0x2901), nil, WriteHandlerFunc(func(r Request, data []byte) byte { return StatusSuccess }))
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "prepare 12 -- insufficient encryption", send: "160c00000061", want: "01160c000f"},
+		{name: "write 12 -- insufficient encryption", send: "120c0061", want: "01120c000f"},
+		{name: "read 12 -- ok", send: "0a0c00", want: "0b"},
+		{name: "encrypt", event: "security medium"},
+		{name: "write 12 -- ok", send: "120c0061", want: "13"},
+	})
+}
+
+func TestPause(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	newService := func(u uint16, value string) *Service {
+		svc := &Service{uuid: UUID16(u)}
+		char := svc.AddCharacteristic(UUID16(u + 1))
+		char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) { io.WriteString(resp, value) })
+		char.HandleWriteFunc(func(r Request, data []byte) byte { return StatusSuccess })
+		return svc
+	}
+	ota, main := newService(0xfff0, "ota"), newService(0xffe0, "main")
+	l2c.setServices("", []*Service{ota, main})
+	go l2c.listenAndServe()
+
+	// ota: [9,11], 11: value; main: [12,14], 14: value
+	start, end, _ := l2c.handles.serviceRange(ota)
+	l2c.pause([][2]uint16{{start, end}})
+	runRxTx(t, shim, []rxtx{
+		{name: "read 14 (main) -- busy", send: "0a0e00", want: "010a0e0080"},
+		{name: "write 14 (main) -- busy", send: "120e0061", want: "01120e0080"},
+		{name: "write cmd 14 (main) -- dropped", event: "data 520e0061"},
+		{name: "read 11 (ota) -- ok", send: "0a0b00", want: "0b6f7461"},
+		{name: "write 11 (ota) -- ok", send: "120b0061", want: "13"},
+		{name: "read 2 (device name) -- busy", send: "0a0200", want: "010a020080"},
+		{name: "read by type [9,11] 0xfff1 -- ok", send: "0809000b00f1ff", want: "09050b006f7461"},
+		{name: "read by type [1,ffff] 0xffe1 -- busy", send: "080100ffffe1ff", want: "0108010080"},
+		{
+			name: "read by type [c,ffff] 0x2803 -- 13: read|write|write cmd, 14, 0xffe1",
+			send: "080c00ffff0328",
+			want: "09070d000e0e00e1ff",
+		},
+		{name: "read by group [1,ffff] -- discovery ok", send: "100100ffff0028", want: "110601000500001806000800011809000b00f0ff"},
+		{name: "prepare 14 (main) -- busy", send: "160e00000061", want: "01160e0080"},
+		{name: "read multiple 11, 14 -- busy", send: "0e0b000e00", want: "010e0b0080"},
+		{name: "read multiple 11, 11 -- ok", send: "0e0b000b00", want: "0f6f74616f7461"},
+		{name: "mtu 0x40 -- ok", send: "024000", want: "034000"},
+	})
+
+	l2c.resume()
+	runRxTx(t, shim, []rxtx{
+		{name: "read 14 (main) -- ok", send: "0a0e00", want: "0b6d61696e"},
+	})
+}
+
+func TestUnhandledCharacteristic(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleRead(nil)
+	char.HandleWrite(nil)
+	char.HandleNotify(nil)
+	char.descs = []*desc{&desc{uuid: UUID16(0x2901)}}
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "read 11 (no handler) -- read not permitted", send: "0a0b00", want: "010a0b0002"},
+		{name: "read by type [9,ffff] 0xfff1 (no handler) -- read not permitted", send: "080900fffff1ff", want: "01080b0002"},
+		{name: "write 11 (no handler) -- write not permitted", send: "120b0061", want: "01120b0003"},
+		{name: "write ccc 12 notify (no handler) -- ok", send: "120c000100", want: "13"},
+		{name: "read 13 (descriptor without value) -- empty", send: "0a0d00", want: "0b"},
+	})
+}
+
+func TestZeroLengthWrite(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	writes := make(chan []byte, 1)
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleWriteFunc(func(r Request, data []byte) byte {
+		writes <- data
+		return StatusSuccess
+	})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	check := func(name string) {
+		data := <-writes
+		if data == nil || len(data) != 0 {
+			t.Errorf("%s: handler got %#v, want non-nil empty slice", name, data)
+		}
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "write 11, no data -- ok", send: "120b00", want: "13", after: func() { check("write") }},
+		{name: "write cmd 11, no data", event: "data 520b00"},
+		{name: "truncated write -- invalid pdu", send: "120b", want: "0112000004", after: func() { check("write cmd") }},
+	})
+}
+
+func TestSetPHY(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.phyc = make(chan [2]PHY, 1)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	if err := l2c.setPHY(a, PHY2M, PHY2M); err == nil {
+		t.Errorf("setPHY while disconnected: got nil error")
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "supports 1M, 2M", event: "phys 3"},
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "mtu 23 -- ok; events processed", send: "021700", want: "031700"},
+	})
+
+	if err := l2c.setPHY(a, PHY2M, PHY2M|PHYCoded); err == nil {
+		t.Errorf("setPHY(2M, 2M|Coded) without coded support: got nil error")
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.setPHY(a, PHY2M, PHY1M|PHY2M) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "setPHY(2M, 1M|2M) -- sent to shim", want: "phy 01:02:03:04:05:06 2 3"},
+	})
+	if err := <-errc; err != nil {
+		t.Errorf("setPHY(2M, 1M|2M): %v", err)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "phy update 2M, 1M", event: "phy 2 1"},
+	})
+	if got, want := <-h.phyc, [2]PHY{PHY2M, PHY1M}; got != want {
+		t.Errorf("phy update: got %v want %v", got, want)
+	}
+}
+
+func TestUnexpectedConfirmation(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "confirmation, no indication pending -- ignored", event: "data 1e"},
+		{name: "another confirmation -- ignored", event: "data 1e"},
+		{name: "mtu 23 -- ok, nothing sent in between", send: "021700", want: "031700"},
+	})
+
+	l2c.pause(nil)
+	runRxTx(t, shim, []rxtx{
+		{name: "confirmation while paused -- ignored", event: "data 1e"},
+		{name: "mtu 23 -- ok, nothing sent in between", send: "021700", want: "031700"},
+	})
+}
+
+func TestLastActivity(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	var nowmu sync.Mutex
+	now := time.Unix(1000, 0)
+	l2c.now = func() time.Time {
+		nowmu.Lock()
+		defer nowmu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowmu.Lock()
+		now = now.Add(d)
+		nowmu.Unlock()
+	}
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	addr := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	check := func(name string, want time.Time) {
+		if got := l2c.lastActivity(addr); !got.Equal(want) {
+			t.Errorf("%s: lastActivity got %v want %v", name, got, want)
+		}
+	}
+
+	check("before connect", time.Time{})
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "mtu 23 -- ok", send: "021700", want: "031700"},
+	})
+	check("after first request", time.Unix(1000, 0))
+
+	advance(5 * time.Second)
+	runRxTx(t, shim, []rxtx{
+		{name: "rssi -- not ATT activity", event: "rssi -40"},
+		{name: "mtu 23 -- ok", send: "021700", want: "031700"},
+	})
+	check("after second request", time.Unix(1005, 0))
+	if got := l2c.lastActivity(net.HardwareAddr{6, 5, 4, 3, 2, 1}); !got.IsZero() {
+		t.Errorf("lastActivity of unconnected addr: got %v want zero time", got)
+	}
+}
+
+func TestSnapshotLongReads(t *testing.T) {
+	for _, snapshot := range []bool{false, true} {
+		l2c, shim := newTestL2cap()
+		value := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+		svc := &Service{uuid: UUID16(0xfff0)}
+		char := svc.AddCharacteristic(UUID16(0xfff1))
+		char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+			v := value[req.Offset:]
+			if len(v) > req.Cap {
+				v = v[:req.Cap]
+			}
+			resp.Write(v)
+		})
+		if snapshot {
+			char.SnapshotLongReads(time.Minute)
+		}
+		l2c.setServices("", []*Service{svc})
+		go l2c.listenAndServe()
+
+		// With an mtu of 23, reads return up to 22 bytes.
+		blob := "0d" + fmt.Sprintf("%x", "mnopqrstuvwxyz")
+		if !snapshot {
+			blob = "0d" + fmt.Sprintf("%x", "MNOPQRSTUVWXYZ")
+		}
+		runRxTx(t, shim, []rxtx{
+			{
+				name:  fmt.Sprintf("snapshot %t: read 11 -- first 22 bytes", snapshot),
+				send:  "0a0b00",
+				want:  "0b" + fmt.Sprintf("%x", "0123456789abcdefghijkl"),
+				after: func() { value = bytes.ToUpper(value) },
+			},
+			{
+				name: fmt.Sprintf("snapshot %t: value changed; read blob 11 at 22 -- rest", snapshot),
+				send: "0c0b001600",
+				want: blob,
+			},
+			{
+				name: fmt.Sprintf("snapshot %t: read blob 11 at 30 -- current value", snapshot),
+				send: "0c0b001e00",
+				want: "0d" + fmt.Sprintf("%x", "UVWXYZ"),
+			},
+		})
+	}
+}
+
+func TestEmptyData(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "empty data frame -- skipped", event: "data"},
+		{name: "empty data frame, trailing space -- skipped", event: "data "},
+		{name: "mtu 23 -- ok, still serving", send: "021700", want: "031700"},
+	})
+
+	if err := l2c.handleReq(nil); err != nil {
+		t.Errorf("handleReq(nil): got error %v, want nil", err)
+	}
+	if err := l2c.handleReq([]byte{}); err != nil {
+		t.Errorf("handleReq([]byte{}): got error %v, want nil", err)
+	}
+	// Nothing was sent; the MTU exchange would read it in its place.
+	runRxTx(t, shim, []rxtx{
+		{name: "mtu 23 -- ok, nothing sent for empty requests", send: "021700", want: "031700"},
+	})
+}
+
+func TestReadAsync(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.phyc = make(chan [2]PHY, 1)
+	reqc := make(chan *ReadRequest, 1)
+	resc := make(chan ReadResult, 1)
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleReadAsync(AsyncReadHandlerFunc(func(req *ReadRequest) <-chan ReadResult {
+		reqc <- req
+		return resc
+	}))
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept 01:02:03:04:05:06"},
+		{name: "read blob 11 at 2 -- pending", event: "data 0c0b000200"},
+		{name: "phy update, while read is pending", event: "phy 2 2"},
+	})
+	// The read starts a byte early, so the server can check the offset.
+	if req := <-reqc; req.Offset != 1 || req.Cap != 23 {
+		t.Errorf("async read: got offset %d, cap %d want offset 1, cap 23", req.Offset, req.Cap)
+	}
+	if got := <-h.phyc; got != [2]PHY{PHY2M, PHY2M} {
+		t.Errorf("phy update while read pending: got %v", got)
+	}
+	resc <- ReadResult{Value: []byte("bcd")}
+	runRxTx(t, shim, []rxtx{
+		{name: "-- read blob response", want: "0d6364"},
+		{name: "read by type [1,ffff] 0xfff1 -- pending", event: "data 080100fffff1ff"},
+		{name: "mtu 23 -- waits for read", event: "data 021700"},
+	})
+	<-reqc
+	resc <- ReadResult{Status: StatusUnexpectedError}
+	runRxTx(t, shim, []rxtx{
+		{name: "-- read by type error", want: "01080b000e"},
+		{name: "-- then mtu response", want: "031700"},
+		{name: "read 11 -- pending", event: "data 0a0b00"},
+		{name: "disconnect a, abandoning read", event: "disconnect 01:02:03:04:05:06"},
+		{name: "mtu 23 -- ok, disconnect processed", send: "021700", want: "031700"},
+	})
+	<-reqc
+	resc <- ReadResult{Value: []byte("abandoned")}
+	runRxTx(t, shim, []rxtx{
+		{name: "mtu 23 -- ok, nothing sent in between", send: "021700", want: "031700"},
+	})
+
+	// Another central disconnecting does not abandon the read.
+	select {
+	case <-resc: // not taken by the abandoned read
+	default:
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept 01:02:03:04:05:06"},
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "switch to a", event: "conn 01:02:03:04:05:06"},
+		{name: "a: read 11 -- pending", event: "data 0a0b00"},
+		{name: "disconnect b", event: "disconnect 0a:0b:0c:0d:0e:0f"},
+	})
+	<-reqc
+	resc <- ReadResult{Value: []byte("ab")}
+	runRxTx(t, shim, []rxtx{
+		{name: "a: -- read response", want: "0b6162"},
+		{name: "a: mtu 23 -- ok", send: "021700", want: "031700"},
+	})
+}
+
+func TestResetConn(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	var wrote []string
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	char.HandleWriteFunc(func(r Request, data []byte) byte {
+		wrote = append(wrote, string(data))
+		return StatusSuccess
+	})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	addr := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	if err := l2c.resetConn(addr); err == nil {
+		t.Errorf("resetConn while disconnected: got nil error")
+	}
+
+	// 11: fff1 value, 12: ccc
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "mtu 100 -- ok", send: "026400", want: "036400"},
+		{name: "subscribe -- ok", send: "120c000100", want: "13"},
+		{name: "prepare 11 -- echoed", send: "160b00000061", want: "170b00000061"},
+		{name: "read ccc -- subscribed", send: "0a0c00", want: "0b0100"},
+		{name: "security medium", event: "security medium"},
+		{name: "find info [12,ffff] -- 12: 0x2902; security processed", send: "040c00ffff", want: "05010c000229"},
+	})
+
+	if err := l2c.resetConn(addr); err != nil {
+		t.Fatalf("resetConn: %v", err)
+	}
+	l2c.connmu.RLock()
+	mtu := l2c.conn.mtu
+	l2c.connmu.RUnlock()
+	if mtu != 23 {
+		t.Errorf("mtu after reset: got %d want 23", mtu)
+	}
+	if h.stopped != 1 {
+		t.Errorf("stopNotify called %d times, want 1", h.stopped)
+	}
+	if l2c.conn.security != SecurityLow {
+		t.Errorf("security after reset: got %v want %v", l2c.conn.security, SecurityLow)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "read ccc -- not subscribed", send: "0a0c00", want: "0b0000"},
+		{name: "execute -- nothing queued", send: "1801", want: "19"},
+	})
+	if len(wrote) != 0 {
+		t.Errorf("execute after reset wrote %q", wrote)
+	}
+}
+
+func TestReadByTypeMultiple(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	for _, v := range []string{"ab", "cd", "xyz", "ef"} {
+		v := v
+		svc.AddCharacteristic(UUID16(0xfff1)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+			io.WriteString(resp, v)
+		})
+	}
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		io.WriteString(resp, "gh")
+	})
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleWriteFunc(func(r Request, data []byte) byte { return StatusSuccess })
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// fff1 values: 11: "ab", 13: "cd", 15: "xyz", 17: "ef"; fff2 values: 19: "gh", 21: write-only
+	runRxTx(t, shim, []rxtx{
+		{name: "read by type [1,ffff] 0xfff1 -- 11: ab, 13: cd", send: "080100fffff1ff", want: "09040b0061620d006364"},
+		{name: "read by type [e,ffff] 0xfff1 -- 15: xyz", send: "080e00fffff1ff", want: "09050f0078797a"},
+		{name: "read by type [10,ffff] 0xfff1 -- 17: ef", send: "081000fffff1ff", want: "090411006566"},
+		{name: "read by type [1,ffff] 0xfff2 -- 19: gh, then write-only", send: "080100fffff2ff", want: "090413006768"},
+		{name: "read by type [14,ffff] 0xfff2 -- write-only", send: "081400fffff2ff", want: "0108150002"},
+	})
+}
+
+func TestStrictServices(t *testing.T) {
+	newServices := func() []*Service {
+		svc := &Service{uuid: UUID16(0xfff0)}
+		svc.AddCharacteristic(UUID16(0xfff1))
+		svc.AddCharacteristic(UUID16(0xfff2))
+		svc.AddCharacteristic(UUID16(0xfff1))
+		other := &Service{uuid: UUID16(0xffe0)}
+		other.AddCharacteristic(UUID16(0xfff2))
+		return []*Service{svc, other}
+	}
+
+	l2c, _ := newTestL2cap()
+	if err := l2c.setServices("", newServices()); err != nil {
+		t.Errorf("setServices with duplicate UUIDs: %v", err)
+	}
+
+	l2c, _ = newTestL2cap()
+	l2c.strict = true
+	if err := l2c.setServices("", newServices()); err == nil {
+		t.Errorf("strict setServices with duplicate UUIDs: got nil error")
+	}
+	svcs := newServices()
+	svcs[0].chars = svcs[0].chars[:2]
+	if err := l2c.setServices("", svcs); err != nil {
+		t.Errorf("strict setServices, UUIDs duplicated only across services: %v", err)
+	}
+}
+
+func TestMustFitMTU(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	type tooLong struct{ valueLen, mtu int }
+	var got []tooLong
+	svc := &Service{uuid: UUID16(0xfff0)}
+	long := svc.AddCharacteristic(UUID16(0xfff1))
+	long.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		resp.Write(bytes.Repeat([]byte{'a'}, 30)[req.Offset:])
+	})
+	long.MustFitMTU(func(valueLen, mtu int) { got = append(got, tooLong{valueLen, mtu}) })
+	short := svc.AddCharacteristic(UUID16(0xfff2))
+	short.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		resp.Write([]byte("0123456789")[req.Offset:])
+	})
+	short.MustFitMTU(nil)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: 30 byte value, 13: 10 byte value
+	runRxTx(t, shim, []rxtx{
+		{name: "read 11 at mtu 23 -- invalid length", send: "0a0b00", want: "010a0b000d"},
+		{name: "read blob 11 at 22 -- invalid length", send: "0c0b001600", want: "010c0b000d"},
+		{name: "read by type [1,ffff] 0xfff1 -- invalid length", send: "080100fffff1ff", want: "01080b000d"},
+		{name: "read 13 -- ok", send: "0a0d00", want: "0b" + fmt.Sprintf("%x", "0123456789")},
+		{name: "read blob 13 at 4 -- ok", send: "0c0d000400", want: "0d" + fmt.Sprintf("%x", "456789")},
+		{name: "read blob 13 at 11 -- invalid offset", send: "0c0d000b00", want: "010c0d0007"},
+		{name: "mtu 40 -- ok", send: "022800", want: "032800"},
+		{name: "read 11 at mtu 40 -- ok", send: "0a0b00", want: "0b" + strings.Repeat("61", 30)},
+	})
+
+	want := []tooLong{{30, 23}, {30, 23}, {30, 23}}
+	if len(got) != len(want) {
+		t.Fatalf("tooLong calls: got %v want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("tooLong calls: got %v want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestMTUEvent(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.mtuc = make(chan int, 10)
+	l2c.setServices("", []*Service{newEchoService()})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "shim negotiated mtu 30", event: "mtu 30"},
+		{name: "write 'abcdefghijklmnopqrstuvwxyz' -- ok", send: "120b00" + fmt.Sprintf("%x", "abcdefghijklmnopqrstuvwxyz"), want: "13"},
+		{name: "read -- 26 bytes fit at mtu 30", send: "0a0b00", want: "0b" + fmt.Sprintf("%x", "abcdefghijklmnopqrstuvwxyz")},
+		{name: "shim negotiated mtu 30 again", event: "mtu 30"},
+		{name: "shim negotiated mtu 10, too small", event: "mtu 10"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+
+	var got []int
+	for len(h.mtuc) > 0 {
+		got = append(got, <-h.mtuc)
+	}
+	if want := []int{30, 23}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("mtuChanged calls: got %v want %v", got, want)
+	}
+}
+
+func TestMTUExchangeEvent(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.mtuc = make(chan int, 10)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "exchange mtu 185", send: "02b900", want: "03b900"},
+		{name: "exchange mtu 185 again", send: "02b900", want: "03b900"},
+		{name: "disconnect", event: "disconnect 01:02:03:04:05:06"},
+		{name: "reconnect", event: "accept 01:02:03:04:05:06"},
+		{name: "exchange mtu 23", send: "021700", want: "031700"},
+	})
+
+	var got []int
+	for len(h.mtuc) > 0 {
+		got = append(got, <-h.mtuc)
+	}
+	if want := []int{185, 23}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("mtuChanged calls: got %v want %v", got, want)
+	}
+}
+
+func TestSecurityEvent(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.securityc = make(chan SecurityLevel, 10)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "security low -- unchanged", event: "security low"},
+		{name: "security high", event: "security high"},
+		{name: "security high again", event: "security high"},
+		{name: "security medium", event: "security medium"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+
+	var got []SecurityLevel
+	for len(h.securityc) > 0 {
+		got = append(got, <-h.securityc)
+	}
+	if want := []SecurityLevel{SecurityHigh, SecurityMedium}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("securityChanged calls: got %v want %v", got, want)
+	}
+	if s := SecurityLevel(7).String(); s != "SecurityLevel(7)" {
+		t.Errorf("unknown SecurityLevel String: got %q", s)
+	}
+}
+
+func TestDataLengthEvent(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.datalenc = make(chan [2]int, 10)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "data length 251 251", event: "datalen 251 251"},
+		{name: "data length 251 251 again", event: "datalen 251 251"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	if tx, rx := l2c.connDataLength(a); tx != 251 || rx != 251 {
+		t.Errorf("connDataLength: got %d, %d want 251, 251", tx, rx)
+	}
+
+	l2c.skipBad = true
+	runRxTx(t, shim, []rxtx{
+		{name: "data length too long -- skipped", event: "datalen 252 251"},
+		{name: "data length 251 27", event: "datalen 251 27"},
+		{name: "reconnect", event: "accept 01:02:03:04:05:06"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	if tx, rx := l2c.connDataLength(a); tx != 27 || rx != 27 {
+		t.Errorf("connDataLength after reconnecting: got %d, %d want 27, 27", tx, rx)
+	}
+
+	var got [][2]int
+	for len(h.datalenc) > 0 {
+		got = append(got, <-h.datalenc)
+	}
+	if want := [][2]int{{251, 251}, {251, 27}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("dataLengthChanged calls: got %v want %v", got, want)
+	}
+}
+
+func TestOwnAddressEvent(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	h.addrc = make(chan string, 10)
+	l2c.setServices("", []*Service{newEchoService()})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "own address", event: "bdaddr 01:02:03:04:05:06"},
+		{name: "rotated", event: "ownaddr 4a:bb:cc:dd:ee:ff"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+
+	if len(h.addrc) != 1 {
+		t.Fatalf("ownAddressChanged calls: got %d want 1", len(h.addrc))
+	}
+	if got, want := <-h.addrc, "4a:bb:cc:dd:ee:ff"; got != want {
+		t.Errorf("ownAddressChanged: got %q want %q", got, want)
+	}
+}
+
+func TestFindByTypeValue(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	var svcs []*Service
+	for _, u := range []uint16{0xaaaa, 0xbbbb, 0xaaaa} {
+		svc := &Service{uuid: UUID16(u)}
+		svc.AddCharacteristic(UUID16(0xfff1)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+		svcs = append(svcs, svc)
+	}
+	l2c.setServices("", svcs)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "find by type [0001,ffff] 0x2800 0xaaaa", send: "060100ffff0028aaaa", want: "0709000b000f001100"},
+		{name: "find by type [0001,ffff] 0x2800 0xbbbb", send: "060100ffff0028bbbb", want: "070c000e00"},
+		{name: "find by type [000a,ffff] 0x2800 0xaaaa", send: "060a00ffff0028aaaa", want: "070f001100"},
+		{name: "find by type [0001,ffff] 0x2800 0xcccc", send: "060100ffff0028cccc", want: "010601000a"},
+	})
+}
+
+func TestFindByTypeValueAttribute(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	for _, c := range []struct {
+		uuid  uint16
+		value byte
+	}{{0xfff1, 0x01}, {0xfff1, 0x02}, {0xfff2, 0x01}} {
+		value := c.value
+		svc.AddCharacteristic(UUID16(c.uuid)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+			resp.Write([]byte{value})
+		})
+	}
+	svc.AddCharacteristic(UUID16(0xfff3)).HandleWriteFunc(func(r Request, data []byte) byte { return StatusSuccess })
+	var asyncReads int
+	svc.AddCharacteristic(UUID16(0xfff4)).HandleReadAsync(AsyncReadHandlerFunc(func(req *ReadRequest) <-chan ReadResult {
+		asyncReads++
+		resc := make(chan ReadResult, 1)
+		resc <- ReadResult{Value: []byte{0x01}}
+		return resc
+	}))
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "find by type [0001,ffff] 0xfff4 01, async -- not compared", send: "060100fffff4ff01", want: "010601000a"},
+		{name: "find by type [0001,ffff] 0xfff1 01", send: "060100fffff1ff01", want: "070b000b00"},
+		{name: "find by type [0001,ffff] 0xfff1 02", send: "060100fffff1ff02", want: "070d000d00"},
+		{name: "find by type [0001,ffff] 0xfff2 01", send: "060100fffff2ff01", want: "070f000f00"},
+		{name: "find by type [0001,ffff] 0xfff1 03", send: "060100fffff1ff03", want: "010601000a"},
+		{name: "find by type [000c,ffff] 0xfff1 01", send: "060c00fffff1ff01", want: "01060c000a"},
+		{name: "find by type [0001,ffff] 0xfff1 0101", send: "060100fffff1ff0101", want: "010601000a"},
+		{name: "find by type [0001,ffff] 0xfff3, unreadable", send: "060100fffff3ff", want: "010601000a"},
+		{name: "find by type [0001,ffff] 0x2803", send: "060100ffff0328020b00f1ff", want: "070a000a00"},
+		{name: "find by type, short pdu", send: "060100ffff00", want: "0106000004"},
+	})
+	if asyncReads != 0 {
+		t.Errorf("find by type read the async value %d times, want 0", asyncReads)
+	}
+}
+
+func TestWriteCommandErrors(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleWriteFunc(func(r Request, data []byte) byte {
+		return StatusUnexpectedError
+	})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// Write Commands never get a response. Each is followed by an
+	// MTU exchange; any stray error response would be read in its place.
+	sync := rxtx{name: "sync", send: "021700", want: "031700"}
+	runRxTx(t, shim, []rxtx{
+		{name: "write cmd, short pdu", event: "data 520b"},
+		sync,
+		{name: "write cmd, no such handle", event: "data 52ff00ab"},
+		sync,
+		{name: "write cmd, service declaration", event: "data 520900ab"},
+		sync,
+		{name: "write cmd, characteristic declaration", event: "data 520a00ab"},
+		sync,
+		{name: "write cmd, read-only characteristic", event: "data 520b00ab"},
+		sync,
+		{name: "write cmd, handler fails", event: "data 520d00ab"},
+		sync,
+		{name: "write req, handler fails", send: "120d00ab", want: fmt.Sprintf("01120d00%02x", StatusUnexpectedError)},
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "security high", event: "security high"},
+		{name: "write cmd, insufficient authentication", event: "data 520d00ab"},
+		sync,
+	})
+}
+
+func TestIndicateSequence(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	c1 := svc.AddCharacteristic(UUID16(0xfff1))
+	c1.HandleIndicateFunc(func(r Request, n Notifier) {})
+	c2 := svc.AddCharacteristic(UUID16(0xfff2))
+	c2.HandleIndicateFunc(func(r Request, n Notifier) {})
+	c3 := svc.AddCharacteristic(UUID16(0xfff3))
+	c3.HandleIndicateFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	var confirmed []string
+	items := []IndicateItem{
+		{Characteristic: c1, Value: []byte{0x01}, Confirmed: func() { confirmed = append(confirmed, "c1") }},
+		{Characteristic: c2, Value: []byte{0x02}, Confirmed: func() { confirmed = append(confirmed, "c2") }},
+		{Characteristic: c1, Value: []byte{0x03}, Confirmed: func() { confirmed = append(confirmed, "c1 again") }},
+	}
+
+	// 11, 14, 17: values; 12, 15, 18: cccs
+	runRxTx(t, shim, []rxtx{
+		{name: "subscribe c1, indicate", send: "120c000200", want: "13"},
+		{name: "subscribe c2, indicate", send: "120f000200", want: "13"},
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.indicateSequence(items) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "indicate c1", want: "1d0b0001"},
+		{name: "confirm", event: "data 1e"},
+		{name: "indicate c2", want: "1d0e0002"},
+		{name: "confirm", event: "data 1e"},
+		{name: "indicate c1 again", want: "1d0b0003"},
+		{name: "confirm", event: "data 1e"},
+	})
+	if err := <-errc; err != nil {
+		t.Errorf("indicateSequence: %v", err)
+	}
+	if want := []string{"c1", "c2", "c1 again"}; fmt.Sprint(confirmed) != fmt.Sprint(want) {
+		t.Errorf("confirmed: got %v want %v", confirmed, want)
+	}
+
+	// A stale confirmation must not confirm the next indication,
+	// and an unconfirmed indication aborts the sequence.
+	confirmed = nil
+	l2c.cnfTimeout = 50 * time.Millisecond
+	go func() { errc <- l2c.indicateSequence(items) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "indicate c1", want: "1d0b0001"},
+		{name: "confirm", event: "data 1e"},
+		{name: "indicate c2", want: "1d0e0002"},
+	})
+	err := <-errc
+	serr, ok := err.(*IndicateSequenceError)
+	if !ok {
+		t.Fatalf("indicateSequence without confirmation: got %v want *IndicateSequenceError", err)
+	}
+	if serr.Confirmed != 1 {
+		t.Errorf("indicateSequence without confirmation: got %d confirmed want 1", serr.Confirmed)
+	}
+	if want := []string{"c1"}; fmt.Sprint(confirmed) != fmt.Sprint(want) {
+		t.Errorf("confirmed: got %v want %v", confirmed, want)
+	}
+
+	// No central has subscribed to indications of c3.
+	confirmed = nil
+	go func() {
+		errc <- l2c.indicateSequence([]IndicateItem{items[0], {Characteristic: c3, Value: []byte{0x04}}})
+	}()
+	runRxTx(t, shim, []rxtx{
+		{name: "indicate c1", want: "1d0b0001"},
+		{name: "confirm", event: "data 1e"},
+		{name: "sync -- c3 not indicated", send: "021700", want: "031700"},
+	})
+	err = <-errc
+	if serr, ok := err.(*IndicateSequenceError); !ok || serr.Confirmed != 1 || serr.Err != errNotSubscribed {
+		t.Errorf("indicateSequence of unsubscribed c3: got %v want 1 confirmed, then %v", err, errNotSubscribed)
+	}
+}
+
+func TestDisconnectReason(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	sync := rxtx{name: "sync", send: "021700", want: "031700"}
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "disconnect, no reason", event: "disconnect 01:02:03:04:05:06"},
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "disconnect, timeout", event: "disconnect 01:02:03:04:05:06 08"},
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "disconnect, remote user", event: "disconnect 01:02:03:04:05:06 13"},
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "disconnect, other", event: "disconnect 01:02:03:04:05:06 3e"},
+		sync,
+	})
+	want := []string{
+		"01:02:03:04:05:06 unknown",
+		"01:02:03:04:05:06 connection timeout",
+		"01:02:03:04:05:06 remote user terminated connection",
+		"01:02:03:04:05:06 DisconnectReason(0x3e)",
+	}
+	if fmt.Sprint(h.disconnects) != fmt.Sprint(want) {
+		t.Errorf("disconnections: got %q want %q", h.disconnects, want)
+	}
+}
+
+func TestMalformedEvents(t *testing.T) {
+	bad := []string{
+		"accept zz:zz",
+		"disconnect 01:02",
+		"disconnect 01:02:03:04:05:06 zz",
+		"rssi loud",
+		"security bogus",
+		"mtu big",
+		"phys xyz",
+		"phy 1",
+		"phy 1 q",
+		"data 0",
+	}
+
+	l2c, shim := newTestL2cap()
+	l2c.skipBad = true
+	l2c.setServices("", []*Service{newEchoService()})
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.listenAndServe() }()
+
+	for _, s := range bad {
+		runRxTx(t, shim, []rxtx{
+			{name: s, event: s},
+			{name: "sync after " + s, send: "021700", want: "031700"},
+		})
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("listenAndServe stopped after malformed lines: %v", err)
+	default:
+	}
+
+	for _, s := range bad {
+		l2c, shim := newTestL2cap()
+		l2c.setServices("", []*Service{newEchoService()})
+		errc := make(chan error, 1)
+		go func() { errc <- l2c.listenAndServe() }()
+		shim.readc <- []byte(s + "\n")
+		err := <-errc
+		if _, ok := err.(badEventError); !ok {
+			t.Errorf("listenAndServe after %q: got %v want badEventError", s, err)
+		}
+	}
+}
+
+func TestMalformedEventHandler(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.skipBad = true
+	var got []string
+	l2c.badEvent = func(line string, err error) {
+		got = append(got, line)
+		if _, ok := err.(badEventError); !ok {
+			t.Errorf("badEvent %q: got error %v want badEventError", line, err)
+		}
+	}
+	l2c.setServices("", []*Service{newEchoService()})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "garbage rssi", event: "rssi notanumber"},
+		{name: "sync", send: "021700", want: "031700"},
+		{name: "garbage mtu", event: "mtu big"},
+		{name: "sync again", send: "021700", want: "031700"},
+	})
+	if want := []string{"rssi notanumber", "mtu big"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("badEvent lines: got %q want %q", got, want)
+	}
+}
+
+// A testLogger records the messages logged at each level.
+type testLogger struct {
+	mu          sync.Mutex
+	debug, info []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.debug = append(l.debug, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.info = append(l.info, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func TestLogger(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	logger := new(testLogger)
+	l2c.logger = logger
+	l2c.setServices("", nil)
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "hci device", event: "hciDeviceId 0"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	want := []string{
+		"gatt: generated 8 handles for 0 services",
+		"gatt: l2cap received hciDeviceId 0",
+		"gatt: l2cap received data 021700",
+		"gatt: l2cap sending 031700",
+	}
+	if !reflect.DeepEqual(logger.debug, want) {
+		t.Errorf("debug messages: got %q want %q", logger.debug, want)
+	}
+	if want := []string{"gatt: l2cap hci device 0"}; !reflect.DeepEqual(logger.info, want) {
+		t.Errorf("info messages: got %q want %q", logger.info, want)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	c1 := svc.AddCharacteristic(UUID16(0xfff1))
+	c1.HandleNotifyFunc(func(r Request, n Notifier) {})
+	c2 := svc.AddCharacteristic(UUID16(0xfff2))
+	c2.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	addr, _ := net.ParseMAC("01:02:03:04:05:06")
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	if subs := l2c.subscriptions(addr); len(subs) != 0 {
+		t.Errorf("subscriptions before subscribing: got %v want none", subs)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "subscribe c2, indicate", send: "120f000200", want: "13"},
+		{name: "subscribe c1, notify", send: "120c000100", want: "13"},
+	})
+	want := []SubscriptionInfo{
+		{Characteristic: c1, Notify: true},
+		{Characteristic: c2, Indicate: true},
+	}
+	if got := l2c.subscriptions(addr); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriptions: got %+v want %+v", got, want)
+	}
+
+	other, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	if subs := l2c.subscriptions(other); subs != nil {
+		t.Errorf("subscriptions of unconnected central: got %v want nil", subs)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "unsubscribe c1", send: "120c000000", want: "13"},
+	})
+	want = want[1:]
+	if got := l2c.subscriptions(addr); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriptions after unsubscribing: got %+v want %+v", got, want)
+	}
+}
+
+func TestConnCCC(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	b, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept " + a.String()},
+		{name: "a: subscribe", send: "120c000100", want: "13"},
+		{name: "connect b", event: "accept " + b.String()},
+		{name: "b: read ccc -- target b", send: "0a0c00", want: "conn " + b.String()},
+		{name: "b: read ccc -- a's subscription is not b's", want: "0b0000"},
+		{name: "b: subscribe", send: "120c000100", want: "13"},
+		{name: "b: unsubscribe", send: "120c000000", want: "13"},
+		{name: "b: read ccc", send: "0a0c00", want: "0b0000"},
+	})
+	if h.started != 1 || h.stopped != 0 {
+		t.Errorf("startNotify, stopNotify calls with a subscribed: got %d, %d want 1, 0", h.started, h.stopped)
+	}
+	if subs := l2c.subscriptions(a); len(subs) != 1 || subs[0].Characteristic != char || !subs[0].Notify {
+		t.Errorf("subscriptions of a: got %+v want notify of %v", subs, char)
+	}
+	if subs := l2c.subscriptions(b); len(subs) != 0 {
+		t.Errorf("subscriptions of b: got %+v want none", subs)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "b: subscribe again", send: "120c000100", want: "13"},
+		{name: "disconnect a", event: "disconnect " + a.String()},
+		{name: "b: read ccc -- still subscribed", send: "0a0c00", want: "0b0100"},
+		{name: "disconnect b", event: "disconnect " + b.String()},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	if h.started != 1 || h.stopped != 1 {
+		t.Errorf("startNotify, stopNotify calls after disconnecting: got %d, %d want 1, 1", h.started, h.stopped)
+	}
+	if subs := l2c.subscriptions(a); subs != nil {
+		t.Errorf("subscriptions of disconnected a: got %+v want nil", subs)
+	}
+}
+
+func TestSendNotification(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	indicateOnly := svc.AddCharacteristic(UUID16(0xfff2))
+	indicateOnly.HandleIndicateFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	sync := rxtx{name: "sync", send: "021700", want: "031700"}
+	runRxTx(t, shim, []rxtx{{name: "connect", event: "accept 01:02:03:04:05:06"}})
+
+	if _, err := l2c.sendNotification(indicateOnly, []byte{0xcd}); err == nil {
+		t.Errorf("sendNotification of a characteristic without notify: got nil error")
+	}
+	// Nothing is sent to a central that hasn't subscribed;
+	// any stray notification would be read in place of the sync.
+	if n, err := l2c.sendNotification(char, []byte{0xcd}); n != 0 || err != nil {
+		t.Errorf("sendNotification, unsubscribed: got %d, %v want 0, nil", n, err)
+	}
+	runRxTx(t, shim, []rxtx{
+		sync,
+		{name: "subscribe", send: "120c000100", want: "13"},
+	})
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	send := func(data []byte) {
+		n, err := l2c.sendNotification(char, data)
+		done <- result{n, err}
+	}
+	go send([]byte{0xcd})
+	runRxTx(t, shim, []rxtx{{name: "notification", want: "1b0b00cd"}})
+	if res := <-done; res.n != 1 || res.err != nil {
+		t.Errorf("sendNotification: got %d, %v want 1, nil", res.n, res.err)
+	}
+
+	// Notifications are truncated to the MTU less 3 bytes.
+	data := bytes.Repeat([]byte("0123456789"), 20)
+	go send(data)
+	runRxTx(t, shim, []rxtx{{name: "notification -- truncated", want: "1b0b00" + fmt.Sprintf("%x", data[:20])}})
+	if res := <-done; res.n != 20 || res.err != nil {
+		t.Errorf("sendNotification of 200 bytes at mtu 23: got %d, %v want 20, nil", res.n, res.err)
+	}
+}
+
+func TestSuppressDuplicateNotifications(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	char.SuppressDuplicateNotifications()
+	plain := svc.AddCharacteristic(UUID16(0xfff2))
+	plain.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// Any stray notification would be read in place of the sync response.
+	sync := rxtx{name: "sync", send: "0a0c00", want: "0b0100"}
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "subscribe", send: "120c000100", want: "13"},
+		{name: "subscribe plain", send: "120f000100", want: "13"},
+	})
+
+	vh := map[*Characteristic]int{char: 0x0b, plain: 0x0e} // value handles
+	send := func(char *Characteristic, data string, want int) {
+		done := make(chan int, 1)
+		go func() {
+			n, err := l2c.sendNotification(char, []byte(data))
+			if err != nil {
+				t.Errorf("sendNotification(%q): %v", data, err)
+			}
+			done <- n
+		}()
+		if want > 0 {
+			runRxTx(t, shim, []rxtx{{name: "notification " + data, want: fmt.Sprintf("1b%02x00%x", vh[char], data)}})
+		}
+		if n := <-done; n != want {
+			t.Errorf("sendNotification(%q): got %d want %d", data, n, want)
+		}
+		if want == 0 {
+			runRxTx(t, shim, []rxtx{sync})
+		}
+	}
+	send(char, "hi", 2)
+	send(char, "hi", 0)
+	send(char, "ho", 2)
+	send(char, "hi", 2)
+	// Duplicates of other characteristics are sent.
+	send(plain, "hi", 2)
+	send(plain, "hi", 2)
+
+	// A central that subscribes again is sent the current value.
+	runRxTx(t, shim, []rxtx{
+		{name: "unsubscribe", send: "120c000000", want: "13"},
+		{name: "subscribe again", send: "120c000100", want: "13"},
+	})
+	send(char, "hi", 2)
+	send(char, "hi", 0)
+}
+
+func TestSendTooLong(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "set mtu to 100", send: "026400", want: "036400"},
+		{name: "reconnect -- mtu back to 23", event: "accept 01:02:03:04:05:06"},
+		{name: "sync", send: "0a0300", want: "0b"},
+	})
+
+	// A notification sized for the old MTU.
+	if _, err := l2c.notify(l2c.conn, 100, char, make([]byte, 50)); err == nil {
+		t.Errorf("notify exceeding the mtu: got nil error")
+	}
+	if err := l2c.send(make([]byte, 24)); err == nil {
+		t.Errorf("send of 24 bytes with mtu 23: got nil error")
+	}
+	// Nothing was sent; any stray pdu would be read in place of the sync.
+	runRxTx(t, shim, []rxtx{{name: "sync", send: "0a0300", want: "0b"}})
+}
+
+func TestMultipleConnections(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	value := bytes.Repeat([]byte("0123456789"), 20) // 200 bytes
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		resp.Write(value[:req.Cap])
+	})
+	secure := svc.AddCharacteristic(UUID16(0xfff2))
+	secure.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	secure.RequireSecurity(SecurityMedium)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	b, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	read := func(mtu int) string { return "0b" + fmt.Sprintf("%x", value[:mtu-1]) }
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept " + a.String()},
+		{name: "a: exchange mtu 100", send: "026400", want: "036400"},
+		{name: "a: read 11", send: "0a0b00", want: read(100)},
+		{name: "connect b", event: "accept " + b.String()},
+		{name: "b: read 11 -- target b", send: "0a0b00", want: "conn " + b.String()},
+		{name: "b: read 11 -- mtu 23", want: read(23)},
+		{name: "b: security medium", event: "security medium"},
+		{name: "b: read 13", send: "0a0d00", want: "0b"},
+		{name: "switch to a", event: "conn " + a.String()},
+		{name: "a: read 11 -- target a", send: "0a0b00", want: "conn " + a.String()},
+		{name: "a: read 11 -- mtu 100", want: read(100)},
+		{name: "a: read 13 -- not encrypted", send: "0a0d00", want: "010a0d000f"},
+		{name: "switch to b", event: "conn " + b.String()},
+		{name: "b: exchange mtu 50 -- target b", send: "023200", want: "conn " + b.String()},
+		{name: "b: exchange mtu 50", want: "033200"},
+		{name: "b: read 11 -- mtu 50", send: "0a0b00", want: read(50)},
+	})
+	if got := l2c.connMTU(a); got != 100 {
+		t.Errorf("mtu of a: got %d want 100", got)
+	}
+	if got := l2c.connMTU(b); got != 50 {
+		t.Errorf("mtu of b: got %d want 50", got)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "disconnect a", event: "disconnect " + a.String()},
+		{name: "b: read 11 -- still mtu 50", send: "0a0b00", want: read(50)},
+	})
+	if got := l2c.connMTU(a); got != 23 {
+		t.Errorf("mtu of disconnected a: got %d want 23", got)
+	}
+	if got := l2c.currentMTU(); got != 50 {
+		t.Errorf("current mtu: got %d want 50", got)
+	}
+}
+
+func TestMultipleConnectionsNotify(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	notify := svc.AddCharacteristic(UUID16(0xfff1))
+	notify.HandleNotifyFunc(func(r Request, n Notifier) {})
+	indicate := svc.AddCharacteristic(UUID16(0xfff3))
+	indicate.HandleIndicateFunc(func(r Request, n Notifier) {})
+	v1, v2 := bytes.Repeat([]byte("a"), 60), bytes.Repeat([]byte("b"), 60)
+	value := v1
+	snap := svc.AddCharacteristic(UUID16(0xfff5))
+	snap.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) { resp.Write(value[req.Offset:]) })
+	snap.SnapshotLongReads(time.Minute)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: notify value, 12: its ccc; 14: indicate value, 15: its ccc; 17: snapshot value
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	b, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	data := make([]byte, 40)
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept " + a.String()},
+		{name: "a: exchange mtu 30", send: "021e00", want: "031e00"},
+		{name: "a: subscribe 11", send: "120c000100", want: "13"},
+		{name: "connect b", event: "accept " + b.String()},
+		{name: "b: subscribe 11 -- target b", send: "120c000100", want: "conn " + b.String()},
+		{name: "b: subscribe 11", want: "13"},
+	})
+
+	// Each subscriber is notified, at its own MTU.
+	resc := make(chan int, 1)
+	go func() {
+		n, err := l2c.sendNotification(notify, data)
+		if err != nil {
+			t.Errorf("sendNotification: %v", err)
+		}
+		resc <- n
+	}()
+	runRxTx(t, shim, []rxtx{
+		{name: "-- target a", want: "conn " + a.String()},
+		{name: "-- a notified 27 bytes", want: "1b0b00" + fmt.Sprintf("%x", data[:27])},
+		{name: "-- target b", want: "conn " + b.String()},
+		{name: "-- b notified 20 bytes", want: "1b0b00" + fmt.Sprintf("%x", data[:20])},
+	})
+	if n := <-resc; n != 20 {
+		t.Errorf("sendNotification: got %d want 20, the least sent", n)
+	}
+
+	// b's events are current, but a can be notified.
+	go func() {
+		if err := l2c.notifyConn(a, notify, data); err != nil {
+			t.Errorf("notifyConn(a): %v", err)
+		}
+	}()
+	runRxTx(t, shim, []rxtx{
+		{name: "-- target a", want: "conn " + a.String()},
+		{name: "-- a notified 27 bytes", want: "1b0b00" + fmt.Sprintf("%x", data[:27])},
+	})
+
+	// Each central reads long values from its own snapshot.
+	runRxTx(t, shim, []rxtx{
+		{name: "switch to a", event: "conn " + a.String()},
+		{name: "a: read 17", send: "0a1100", want: "0b" + fmt.Sprintf("%x", v1[:29]), after: func() { value = v2 }},
+		{name: "switch to b", event: "conn " + b.String()},
+		{name: "b: read 17 -- target b", send: "0a1100", want: "conn " + b.String()},
+		{name: "b: read 17", want: "0b" + fmt.Sprintf("%x", v2[:22])},
+		{name: "switch to a", event: "conn " + a.String()},
+		{name: "a: read blob 17 offset 29 -- target a", send: "0c11001d00", want: "conn " + a.String()},
+		{name: "a: read blob 17 offset 29 -- a's snapshot", want: "0d" + fmt.Sprintf("%x", v1[29:58])},
+		{name: "switch to b", event: "conn " + b.String()},
+		{name: "b: read blob 17 offset 22 -- target b", send: "0c11001600", want: "conn " + b.String()},
+		{name: "b: read blob 17 offset 22 -- b's snapshot", want: "0d" + fmt.Sprintf("%x", v2[22:44])},
+	})
+
+	// Only the indicated central's confirmation completes an indication.
+	runRxTx(t, shim, []rxtx{
+		{name: "switch to a", event: "conn " + a.String()},
+		{name: "a: subscribe 14 -- target a", send: "120f000200", want: "conn " + a.String()},
+		{name: "a: subscribe 14", want: "13"},
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.sendIndication(indicate, []byte("x")) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "-- a indicated", want: "1d0e0078"},
+		{name: "switch to b", event: "conn " + b.String()},
+		{name: "b: confirm", event: "data 1e"},
+		{name: "b: sync -- target b", send: "021700", want: "conn " + b.String()},
+		{name: "b: sync", want: "031700"},
+	})
+	select {
+	case err := <-errc:
+		t.Fatalf("indication of a completed by b's confirmation: %v", err)
+	default:
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "switch to a", event: "conn " + a.String()},
+		{name: "a: confirm", event: "data 1e"},
+	})
+	if err := <-errc; err != nil {
+		t.Errorf("sendIndication: %v", err)
+	}
+}
+
+func TestNotifierCap(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect a", event: "accept 01:02:03:04:05:06"},
+		{name: "a: exchange mtu 185", send: "02b900", want: "03b900"},
+		{name: "a: subscribe", send: "120c000100", want: "13"},
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "b: sync -- target b", send: "021700", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "b: sync", want: "031700"},
+	})
+	n := l2c.handler.(*testL2CapHandler).notifiers[char]
+	if got := n.Cap(); got != 182 {
+		t.Errorf("Cap with a subscribed at mtu 185: got %d want 182", got)
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "b: exchange mtu 100", send: "026400", want: "036400"},
+		{name: "b: subscribe", send: "120c000100", want: "13"},
+	})
+	if got := n.Cap(); got != 97 {
+		t.Errorf("Cap with b also subscribed at mtu 100: got %d want 97", got)
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "disconnect b", event: "disconnect 0a:0b:0c:0d:0e:0f"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	if got := n.Cap(); got != 182 {
+		t.Errorf("Cap after b disconnected: got %d want 182", got)
+	}
+}
+
+func TestMaxValueLength(t *testing.T) {
+	l2c, _ := newTestL2cap()
+	if err := l2c.setServices(strings.Repeat("n", 512), nil); err != nil {
+		t.Errorf("setServices with 512 byte name: %v", err)
+	}
+	if err := l2c.setServices(strings.Repeat("n", 513), nil); err == nil {
+		t.Errorf("setServices with 513 byte name: got nil error")
+	}
+
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	var written []int
+	write := func(r Request, data []byte) byte {
+		written = append(written, len(data))
+		return StatusSuccess
+	}
+	short := svc.AddCharacteristic(UUID16(0xfff1))
+	short.HandleWriteFunc(write)
+	short.SetMaxLength(4)
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleWriteFunc(write)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: fff1 value, max 4; 13: fff2 value
+	rr := []rxtx{
+		{name: "write 4 bytes to 11", send: "120b0061626364", want: "13"},
+		{name: "write 5 bytes to 11", send: "120b006162636465", want: "01120b000d"},
+		{name: "write cmd 5 bytes to 11", event: "data 520b006162636465"},
+		{name: "prepare 11 offset 0", send: "160b000000616263", want: "170b000000616263"},
+		{name: "prepare 11 offset 3 -- too long", send: "160b000300646566", want: "01160b0009"},
+		{name: "execute -- first fragment only", send: "1801", want: "19"},
+	}
+	// A 513 byte value, in 18 byte fragments.
+	for off := 0; off < 513; off += 18 {
+		n := 18
+		if off+n > 513 {
+			n = 513 - off
+		}
+		pdu := fmt.Sprintf("0d00%02x%02x%x", byte(off), byte(off>>8), bytes.Repeat([]byte{'v'}, n))
+		want := "17" + pdu
+		if off+n > 512 {
+			want = "01160d0009"
+		}
+		rr = append(rr, rxtx{name: fmt.Sprintf("prepare 13 offset %d", off), send: "16" + pdu, want: want})
+	}
+	rr = append(rr, rxtx{name: "cancel", send: "1800", want: "19"})
+	runRxTx(t, shim, rr)
+
+	if want := []int{4, 3}; fmt.Sprint(written) != fmt.Sprint(want) {
+		t.Errorf("written lengths: got %v want %v", written, want)
+	}
+}
+
+func TestFixedLength(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	var written []string
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleWriteFunc(func(r Request, data []byte) byte {
+		written = append(written, fmt.Sprintf("%x", data))
+		return StatusSuccess
+	})
+	char.SetFixedLength(2)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: fff1 value, exactly 2 bytes
+	runRxTx(t, shim, []rxtx{
+		{name: "write 2 bytes", send: "120b000102", want: "13"},
+		{name: "write 1 byte -- wrong length", send: "120b0001", want: "01120b000d"},
+		{name: "write 3 bytes -- too long", send: "120b00010203", want: "01120b000d"},
+		{name: "write cmd 1 byte -- dropped", event: "data 520b0003"},
+		{name: "prepare offset 0, 1 byte", send: "160b00000004", want: "170b00000004"},
+		{name: "execute -- wrong length", send: "1801", want: "01180b000d"},
+		{name: "prepare offset 0, 1 byte again", send: "160b00000005", want: "170b00000005"},
+		{name: "prepare offset 1, 1 byte", send: "160b00010006", want: "170b00010006"},
+		{name: "execute -- ok", send: "1801", want: "19"},
+		{name: "prepare offset 2 -- beyond fixed length", send: "160b00020007", want: "01160b0009"},
+	})
+
+	if want := []string{"0102", "0506"}; fmt.Sprint(written) != fmt.Sprint(want) {
+		t.Errorf("written: got %v want %v", written, want)
+	}
+}
+
+func TestSharedServices(t *testing.T) {
+	var mu sync.Mutex
+	var value []byte
+	notifiers := make(map[Notifier]bool)
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+		resp.Write(value)
+	})
+	char.HandleWriteFunc(func(r Request, data []byte) byte {
+		mu.Lock()
+		defer mu.Unlock()
+		value = append([]byte(nil), data...)
+		return StatusSuccess
+	})
+	char.HandleNotifyFunc(func(r Request, n Notifier) {
+		mu.Lock()
+		defer mu.Unlock()
+		notifiers[n] = true
+	})
+	svcs := []*Service{svc}
+
+	// a and b serve svcs at the same handles; c serves it after
+	// another service, at different handles.
+	other := &Service{uuid: UUID16(0xbbbb)}
+	other.AddCharacteristic(UUID16(0xfff2)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	cases := []struct {
+		svcs   []*Service
+		valuen string // char value handle, little-endian hex
+		cccn   string // char ccc handle, little-endian hex
+	}{
+		{svcs: svcs, valuen: "0b00", cccn: "0c00"},
+		{svcs: svcs, valuen: "0b00", cccn: "0c00"},
+		{svcs: []*Service{other, svc}, valuen: "0e00", cccn: "0f00"},
+	}
+
+	servers := make([]*Server, len(cases))
+	shims := make([]*testL2CShim, len(cases))
+	var wg sync.WaitGroup
+	for i, tt := range cases {
+		s := &Server{shutdown: true} // don't advertise after disconnecting
+		shim := &testL2CShim{readc: make(chan []byte), writec: make(chan []byte)}
+		s.l2cap = newL2cap(shim, s)
+		servers[i], shims[i] = s, shim
+		wg.Add(1)
+		go func(i int, svcs []*Service, valuen, cccn string) {
+			defer wg.Done()
+			if err := s.l2cap.setServices(fmt.Sprint("l2cap ", i), svcs); err != nil {
+				t.Errorf("l2cap %d: setServices: %v", i, err)
+				return
+			}
+			go s.l2cap.listenAndServe()
+
+			rr := []rxtx{
+				{name: "connect", event: "accept 01:02:03:04:05:06"},
+				{name: "subscribe", send: "12" + cccn + "0100", want: "13"},
+			}
+			for j := 0; j < 10; j++ {
+				rr = append(rr,
+					rxtx{name: "write", send: "12" + valuen + "ab", want: "13"},
+					rxtx{name: "read", send: "0a" + valuen, want: "0bab"},
+				)
+			}
+			runRxTx(t, shim, rr)
+
+			done := make(chan error)
+			go func() {
+				_, err := s.l2cap.sendNotification(char, []byte{0xcd})
+				done <- err
+			}()
+			runRxTx(t, shim, []rxtx{{name: fmt.Sprint("l2cap ", i, " notification"), want: "1b" + valuen + "cd"}})
+			if err := <-done; err != nil {
+				t.Errorf("l2cap %d: sendNotification: %v", i, err)
+			}
+		}(i, tt.svcs, tt.valuen, tt.cccn)
+	}
+	wg.Wait()
+
+	// Each server runs its own notify handler.
+	if len(notifiers) != len(cases) {
+		t.Fatalf("notify handlers: got %d want %d", len(notifiers), len(cases))
+	}
+	// Unsubscribing from one server stops only its notifier.
+	stopped := servers[0].notifiers[char]
+	runRxTx(t, shims[0], []rxtx{{name: "unsubscribe", send: "12" + cases[0].cccn + "0000", want: "13"}})
+	if !stopped.Done() {
+		t.Errorf("l2cap 0 notifier not done after unsubscribing")
+	}
+	for n := range notifiers {
+		if n != Notifier(stopped) && n.Done() {
+			t.Errorf("notifier of another l2cap done after l2cap 0 unsubscribed")
+		}
+	}
+}
+
+func TestPrepareProgress(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	write := func(r Request, data []byte) byte { return StatusSuccess }
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleWriteFunc(write)
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleWriteFunc(write)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: fff1 value, 13: fff2 value
+	runRxTx(t, shim, []rxtx{
+		{name: "prepare 11 offset 0", send: "160b000000616263", want: "170b000000616263"},
+		{name: "prepare 13 offset 0", send: "160d0000007879", want: "170d0000007879"},
+		{name: "prepare 11 offset 3", send: "160b000300646566", want: "170b000300646566"},
+		{name: "prepare 11 offset 6", send: "160b00060067", want: "170b00060067"},
+		{name: "prepare 9 -- rejected", send: "1609000000ab", want: "0116090003"},
+		{name: "execute", send: "1801", want: "19"},
+		{name: "prepare 11 offset 0 again", send: "160b000000616263", want: "170b000000616263"},
+	})
+	want := []string{
+		"fff1: 3 bytes, 1 fragments",
+		"fff2: 2 bytes, 1 fragments",
+		"fff1: 6 bytes, 2 fragments",
+		"fff1: 7 bytes, 3 fragments",
+		"fff1: 3 bytes, 1 fragments",
+	}
+	if !reflect.DeepEqual(h.progress, want) {
+		t.Errorf("progress: got %q want %q", h.progress, want)
+	}
+}
+
+func TestReadMulti(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	for _, v := range []string{"0123456789", "abcdefgh", "ABCDEFGH"} {
+		v := v
+		svc.AddCharacteristic(UUID16(0xfff1)).HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+			io.WriteString(resp, v)
+		})
+	}
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleWriteFunc(func(r Request, data []byte) byte { return StatusSuccess })
+	async := svc.AddCharacteristic(UUID16(0xfff3))
+	async.HandleReadAsync(AsyncReadHandlerFunc(func(req *ReadRequest) <-chan ReadResult {
+		resc := make(chan ReadResult, 1)
+		resc <- ReadResult{Value: []byte("xyz")}
+		return resc
+	}))
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11, 13, 15: values; 17: write-only value; 19: async value
+	runRxTx(t, shim, []rxtx{
+		{name: "read multiple 11, 13", send: "0e0b000d00", want: "0f" + fmt.Sprintf("%x", "0123456789abcdefgh")},
+		{name: "read multiple 11, 13, 15 -- 15 clipped", send: "0e0b000d000f00", want: "0f" + fmt.Sprintf("%x", "0123456789abcdefghABCD")},
+		{name: "read multiple 15, 19 -- async not supported at 19", send: "0e0f001300", want: "010e130006"},
+		{name: "read multiple 9, 10 -- declarations", send: "0e09000a00", want: "0faaaa020b00f1ff"},
+		{name: "read multiple 11, 99 -- invalid at 99", send: "0e0b006300", want: "010e630001"},
+		{name: "read multiple 11, 17 -- not readable at 17", send: "0e0b001100", want: "010e110002"},
+		{name: "read multiple 11 -- too few handles", send: "0e0b00", want: "010e000004"},
+		{name: "read multiple odd length", send: "0e0b000d0000", want: "010e000004"},
+	})
+}
+
+func TestValidateWrite(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	var written []string
+	write := func(r Request, data []byte) byte {
+		written = append(written, string(data))
+		return StatusSuccess
+	}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleWriteFunc(write)
+	checked := svc.AddCharacteristic(UUID16(0xfff2))
+	checked.HandleWriteFunc(write)
+	checked.ValidateWrite(func(data []byte) byte {
+		if len(data) > 0 && data[0] == 'x' {
+			return 0x80 // application error: out of range
+		}
+		return StatusSuccess
+	})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: fff1 value; 13: fff2 value, validated
+	runRxTx(t, shim, []rxtx{
+		{name: "write 13 'ok'", send: "120d006f6b", want: "13"},
+		{name: "write 13 'xy' -- rejected", send: "120d007879", want: "01120d0080"},
+		{name: "write cmd 13 'xy' -- dropped", event: "data 520d007879"},
+		{name: "prepare 11 'ab'", send: "160b0000006162", want: "170b0000006162"},
+		{name: "prepare 13 'xy'", send: "160d0000007879", want: "170d0000007879"},
+		{name: "execute -- rejected at 13", send: "1801", want: "01180d0080"},
+		{name: "prepare 11 'ab'", send: "160b0000006162", want: "170b0000006162"},
+		{name: "prepare 13 'cd'", send: "160d0000006364", want: "170d0000006364"},
+		{name: "prepare 13 'xy' at 2", send: "160d0002007879", want: "170d0002007879"},
+		{name: "execute -- ok", send: "1801", want: "19"},
+	})
+	if want := []string{"ok", "ab", "cdxy"}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written: got %q want %q", written, want)
+	}
+}
+
+func TestLongWrite(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	var written [][]byte
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleWriteFunc(func(r Request, data []byte) byte {
+		written = append(written, data)
+		return StatusSuccess
+	})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	value := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD") // 40 bytes
+	prepare := func(off, n int) rxtx {
+		pdu := fmt.Sprintf("0b00%02x00%x", off, value[off:off+n])
+		return rxtx{name: fmt.Sprintf("prepare 11 offset %d", off), send: "16" + pdu, want: "17" + pdu}
+	}
+
+	// 11: fff1 value. At mtu 23, prepared writes carry up to 18 bytes.
+	runRxTx(t, shim, []rxtx{
+		prepare(18, 18),
+		prepare(0, 18),
+		prepare(36, 4),
+		{name: "execute", send: "1801", want: "19"},
+		prepare(0, 18),
+		{name: "cancel", send: "1800", want: "19"},
+		{name: "execute -- nothing queued", send: "1801", want: "19"},
+		prepare(0, 18),
+		prepare(20, 18),
+		{name: "execute -- gap at 18", send: "1801", want: "01180b0007"},
+	})
+	if len(written) != 1 || !bytes.Equal(written[0], value) {
+		t.Errorf("written: got %q want [%q]", written, value)
+	}
+}
+
+func TestSendIndication(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleIndicateFunc(func(r Request, n Notifier) {})
+	notifyOnly := svc.AddCharacteristic(UUID16(0xfff2))
+	notifyOnly.HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	if err := l2c.sendIndication(notifyOnly, []byte("hello")); err == nil {
+		t.Errorf("sendIndication of a characteristic without indicate: got nil error")
+	}
+	if err := l2c.sendIndication(char, []byte("hello")); err != errNotSubscribed {
+		t.Errorf("sendIndication, unsubscribed: got %v want %v", err, errNotSubscribed)
+	}
+	// Nothing was sent; any stray pdu would be read in place of the response.
+	runRxTx(t, shim, []rxtx{
+		{name: "subscribe, notify -- not indications", send: "120c000100", want: "13"},
+	})
+	if err := l2c.sendIndication(char, []byte("hello")); err != errNotSubscribed {
+		t.Errorf("sendIndication, subscribed to notifications: got %v want %v", err, errNotSubscribed)
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "subscribe, indicate", send: "120c000200", want: "13"},
+		{name: "stale confirmation", event: "data 1e"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.sendIndication(char, []byte("hello")) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "indicate", want: "1d0b00" + fmt.Sprintf("%x", "hello")},
+	})
+	select {
+	case err := <-errc:
+		t.Fatalf("sendIndication returned before confirmation: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	runRxTx(t, shim, []rxtx{{name: "confirm", event: "data 1e"}})
+	if err := <-errc; err != nil {
+		t.Errorf("sendIndication: %v", err)
+	}
+
+	l2c.cnfTimeout = 20 * time.Millisecond
+	go func() { errc <- l2c.sendIndication(char, []byte("0123456789abcdefghijklmnopqrstuvwxyz")) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "indicate -- truncated", want: "1d0b00" + fmt.Sprintf("%x", "0123456789abcdefghij")},
+	})
+	if err := <-errc; err == nil {
+		t.Errorf("sendIndication without confirmation: got nil error")
+	}
+}
+
+func TestServiceChanged(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	l2c.svcchg = newServiceChanged()
+	l2c.setServices("", []*Service{newEchoService()})
+	go l2c.listenAndServe()
+
+	sync := rxtx{name: "sync", send: "021700", want: "031700"}
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{
+			name: "find info [6,9] -- 6: 0x2800, 7: 0x2803, 8: 0x2a05, 9: 0x2902",
+			send: "0406000900",
+			want: "050106000028070003280800052a09000229",
+		},
+		{name: "read declaration 7", send: "0a0700", want: "0b200800052a"},
+		{name: "read 8 -- not permitted", send: "0a0800", want: "010a080002"},
+	})
+
+	// Without a subscription, there is nothing to send;
+	// any stray indication would be read in place of the sync.
+	if err := l2c.indicateServiceChanged(0x000c, 0xffff); err != nil {
+		t.Fatalf("indicateServiceChanged, unsubscribed: %v", err)
+	}
+	runRxTx(t, shim, []rxtx{
+		sync,
+		{name: "subscribe", send: "120900" + "0200", want: "13"},
+	})
+	if h.startedInd != 0 {
+		t.Errorf("startIndicate called for the Service Changed characteristic")
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.indicateServiceChanged(0x000c, 0x0123) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "indicate [000c,0123]", want: "1d0800" + "0c00" + "2301"},
+		{name: "confirm", event: "data 1e"},
+	})
+	if err := <-errc; err != nil {
+		t.Errorf("indicateServiceChanged: %v", err)
+	}
+
+	// Each subscribed central is indicated in turn.
+	runRxTx(t, shim, []rxtx{
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "b: subscribe -- target b", send: "120900" + "0200", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "b: subscribe", want: "13"},
+	})
+	go func() { errc <- l2c.indicateServiceChanged(0x0001, 0xffff) }()
+	runRxTx(t, shim, []rxtx{
+		{name: "-- target a", want: "conn 01:02:03:04:05:06"},
+		{name: "indicate a [0001,ffff]", want: "1d0800" + "0100" + "ffff"},
+		{name: "switch to a", event: "conn 01:02:03:04:05:06"},
+		{name: "a: confirm", event: "data 1e"},
+		{name: "-- target b", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "indicate b [0001,ffff]", want: "1d0800" + "0100" + "ffff"},
+		{name: "switch to b", event: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "b: confirm", event: "data 1e"},
+	})
+	if err := <-errc; err != nil {
+		t.Errorf("indicateServiceChanged to a and b: %v", err)
+	}
+
+	other, _ := newTestL2cap()
+	if err := other.indicateServiceChanged(0x0001, 0xffff); err == nil {
+		t.Errorf("indicateServiceChanged without the characteristic: got nil error")
+	}
+}
+
+func TestReadByTypeTruncation(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	value := bytes.Repeat([]byte("0123456789"), 30) // 300 bytes
+	read := func(v []byte) func(resp ReadResponseWriter, req *ReadRequest) {
+		return func(resp ReadResponseWriter, req *ReadRequest) {
+			if len(v) > req.Cap {
+				resp.Write(v[:req.Cap])
+				return
+			}
+			resp.Write(v)
+		}
+	}
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleReadFunc(read(value[:50]))
+	svc.AddCharacteristic(UUID16(0xfff2)).HandleReadFunc(read(value))
+	svc.AddCharacteristic(UUID16(0xfff3)).HandleReadAsync(AsyncReadHandlerFunc(func(req *ReadRequest) <-chan ReadResult {
+		resc := make(chan ReadResult, 1)
+		resc <- ReadResult{Value: value}
+		return resc
+	}))
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: fff1 value, 50 bytes; 13: fff2 value, 300 bytes; 15: fff3 value, async, 300 bytes.
+	// The length byte covers the handle and the value actually sent.
+	runRxTx(t, shim, []rxtx{
+		{name: "read by type [1,ffff] 0xfff1 at mtu 23", send: "080100fffff1ff", want: fmt.Sprintf("0915%04x%x", 0x0b00, value[:19])},
+		{name: "read by type [1,ffff] 0xfff3 at mtu 23, async", send: "080100fffff3ff", want: fmt.Sprintf("0915%04x%x", 0x0f00, value[:19])},
+		{name: "mtu 0x200", send: "020002", want: "030002"},
+		{name: "read by type [1,ffff] 0xfff1 at mtu 512", send: "080100fffff1ff", want: fmt.Sprintf("0934%04x%x", 0x0b00, value[:50])},
+		{name: "read by type [1,ffff] 0xfff2 at mtu 512", send: "080100fffff2ff", want: fmt.Sprintf("09ff%04x%x", 0x0d00, value[:253])},
+		{name: "read by type [1,ffff] 0xfff3 at mtu 512, async", send: "080100fffff3ff", want: fmt.Sprintf("09ff%04x%x", 0x0f00, value[:253])},
+	})
+}
+
+func TestReadByTypeTruncationStatic(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	desc := "The speed of the fan, in rpm" // 28 bytes
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	fan := svc.AddCharacteristic(UUID16(0xfff1))
+	fan.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	fan.SetDescription(desc)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 12: fff1 user description, a static value longer than mtu-4.
+	// The response is exactly mtu bytes, and its length byte covers
+	// the handle and the truncated value; the rest is read as a blob.
+	runRxTx(t, shim, []rxtx{
+		{name: "read by type [1,ffff] 0x2901 at mtu 23", send: "080100ffff0129", want: fmt.Sprintf("0915%04x%x", 0x0c00, desc[:19])},
+		{name: "read blob 12 at 19", send: "0c0c001300", want: fmt.Sprintf("0d%x", desc[19:])},
+		{name: "mtu 0x20", send: "022000", want: "032000"},
+		{name: "read by type [1,ffff] 0x2901 at mtu 32", send: "080100ffff0129", want: fmt.Sprintf("091e%04x%x", 0x0c00, desc)},
+	})
+}
+
+func TestIndicateLifecycle(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	nc := make(chan Notifier, 2)
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleIndicateFunc(func(r Request, n Notifier) { nc <- n })
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{
+			name: "read by type [9,ffff] 0x2803 -- 10: indicate, 11, 0xfff1",
+			send: "080900ffff0328",
+			want: "09070a00200b00f1ff",
+		},
+		{name: "find info [12,ffff] -- 12: 0x2902", send: "040c00ffff", want: "05010c000229"},
+		{name: "subscribe, indicate", send: "120c000200", want: "13"},
+	})
+	n := <-nc
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := n.Write([]byte("hi"))
+		errc <- err
+	}()
+	runRxTx(t, shim, []rxtx{
+		{name: "indication", want: "1d0b006869"},
+		{name: "confirm", event: "data 1e"},
+	})
+	if err := <-errc; err != nil {
+		t.Errorf("indicate: %v", err)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "unsubscribe", send: "120c000000", want: "13"},
+		{name: "subscribe, notify and indicate", send: "120c000300", want: "13"},
+		{name: "subscribe, notify only", send: "120c000100", want: "13"},
+	})
+	if !n.Done() {
+		t.Errorf("indicator not done after unsubscribing")
+	}
+	if h.startedInd != 2 || h.stoppedInd != 2 {
+		t.Errorf("startIndicate, stopIndicate calls: got %d, %d want 2, 2", h.startedInd, h.stoppedInd)
+	}
+	// startNotify and stopNotify are only called when the
+	// notification state changes.
+	if h.started != 1 || h.stopped != 0 {
+		t.Errorf("startNotify, stopNotify calls: got %d, %d want 1, 0", h.started, h.stopped)
+	}
+}
+
+// TestResponsesFitMTU checks that no response exceeds the MTU,
+// which would panic in send, for a range of MTUs and attribute tables.
+func TestResponsesFitMTU(t *testing.T) {
+	long := bytes.Repeat([]byte{0xaa}, 512)
+	readLong := func(resp ReadResponseWriter, req *ReadRequest) {
+		b := long[req.Offset:]
+		if len(b) > req.Cap {
+			b = b[:req.Cap]
+		}
+		resp.Write(b)
+	}
+	writeAny := func(r Request, data []byte) byte { return StatusSuccess }
+	u128 := MustParseUUID("34DA3AD1-7110-41A1-B1EF-4430F509CDE7")
+	c128 := MustParseUUID("34DA3AD1-7110-41A1-B1EF-4430F509CDE8")
+
+	tables := []struct {
+		name  string
+		svcs  func() []*Service
+		uuids []UUID // service and characteristic uuids to look for
+	}{
+		{name: "no services", svcs: func() []*Service { return nil }},
+		{
+			name: "16-bit uuids",
+			svcs: func() []*Service {
+				svc := &Service{uuid: UUID16(0xaaaa)}
+				for i := 0; i < 20; i++ {
+					char := svc.AddCharacteristic(UUID16(0xfff1))
+					char.HandleReadFunc(readLong)
+					char.HandleWriteFunc(writeAny)
+					char.HandleNotifyFunc(func(r Request, n Notifier) {})
+					char.descs = []*desc{{uuid: UUID16(0x2901), value: long}}
+				}
+				return []*Service{svc}
+			},
+			uuids: []UUID{UUID16(0xaaaa), UUID16(0xfff1)},
+		},
+		{
+			name: "128-bit uuids",
+			svcs: func() []*Service {
+				var svcs []*Service
+				for i := 0; i < 10; i++ {
+					svc := &Service{uuid: u128}
+					if i%2 == 0 {
+						svc.uuid = UUID16(0xaaaa)
+					}
+					for j := 0; j < 3; j++ {
+						char := svc.AddCharacteristic(c128)
+						char.HandleReadFunc(readLong)
+						char.HandleWriteFunc(writeAny)
+					}
+					svcs = append(svcs, svc)
+				}
+				return svcs
+			},
+			uuids: []UUID{UUID16(0xaaaa), u128, c128},
+		},
+	}
+
+	le := func(n uint16) string { return fmt.Sprintf("%02x%02x", byte(n), byte(n>>8)) }
+	step := 1
+	if testing.Short() {
+		step = 13
+	}
+	for _, tt := range tables {
+		l2c, _ := newTestL2cap()
+		if err := l2c.setServices(string(long), tt.svcs()); err != nil {
+			t.Fatalf("%s: setServices: %v", tt.name, err)
+		}
+		last := l2c.handles.hh[len(l2c.handles.hh)-1].n
+
+		reqs := []string{"040100ffff", "080100ffff0328", "080100ffff0129", "100100ffff0028", "100100ffff0128"}
+		for _, u := range tt.uuids {
+			reqs = append(reqs,
+				fmt.Sprintf("060100ffff0028%x", u.reverseBytes()),
+				fmt.Sprintf("080100ffff%x", u.reverseBytes()),
+			)
+		}
+		multi := "0e"
+		for n := uint16(1); n <= last; n++ {
+			reqs = append(reqs, "0a"+le(n), "0c"+le(n)+"0000", "0c"+le(n)+"1600")
+			multi += le(n)
+		}
+		reqs = append(reqs, multi)
+
+		for mtu := 23; mtu <= 517; mtu += step {
+			l2c.conn.mtu = uint16(mtu)
+			rr := reqs
+			for n := uint16(1); n <= last; n++ {
+				rr = append(rr[:len(rr):len(rr)], "16"+le(n)+"0000"+strings.Repeat("bb", mtu-5))
+			}
+			for _, req := range rr {
+				b, err := hex.DecodeString(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				l2c.conn.prepq = nil
+				if resp := l2c.respond(b); len(resp) > mtu {
+					t.Errorf("%s, mtu %d: request %.40s...: response length %d exceeds mtu", tt.name, mtu, req, len(resp))
+				}
+			}
+		}
+	}
+}
+
+func TestAttErrAppendTo(t *testing.T) {
+	e := attErr{opcode: attOpReadReq, handle: 0x0b0a, status: attEcodeInvalidHandle}
+	buf := e.AppendTo(nil)
+	if want := []byte{attOpError, attOpReadReq, 0x0a, 0x0b, attEcodeInvalidHandle}; !bytes.Equal(buf, want) || !bytes.Equal(e.Marshal(), want) {
+		t.Errorf("AppendTo, Marshal: got %x, %x want %x", buf, e.Marshal(), want)
+	}
+	if n := testing.AllocsPerRun(100, func() { buf = e.AppendTo(buf[:0]) }); n != 0 {
+		t.Errorf("AppendTo to a reused buffer: got %v allocs want 0", n)
+	}
+}
+
+func TestErrorResponsesReuseBuffer(t *testing.T) {
+	l2c, _ := newTestL2cap()
+	l2c.setServices("", nil)
+
+	for _, tt := range []struct {
+		name, req, want string
+	}{
+		{name: "read 0x00ff -- invalid handle", req: "0aff00", want: "010aff0001"},
+		{name: "write 0x00ff -- invalid handle", req: "12ff0000", want: "0112ff0001"},
+		{name: "prepare 0x00ff -- invalid handle", req: "16ff00000000", want: "0116ff0001"},
+		{name: "read by group 0x2803 -- unsupported group type", req: "100100ffff0328", want: "0110010010"},
+		{name: "read multiple -- invalid pdu", req: "0e0100", want: "010e000004"},
+		{name: "find by type -- invalid pdu", req: "060100", want: "0106000004"},
+	} {
+		req, _ := hex.DecodeString(tt.req)
+		if got := fmt.Sprintf("%x", l2c.respond(req)); got != tt.want {
+			t.Errorf("%s: got %s want %s", tt.name, got, tt.want)
+		}
+		if n := testing.AllocsPerRun(100, func() { l2c.respond(req) }); n != 0 {
+			t.Errorf("%s: got %v allocs want 0", tt.name, n)
+		}
+	}
+}
+
+func BenchmarkAttErrAppendTo(b *testing.B) {
+	b.ReportAllocs()
+	e := attErr{opcode: attOpReadReq, handle: 0x0b0a, status: attEcodeInvalidHandle}
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = e.AppendTo(buf[:0])
+	}
+}
+
+// BenchmarkReadRequests measures handling a read-heavy workload:
+// service discovery and reads of attribute values.
+func BenchmarkReadRequests(b *testing.B) {
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xfff0)}
+	char := svc.AddCharacteristic(UUID16(0xfff1))
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		resp.Write(bytes.Repeat([]byte{0xaa}, req.Cap))
+	})
+	l2c.setServices("bench", []*Service{svc})
+	l2c.conn.mtu = 185
+	go func() {
+		for range shim.writec {
+		}
+	}()
+	defer close(shim.writec)
+
+	var reqs [][]byte
+	for _, s := range []string{
+		"100100ffff0028", // read by group type, primary services
+		"080100ffff0328", // read by type, characteristics
+		"040100ffff",     // find information
+		"0a0300",         // read, device name
+		"0a0b00",         // read, characteristic value
+		"0c0b000a00",     // read blob, characteristic value
+	} {
+		req, err := hex.DecodeString(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		reqs = append(reqs, req)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, req := range reqs {
+			if err := l2c.handleReq(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReopenTransport(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	h := l2c.handler.(*testL2CapHandler)
+	shim2 := &testL2CShim{readc: make(chan []byte), writec: make(chan []byte)}
+	var attempts int
+	l2c.reopen = func() (Transport, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("shim still restarting")
+		}
+		return shim2, nil
+	}
+	l2c.reconnect = ReconnectPolicy{MaxRetries: 3, Backoff: time.Millisecond}
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleNotifyFunc(func(r Request, n Notifier) {})
+	l2c.setServices("", []*Service{svc})
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.listenAndServe() }()
+
+	discover := rxtx{
+		name: "read by type [9,ffff] 0x2803 -- 10: notify, 11, 0xfff1",
+		send: "080900ffff0328",
+		want: "09070a00100b00f1ff",
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		discover,
+		{name: "subscribe", send: "120c000100", want: "13"},
+	})
+	close(shim.readc) // the shim exits
+
+	// The reopened shim serves the same handles, to a new connection.
+	runRxTx(t, shim2, []rxtx{
+		discover,
+		{name: "read ccc 12 -- not subscribed", send: "0a0c00", want: "0b0000"},
+		{name: "connect again", event: "accept 01:02:03:04:05:06"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	if attempts != 2 {
+		t.Errorf("attempts to reopen: got %d want 2", attempts)
+	}
+	if h.reopened != 1 {
+		t.Errorf("transportReopened calls: got %d want 1", h.reopened)
+	}
+	if want := []string{"01:02:03:04:05:06 " + DisconnectUnknown.String()}; !reflect.DeepEqual(h.disconnects, want) {
+		t.Errorf("disconnects: got %q want %q", h.disconnects, want)
+	}
+	if h.stopped != 1 {
+		t.Errorf("stopNotify calls: got %d want 1", h.stopped)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("listenAndServe returned after reopening: %v", err)
+	default:
+	}
+	l2c.close()
+	if err := <-errc; err != nil {
+		t.Errorf("listenAndServe after close: %v", err)
+	}
+}
+
+func TestReopenTransportGiveUp(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	var attempts int
+	l2c.reopen = func() (Transport, error) {
+		attempts++
+		return nil, errors.New("no shim")
+	}
+	l2c.reconnect = ReconnectPolicy{MaxRetries: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	l2c.setServices("", nil)
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.listenAndServe() }()
+
+	close(shim.readc)
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("listenAndServe after giving up: got nil error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listenAndServe did not give up")
+	}
+	if attempts != 3 {
+		t.Errorf("attempts to reopen: got %d want 3", attempts)
+	}
+}
+
+func TestCloseIdle(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.listenAndServe() }()
+
+	runRxTx(t, shim, []rxtx{{name: "sync", send: "021700", want: "031700"}})
+	// The shim stays idle; nothing more is ever read.
+	l2c.close()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("listenAndServe: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listenAndServe did not return after close")
+	}
+}
+
+func TestListenAndServeContext(t *testing.T) {
+	l2c, shim := newTestL2cap()
+	shim.cmdc = make(chan Command, 1)
+	l2c.setServices("", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- l2c.listenAndServeContext(ctx) }()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("listenAndServeContext: got error %v want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listenAndServeContext did not return after cancellation")
+	}
+	if cmd := <-shim.cmdc; cmd != CommandDisconnect {
+		t.Errorf("got command %v want %v", cmd, CommandDisconnect)
 	}
 }
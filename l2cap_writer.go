@@ -1,11 +1,14 @@
 package gatt
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"sync"
+)
 
 // l2capWriter helps create l2cap responses.
 // It is not meant to be used with large writes.
 // TODO: benchmark the number of allocs here.
-// Reduce by letting WriteByte, WriteUint16, etc.
+// Reduce by letting WriteUint8, WriteUint16, etc.
 // extend b/chunk and write into it directly.
 type l2capWriter struct {
 	mtu     int
@@ -14,8 +17,29 @@ type l2capWriter struct {
 	chunked bool
 }
 
+// writerPool holds released l2capWriters, for reuse by newL2capWriter.
+var writerPool = sync.Pool{New: func() interface{} { return new(l2capWriter) }}
+
+// newL2capWriter returns an empty writer for a pdu of at most mtu
+// bytes, reusing a released writer if possible.
 func newL2capWriter(mtu uint16) *l2capWriter {
-	return &l2capWriter{mtu: int(mtu), b: make([]byte, 0, mtu)}
+	w := writerPool.Get().(*l2capWriter)
+	w.mtu = int(mtu)
+	if cap(w.b) < w.mtu {
+		w.b = make([]byte, 0, mtu)
+	}
+	return w
+}
+
+// Release resets w and returns it for reuse by newL2capWriter.
+// Neither w nor any slice returned by its Bytes may be used
+// afterward. Writers that are never released are simply
+// garbage collected.
+func (w *l2capWriter) Release() {
+	w.b = w.b[:0]
+	w.chunk = w.chunk[:0]
+	w.chunked = false
+	writerPool.Put(w)
 }
 
 // Chunk starts writing a new chunk. This chunk
@@ -65,10 +89,10 @@ func (w *l2capWriter) CommitFit() {
 	w.chunked = false
 }
 
-// WriteByte writes b.
+// WriteUint8 writes b.
 // It reports whether the write succeeded,
 // using the criteria of WriteFit.
-func (w *l2capWriter) WriteByte(b byte) bool {
+func (w *l2capWriter) WriteUint8(b byte) bool {
 	return w.WriteFit([]byte{b})
 }
 
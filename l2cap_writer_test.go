@@ -26,19 +26,19 @@ func TestL2capWriterChunk(t *testing.T) {
 		w := newL2capWriter(tt.mtu)
 		var want []byte
 		for i := 0; i < tt.head; i++ {
-			w.WriteByte(byte(i))
+			w.WriteUint8(byte(i))
 			want = append(want, byte(i))
 		}
 		w.Chunk()
 		for i := 0; i < tt.chunk; i++ {
-			w.WriteByte(byte(i))
+			w.WriteUint8(byte(i))
 			if tt.ok {
 				want = append(want, byte(i))
 			}
 		}
 		ok := w.Commit()
 		if ok != tt.ok {
-			t.Errorf("Chunk(%d %d %d) commit: got %b want %b", tt.mtu, tt.head, tt.chunk, ok, tt.ok)
+			t.Errorf("Chunk(%d %d %d) commit: got %t want %t", tt.mtu, tt.head, tt.chunk, ok, tt.ok)
 			continue
 		}
 		if !bytes.Equal(want, w.Bytes()) {
@@ -71,6 +71,31 @@ func TestL2capWriterPanicDoubleCommit(t *testing.T) {
 	t.Errorf("l2capWriter should panic on double-commit")
 }
 
+func TestL2capWriterRelease(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		w := newL2capWriter(8)
+		w.WriteFit([]byte{1, 2, 3})
+		w.Chunk()
+		w.WriteFit([]byte{4, 5, 6})
+		w.Release() // mid-chunk, as after an error response
+
+		w = newL2capWriter(3)
+		if b := w.Bytes(); len(b) != 0 {
+			t.Fatalf("reused writer: got %x want no bytes", b)
+		}
+		w.Chunk()
+		w.WriteFit([]byte{7})
+		w.CommitFit()
+		if ok := w.WriteFit([]byte{8, 9, 10}); ok {
+			t.Errorf("reused writer with mtu 3: write of 3 bytes after 1 succeeded")
+		}
+		if want := []byte{7, 8, 9}; !bytes.Equal(w.Bytes(), want) {
+			t.Errorf("reused writer: got %x want %x", w.Bytes(), want)
+		}
+		w.Release()
+	}
+}
+
 func BenchmarkWriteUint16(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		w := newL2capWriter(17)
@@ -0,0 +1,17 @@
+package gatt
+
+// A Logger receives diagnostic messages from a Server; see Server.Logger.
+// Debugf receives detailed traces, such as each line exchanged with the
+// shims, including every ATT PDU, which help debug interoperability
+// problems. Infof receives occasional informational messages.
+// Messages do not end in a newline.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+// nopLogger is a Logger that discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
@@ -1,9 +1,12 @@
 package gatt
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -45,6 +48,108 @@ type Server struct {
 	// must be no longer than MaxAdvertisingPacketLength.
 	ScanResponsePacket []byte
 
+	// MaxMTU, if at least 23, caps the MTU used for data sent by the
+	// server: responses and notifications. During an MTU exchange, the
+	// server always echoes the MTU requested by the central, which keeps
+	// some misbehaving centrals happy; MaxMTU does not change that.
+	// Note that the central may therefore send requests as large as the
+	// MTU it requested, even if that is larger than MaxMTU.
+	// MaxMTU must be set, if at all, before starting the server.
+	MaxMTU int
+
+	// UnhandledRead and UnhandledWrite are optional catch-all handlers
+	// for reads and writes of characteristics that support them but have
+	// no handler of their own, as after HandleRead(nil). The Request's
+	// Characteristic identifies the characteristic. If UnhandledRead or
+	// UnhandledWrite is nil, such requests fail with StatusReadNotPermitted
+	// or StatusWriteNotPermitted respectively.
+	UnhandledRead  ReadHandler
+	UnhandledWrite WriteHandler
+
+	// ValidatePreparedWrites is an optional callback function that will
+	// be called when a central executes a queue of prepared (reliable)
+	// writes, before any of them is applied. writes contains one complete
+	// value per attribute, reassembled from the queued fragments.
+	// If ValidatePreparedWrites returns anything other than StatusSuccess,
+	// none of the writes is applied and the status is sent to the central.
+	//
+	// Once validated, the writes are applied one at a time via the usual
+	// write handlers (and CCC handling). Side-effects of a write handler
+	// cannot be rolled back, so ValidatePreparedWrites is the place to
+	// ensure that the set is applied all-or-nothing.
+	ValidatePreparedWrites func(c Conn, writes []PreparedWrite) (status byte)
+
+	// PrepareProgress is an optional callback function that will be
+	// called each time a central queues a prepared write fragment for
+	// a characteristic, e.g. to show the progress of a long upload.
+	// bytesQueued and fragments are the totals queued for char so far;
+	// the value is written when the central executes the queue.
+	PrepareProgress func(c Conn, char *Characteristic, bytesQueued, fragments int)
+
+	// AuthorizeRead and AuthorizeWrite are optional callback functions
+	// that will be called before each read or write of a characteristic
+	// value, respectively, to implement application-level access control
+	// beyond the link's security. If they return false, the request fails
+	// with an insufficient authorization error. If AuthorizeRead or
+	// AuthorizeWrite is nil, all reads or writes are authorized.
+	AuthorizeRead  func(c Conn, char *Characteristic) bool
+	AuthorizeWrite func(c Conn, char *Characteristic) bool
+
+	// StrictServices makes starting the server fail if any service has
+	// several characteristics with the same UUID. Such duplicates are
+	// legal, and are served correctly, but are often a mistake.
+	// StrictServices must be set, if at all, before starting the server.
+	StrictServices bool
+
+	// ServiceChanged makes the Generic Attribute service include a
+	// Service Changed characteristic, which lets the server prompt
+	// centrals to rediscover services; see IndicateServiceChanged.
+	// It moves the handles of all other services.
+	// ServiceChanged must be set, if at all, before starting the server.
+	ServiceChanged bool
+
+	// ServerFeatures is the value of the Generic Attribute service's
+	// Server Supported Features characteristic (0x2B3A), a bit field
+	// of the GATT features that the server supports. Bit 0 announces
+	// the enhanced ATT bearer (EATT), which only transports that carry
+	// EATT may set; the default, 0, announces no optional features.
+	// ServerFeatures must be set, if at all, before starting the server.
+	ServerFeatures byte
+
+	// SkipMalformedEvents makes the server log and skip lines from the
+	// shim that it cannot parse, such as a malformed address or number,
+	// rather than closing with an error. Failures to read from the shim
+	// are always fatal. SkipMalformedEvents must be set, if at all,
+	// before starting the server.
+	SkipMalformedEvents bool
+
+	// MalformedEvent is an optional callback function that will be
+	// called, instead of logging, with each line skipped because of
+	// SkipMalformedEvents and the error parsing it. MalformedEvent
+	// must be set, if at all, before starting the server.
+	MalformedEvent func(line string, err error)
+
+	// Reconnect, if non-nil, makes the server reopen the l2cap transport,
+	// and resume serving and advertising, if reading from it fails, as
+	// when its shim exits unexpectedly. Centrals connected at the time
+	// are disconnected; the services are kept. Without Reconnect, such
+	// failures close the server.
+	// Reconnect must be set, if at all, before starting the server.
+	Reconnect *ReconnectPolicy
+
+	// Logger, if non-nil, receives diagnostic messages from the server,
+	// such as a trace of the ATT PDUs exchanged with centrals. By default
+	// they are discarded. Logger must be set, if at all, before starting
+	// the server.
+	Logger Logger
+
+	// OpenTransport is an optional function that opens the transport
+	// named name, "hci-ble" or "l2cap-ble", for the hci device dev, which
+	// is "" or a device number. See Transport for the contract that the
+	// transports must meet. If OpenTransport is nil, NewShimTransport(name, dev)
+	// is used. OpenTransport must be set, if at all, before starting the server.
+	OpenTransport func(name, dev string) (Transport, error)
+
 	// TODO: Add a way to disable connections? The iBeacon advertising
 	// packet will advertise that the device is not connectable. Do
 	// we also need to enforce that?
@@ -62,6 +167,31 @@ type Server struct {
 	// when an RSSI measurement has been received for a connection.
 	ReceiveRSSI func(c Conn, rssi int)
 
+	// MTUChange is an optional callback function that will be called
+	// when the MTU of a connection changes.
+	MTUChange func(c Conn, mtu int)
+
+	// PHYUpdate is an optional callback function that will be called
+	// when the PHYs used by a connection change, e.g. after Conn.SetPHY.
+	PHYUpdate func(c Conn, tx, rx PHY)
+
+	// DataLengthChange is an optional callback function that will be
+	// called when the link layer data length of a connection changes,
+	// as reported by shims that support the data length extension;
+	// see Conn.DataLength.
+	DataLengthChange func(c Conn, tx, rx int)
+
+	// SecurityChange is an optional callback function that will be
+	// called when the security level of a connection changes, e.g.
+	// after pairing completes, so that the application can re-evaluate
+	// which characteristics it is willing to serve.
+	SecurityChange func(c Conn, level SecurityLevel)
+
+	// OwnAddressChange is an optional callback function that will be
+	// called when the server's own address changes, as when a resolvable
+	// private address rotates. Not all shims report such changes.
+	OwnAddressChange func(addr BDAddr)
+
 	// Closed is an optional callback function that will be called
 	// when the server is closed. err will be any associated error.
 	// If the server was closed by calling Close, err may be nil.
@@ -78,17 +208,23 @@ type Server struct {
 
 	addr BDAddr
 
-	// For now, there is one active conn per server; stash it here.
-	// The conn part of the API is for forward-compatibility.
-	// When Bluetooth 4.1 hits, there may be multiple active
-	// connections per server, at which point, we'll need to
-	// thread the connection through at each event. We won't
-	// be able to do that without l2cap/BlueZ support, though.
-	connmu sync.RWMutex
-	conn   *conn
+	// Several centrals may be connected at once, if the l2cap shim
+	// supports it. conn is the one that the shim's events currently
+	// concern, to which the callbacks for those events refer.
+	connmu   sync.RWMutex
+	conn     *conn
+	conns    map[string]*conn // connected centrals, by address
+	shutdown bool             // don't advertise again; see Shutdown
 
 	services []*Service
 
+	// notifiers and indicators are the running notifiers and
+	// indicators, by characteristic. The services may be shared
+	// with other servers, each of which has its own. They are
+	// only used on the l2cap eventloop.
+	notifiers  map[*Characteristic]*notifier
+	indicators map[*Characteristic]*notifier
+
 	quitonce sync.Once
 	quit     chan struct{}
 	err      error
@@ -187,7 +323,12 @@ func cleanHCIDevice(hci string) string {
 func (s *Server) start() error {
 	hciDevice := cleanHCIDevice(s.HCI)
 
-	hciShim, err := newCShim("hci-ble", hciDevice)
+	open := s.OpenTransport
+	if open == nil {
+		open = func(name, dev string) (Transport, error) { return newShim(name, dev) }
+	}
+
+	hciShim, err := open("hci-ble", hciDevice)
 	if err != nil {
 		return err
 	}
@@ -195,6 +336,9 @@ func (s *Server) start() error {
 	s.quit = make(chan struct{})
 
 	s.hci = newHCI(hciShim)
+	if s.Logger != nil {
+		s.hci.logger = s.Logger
+	}
 	event, err := s.hci.event()
 	if err != nil {
 		return err
@@ -215,13 +359,13 @@ func (s *Server) start() error {
 			// hci will get killed, which'll cause an error to be returned here.
 			event, err := s.hci.event()
 			if err != nil {
-				break
+				s.close(err)
+				return
 			}
 			if s.StateChange != nil {
 				s.StateChange(event)
 			}
 		}
-		s.close(err)
 	}()
 
 	if s.Closed != nil {
@@ -231,16 +375,46 @@ func (s *Server) start() error {
 		}()
 	}
 
-	l2capShim, err := newCShim("l2cap-ble", hciDevice)
+	l2capShim, err := open("l2cap-ble", hciDevice)
 	if err != nil {
 		s.close(err)
 		return err
 	}
 
 	s.l2cap = newL2cap(l2capShim, s)
+	if s.MaxMTU >= 23 && s.MaxMTU <= 0xffff {
+		s.l2cap.maxMTU = uint16(s.MaxMTU)
+	}
+	s.l2cap.features = s.ServerFeatures
+	s.l2cap.strict = s.StrictServices
+	if s.ServiceChanged {
+		s.l2cap.svcchg = newServiceChanged()
+	}
+	s.l2cap.skipBad = s.SkipMalformedEvents
+	s.l2cap.badEvent = s.MalformedEvent
+	if s.Logger != nil {
+		s.l2cap.logger = s.Logger
+	}
+	if s.Reconnect != nil {
+		s.l2cap.reopen = func() (Transport, error) { return open("l2cap-ble", hciDevice) }
+		s.l2cap.reconnect = *s.Reconnect
+	}
 	return nil
 }
 
+// A ReconnectPolicy governs reopening a failed transport;
+// see Server.Reconnect.
+type ReconnectPolicy struct {
+	// MaxRetries is the number of attempts to reopen the transport
+	// after each failure, before giving up. It is at least 1.
+	MaxRetries int
+
+	// Backoff is the wait before the first attempt. It doubles
+	// after each failed attempt, up to MaxBackoff, if positive.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
 // Close stops a Server.
 func (s *Server) Close() error {
 	if !serving() {
@@ -258,6 +432,321 @@ func (s *Server) Close() error {
 	return err
 }
 
+// Shutdown gracefully stops a Server. It stops the server from
+// advertising again once the central disconnects, waits for pending
+// notifications and indications to be sent, and, if goodbye is
+// non-nil, sends goodbye as an indication, e.g. a "going offline"
+// status, to each central that has subscribed to indications of its
+// characteristic, and waits for their confirmations.
+// Then it disconnects the central, if any, and closes the server.
+//
+// If ctx is done before the server has finished sending, Shutdown
+// disconnects and closes the server at once, and returns ctx.Err().
+// Shutdown must not be called from within a handler.
+func (s *Server) Shutdown(ctx context.Context, goodbye *IndicateItem) error {
+	if !serving() {
+		return errors.New("not serving")
+	}
+	s.connmu.Lock()
+	s.shutdown = true
+	connected := s.conn != nil
+	s.connmu.Unlock()
+
+	err := s.l2cap.flush(ctx)
+	if err == nil && connected && goodbye != nil {
+		errc := make(chan error, 1)
+		go func() {
+			errc <- s.l2cap.sendIndication(goodbye.Characteristic, goodbye.Value)
+		}()
+		select {
+		case err = <-errc:
+			if err == errNotSubscribed {
+				// No one to say goodbye to.
+				err = nil
+			} else if err == nil && goodbye.Confirmed != nil {
+				goodbye.Confirmed()
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if connected {
+		if derr := s.l2cap.disconnect(); err == nil {
+			err = derr
+		}
+	}
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// StartRSSIMonitor requests an RSSI measurement for the connected
+// central every interval. Measurements are delivered via ReceiveRSSI.
+// The monitor runs until StopRSSIMonitor is called, the central
+// disconnects, or the server is closed. Calling StartRSSIMonitor
+// again replaces the running monitor.
+func (s *Server) StartRSSIMonitor(interval time.Duration) error {
+	if !serving() {
+		return errors.New("not serving")
+	}
+	if interval <= 0 {
+		return errors.New("non-positive RSSI monitor interval")
+	}
+	s.l2cap.startRSSIMonitor(interval)
+	return nil
+}
+
+// StopRSSIMonitor stops the RSSI monitor started by StartRSSIMonitor.
+func (s *Server) StopRSSIMonitor() {
+	if s.l2cap != nil {
+		s.l2cap.stopRSSIMonitor()
+	}
+}
+
+// Pause makes the server reject all ATT requests, without disconnecting,
+// except those for the services in allow, which must have been added
+// to the server. This is useful, e.g., to block other access during a
+// firmware update served by allow. Rejected requests receive the
+// application error 0x80 (device busy). MTU exchanges and discovery of
+// services and characteristics remain available while paused.
+// Pause may be called again to change the allowed services.
+func (s *Server) Pause(allow ...*Service) error {
+	if !serving() || s.l2cap == nil || s.l2cap.handles == nil {
+		return errors.New("not serving")
+	}
+	allowed := make([][2]uint16, len(allow))
+	for i, svc := range allow {
+		start, end, ok := s.l2cap.handles.serviceRange(svc)
+		if !ok {
+			return fmt.Errorf("service %v is not being served", svc.UUID())
+		}
+		allowed[i] = [2]uint16{start, end}
+	}
+	s.l2cap.pause(allowed)
+	return nil
+}
+
+// Resume ends a pause started by Pause.
+func (s *Server) Resume() {
+	if s.l2cap != nil {
+		s.l2cap.resume()
+	}
+}
+
+// NotifyConn sends a notification of data for c to the connected
+// central with address addr, if it has subscribed to notifications
+// of c; otherwise, it sends nothing. data is truncated as needed to
+// fit in a single notification at that connection's MTU. NotifyConn
+// returns an error if addr is not connected.
+func (s *Server) NotifyConn(addr net.HardwareAddr, c *Characteristic, data []byte) error {
+	if !serving() {
+		return errors.New("not serving")
+	}
+	return s.l2cap.notifyConn(addr, c, data)
+}
+
+// Centrals returns the addresses of the connected centrals, sorted.
+// Centrals may be called concurrently with handlers.
+func (s *Server) Centrals() []net.HardwareAddr {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	addrs := make([]net.HardwareAddr, 0, len(s.conns))
+	for _, c := range s.conns {
+		addrs = append(addrs, c.remoteAddr.HardwareAddr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return bytes.Compare(addrs[i], addrs[j]) < 0 })
+	return addrs
+}
+
+// LastActivity returns the time at which the connected central with
+// address addr last sent an ATT PDU, or at which it connected, if it
+// has sent none. This is useful e.g. for implementing idle policies.
+// LastActivity returns the zero time if addr is not connected.
+func (s *Server) LastActivity(addr net.HardwareAddr) time.Time {
+	if !serving() {
+		return time.Time{}
+	}
+	return s.l2cap.lastActivity(addr)
+}
+
+// DisconnectCentral disconnects the connected central with address
+// addr, such as a misbehaving one, leaving any other centrals
+// connected. The Disconnect callback is called once the link is
+// down. DisconnectCentral returns an error if addr is not connected.
+func (s *Server) DisconnectCentral(addr net.HardwareAddr) error {
+	if !serving() {
+		return errors.New("not serving")
+	}
+	return s.l2cap.disconnectConn(addr)
+}
+
+// ResetConnection restores the state of the connection with the
+// central with address addr to that of a new connection, without
+// disconnecting: the MTU reverts to 23, subscriptions to notifications
+// are cancelled, queued prepared writes are discarded, and the security
+// level reverts to low. This is useful to simulate a fresh ATT bearer,
+// e.g. in testing, or to recover from a desynchronized state.
+// ResetConnection must not be called from within a handler.
+func (s *Server) ResetConnection(addr net.HardwareAddr) error {
+	if !serving() {
+		return errors.New("not serving")
+	}
+	return s.l2cap.resetConn(addr)
+}
+
+// A SubscriptionInfo describes a central's subscription
+// to a characteristic; see Subscriptions.
+type SubscriptionInfo struct {
+	Characteristic *Characteristic
+	Notify         bool // the central has enabled notifications
+	Indicate       bool // the central has enabled indications
+}
+
+// Subscriptions returns the characteristics to which the connected
+// central with address addr has subscribed, in handle order, as set
+// by its writes to their client characteristic configuration
+// descriptors. This is useful e.g. to diagnose missing notifications.
+// Subscriptions returns nil if addr is not connected.
+// Subscriptions must not be called from within a handler.
+func (s *Server) Subscriptions(addr net.HardwareAddr) []SubscriptionInfo {
+	if !serving() {
+		return nil
+	}
+	return s.l2cap.subscriptions(addr)
+}
+
+// MTU returns the MTU of the current connection, which is used to
+// size responses and notifications: notifications carry at most
+// MTU-3 bytes of data. The MTU is 23 until the central exchanges
+// MTUs, and may change at any time during the connection, so use
+// MTUChange to track it. MTU returns 23 if the server has not started.
+func (s *Server) MTU() int {
+	if s.l2cap == nil {
+		return 23
+	}
+	return int(s.l2cap.currentMTU())
+}
+
+// A HandleInfo describes an attribute in the server's handle table;
+// see DumpHandles.
+type HandleInfo struct {
+	Handle uint16
+	// Type is "service", "includedService", "include" (a declaration
+	// of an included service), "characteristic" (a declaration),
+	// "characteristicValue", or "descriptor".
+	Type string
+	// UUID is the service, characteristic or descriptor UUID;
+	// for includes, that of the included service.
+	UUID UUID
+	// Properties are the characteristic properties, as in the
+	// declaration, for characteristics, and the permitted accesses
+	// for descriptors and includes. They are 0 for other attributes.
+	Properties byte
+}
+
+// DumpHandles returns the server's handle table, in handle order,
+// including the Generic Access and Generic Attribute services.
+// It is meant for debugging service definitions. Before the server
+// has started, DumpHandles returns the table that it would serve.
+func (s *Server) DumpHandles() []HandleInfo {
+	return s.handleTable().info()
+}
+
+// Handle returns the attribute handle of c's value, as seen by
+// centrals (e.g. in a BLE explorer app), or 0 if c is not served
+// by s. Before the server has started, Handle returns the handle
+// that c would have.
+func (s *Server) Handle(c *Characteristic) uint16 {
+	n, _ := s.handleTable().valueHandle(c)
+	return n
+}
+
+// HandleRange returns the range of attribute handles used by svc,
+// from its declaration through its last attribute, or 0, 0 if svc
+// is not served by s. Before the server has started, HandleRange
+// returns the range that svc would have.
+func (s *Server) HandleRange(svc *Service) (start, end uint16) {
+	start, end, _ = s.handleTable().serviceRange(svc)
+	return start, end
+}
+
+// handleTable returns the handle table being served, or, before
+// the server has started, a table generated from its services.
+// Handles are never recorded in the services themselves, which
+// may be shared with other servers.
+func (s *Server) handleTable() *handleRange {
+	if s.l2cap != nil && s.l2cap.handles != nil {
+		return s.l2cap.handles
+	}
+	var svcChanged *Characteristic
+	if s.ServiceChanged {
+		svcChanged = newServiceChanged()
+	}
+	return generateHandles(s.Name, s.ServerFeatures, svcChanged, s.services, 1)
+}
+
+// OwnAddr returns the server's current own address. If the server
+// uses a resolvable private address, this changes as it rotates;
+// see OwnAddressChange. The LocalAddr of a Conn is the own address
+// at the time the connection was made.
+func (s *Server) OwnAddr() BDAddr {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	return s.addr
+}
+
+// An IndicateItem is a single indication in a sequence;
+// see IndicateSequence.
+type IndicateItem struct {
+	Characteristic *Characteristic
+	Value          []byte
+
+	// Confirmed is an optional callback function that will
+	// be called when the central confirms this indication.
+	Confirmed func()
+}
+
+// An IndicateSequenceError reports the failure of an IndicateSequence.
+type IndicateSequenceError struct {
+	Confirmed int   // the number of indications confirmed before the failure
+	Err       error // the reason that the next indication failed
+}
+
+func (e *IndicateSequenceError) Error() string {
+	return fmt.Sprintf("indication %d failed: %v", e.Confirmed, e.Err)
+}
+
+// IndicateSequence sends items as indications, in order, to the
+// centrals that have subscribed to indications of their
+// characteristics. Each indication must be confirmed before the next
+// is sent. If a confirmation does not arrive within the ATT transaction
+// timeout of 30 seconds, or an indication cannot be sent, as when no
+// central has subscribed, IndicateSequence stops and returns an
+// *IndicateSequenceError, reporting how many items were confirmed.
+// Values are truncated as needed to fit in each connection's MTU.
+// IndicateSequence must not be called from within a handler.
+func (s *Server) IndicateSequence(items []IndicateItem) error {
+	if !serving() {
+		return errors.New("not serving")
+	}
+	return s.l2cap.indicateSequence(items)
+}
+
+// IndicateServiceChanged indicates to the connected centrals that the
+// attributes with handles in the range [start, end] have changed, so
+// that they rediscover them. Only centrals that have subscribed to the
+// Service Changed characteristic, which requires ServiceChanged, are
+// indicated; if none has, IndicateServiceChanged does nothing. Like
+// IndicateSequence, it waits for each central to confirm the
+// indication, and must not be called from within a handler.
+func (s *Server) IndicateServiceChanged(start, end uint16) error {
+	if !serving() {
+		return errors.New("not serving")
+	}
+	return s.l2cap.indicateServiceChanged(start, end)
+}
+
 // A BDAddr (Bluetooth Device Address) is a
 // hardware-addressed-based net.Addr.
 type BDAddr struct {
@@ -288,6 +777,109 @@ type Conn interface {
 
 	// MTU returns the current connection mtu.
 	MTU() int
+
+	// DataLength returns the maximum payload sizes of link layer
+	// packets sent and received on the connection. They are 27 bytes,
+	// unless the data length extension has raised them, up to 251 bytes.
+	// The larger they are compared to the MTU, the less ATT packets
+	// need to be fragmented, which improves throughput.
+	DataLength() (tx, rx int)
+
+	// SetPHY sets the preferred transmit and receive PHYs for the
+	// connection. Each of tx and rx may combine several PHYs, from which
+	// the controller chooses; the PHYs actually used are reported via
+	// Server.PHYUpdate. SetPHY requires a BLE 5 adapter; it returns
+	// an error if the adapter does not support the requested PHYs.
+	SetPHY(tx, rx PHY) error
+
+	// DisconnectReason returns the reason for which the connection
+	// ended, as reported by the shim, e.g. in the Server's Disconnect
+	// callback. It is DisconnectUnknown while the connection is up,
+	// or if the shim did not report a reason.
+	DisconnectReason() DisconnectReason
+}
+
+// A DisconnectReason is the HCI error code
+// with which a connection was terminated.
+type DisconnectReason byte
+
+// Common disconnect reasons.
+const (
+	DisconnectUnknown            DisconnectReason = 0x00 // no reason was reported
+	DisconnectTimeout            DisconnectReason = 0x08 // the link supervision timeout expired
+	DisconnectRemoteUser         DisconnectReason = 0x13 // the central terminated the connection
+	DisconnectRemoteLowResources DisconnectReason = 0x14 // the central ran low on resources
+	DisconnectRemotePowerOff     DisconnectReason = 0x15 // the central is powering off
+	DisconnectLocalHost          DisconnectReason = 0x16 // the server terminated the connection
+)
+
+var disconnectReasonNames = map[DisconnectReason]string{
+	DisconnectUnknown:            "unknown",
+	DisconnectTimeout:            "connection timeout",
+	DisconnectRemoteUser:         "remote user terminated connection",
+	DisconnectRemoteLowResources: "remote device terminated connection due to low resources",
+	DisconnectRemotePowerOff:     "remote device terminated connection due to power off",
+	DisconnectLocalHost:          "connection terminated by local host",
+}
+
+func (r DisconnectReason) String() string {
+	if name, ok := disconnectReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("DisconnectReason(%#02x)", byte(r))
+}
+
+// A PHY is a set of BLE physical layers.
+type PHY uint8
+
+// Supported PHYs. PHY2M and PHYCoded require BLE 5.
+const (
+	PHY1M    PHY = 1 << 0 // 1 Msym/s, supported by all adapters
+	PHY2M    PHY = 1 << 1 // 2 Msym/s, for higher throughput
+	PHYCoded PHY = 1 << 2 // coded, for longer range
+)
+
+func (p PHY) String() string {
+	var names []string
+	for _, phy := range []struct {
+		p    PHY
+		name string
+	}{{PHY1M, "1M"}, {PHY2M, "2M"}, {PHYCoded, "Coded"}} {
+		if p&phy.p != 0 {
+			names = append(names, phy.name)
+			p &^= phy.p
+		}
+	}
+	if p != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint8(p)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// A SecurityLevel is the security level of a connection,
+// as reported by the shim.
+type SecurityLevel int
+
+// Security levels.
+const (
+	SecurityLow    SecurityLevel = iota // no encryption
+	SecurityMedium                      // encryption, without authentication
+	SecurityHigh                        // encryption and authentication
+)
+
+func (l SecurityLevel) String() string {
+	switch l {
+	case SecurityLow:
+		return "low"
+	case SecurityMedium:
+		return "medium"
+	case SecurityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("SecurityLevel(%d)", int(l))
 }
 
 func (s *Server) close(err error) {
@@ -301,8 +893,23 @@ func (s *Server) close(err error) {
 
 func (s *Server) receivedBDAddr(bdaddr string) {
 	hwaddr, err := net.ParseMAC(bdaddr)
-	if err != nil {
+	if err == nil {
+		s.connmu.Lock()
 		s.addr = BDAddr{hwaddr}
+		s.connmu.Unlock()
+	}
+}
+
+func (s *Server) ownAddressChanged(addr string) {
+	hwaddr, err := net.ParseMAC(addr)
+	if err != nil {
+		return
+	}
+	s.connmu.Lock()
+	s.addr = BDAddr{hwaddr}
+	s.connmu.Unlock()
+	if s.OwnAddressChange != nil {
+		s.OwnAddressChange(BDAddr{hwaddr})
 	}
 }
 
@@ -318,33 +925,142 @@ func (s *Server) request(c *Characteristic) Request {
 	return r
 }
 
-func (s *Server) readChar(c *Characteristic, maxlen int, offset int) (data []byte, status byte) {
-	req := &ReadRequest{Request: s.request(c), Cap: maxlen, Offset: offset}
+// requestFrom returns a Request for c made by the central at hw.
+// Its Conn is nil if that central is no longer connected.
+func (s *Server) requestFrom(c *Characteristic, hw net.HardwareAddr) Request {
+	r := Request{
+		Server:         s,
+		Service:        c.service,
+		Characteristic: c,
+	}
+	if c := s.connFor(hw); c != nil {
+		r.Conn = c
+	}
+	return r
+}
+
+// connFor returns the connection with the central at hw,
+// or nil if it is not connected.
+func (s *Server) connFor(hw net.HardwareAddr) *conn {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	return s.conns[hw.String()]
+}
+
+func (s *Server) readChar(c *Characteristic, hw net.HardwareAddr, maxlen int, offset int) (data []byte, status byte) {
+	req := &ReadRequest{Request: s.requestFrom(c, hw), Cap: maxlen, Offset: offset}
 	resp := newReadResponseWriter(maxlen)
-	c.rhandler.ServeRead(resp, req)
+	c.serveRead(s.UnhandledRead, resp, req)
 	return resp.bytes(), resp.status
 }
 
-func (s *Server) writeChar(c *Characteristic, data []byte, noResponse bool) (status byte) {
-	return c.whandler.ServeWrite(s.request(c), data)
+func (s *Server) readCharAsync(c *Characteristic, hw net.HardwareAddr, maxlen int, offset int) <-chan ReadResult {
+	req := &ReadRequest{Request: s.requestFrom(c, hw), Cap: maxlen, Offset: offset}
+	return c.arhandler.ServeReadAsync(req)
+}
+
+func (s *Server) writeChar(c *Characteristic, hw net.HardwareAddr, data []byte, noResponse bool) (status byte) {
+	return c.serveWrite(s.UnhandledWrite, s.requestFrom(c, hw), data)
+}
+
+func (s *Server) writeDesc(d *desc, hw net.HardwareAddr, data []byte) (status byte) {
+	return d.whandler.ServeWrite(s.requestFrom(d.char, hw), data)
+}
+
+func (s *Server) validateWrite(c *Characteristic, data []byte) (status byte) {
+	if c.validate == nil {
+		return StatusSuccess
+	}
+	return c.validate(data)
+}
+
+func (s *Server) validateWrites(writes []PreparedWrite) (status byte) {
+	if s.ValidatePreparedWrites == nil {
+		return StatusSuccess
+	}
+	s.connmu.RLock()
+	c := s.conn
+	s.connmu.RUnlock()
+	return s.ValidatePreparedWrites(c, writes)
+}
+
+func (s *Server) authorizeRead(char *Characteristic, hw net.HardwareAddr) bool {
+	return s.authorize(s.AuthorizeRead, char, hw)
+}
+
+func (s *Server) authorizeWrite(char *Characteristic, hw net.HardwareAddr) bool {
+	return s.authorize(s.AuthorizeWrite, char, hw)
+}
+
+// authorize reports whether the optional callback f authorizes
+// access to char by the central at hw. Centrals that are not
+// connected are not authorized.
+func (s *Server) authorize(f func(c Conn, char *Characteristic) bool, char *Characteristic, hw net.HardwareAddr) bool {
+	if f == nil {
+		return true
+	}
+	c := s.connFor(hw)
+	if c == nil {
+		return false
+	}
+	return f(c, char)
+}
+
+func (s *Server) prepareProgress(char *Characteristic, bytesQueued, fragments int) {
+	if s.PrepareProgress == nil {
+		return
+	}
+	s.connmu.RLock()
+	c := s.conn
+	s.connmu.RUnlock()
+	s.PrepareProgress(c, char, bytesQueued, fragments)
 }
 
 func (s *Server) startNotify(c *Characteristic, maxlen int) {
-	if c.notifier != nil {
+	if s.notifiers[c] != nil {
 		return
 	}
-	c.notifier = newNotifier(s.l2cap, c, maxlen)
-	c.nhandler.ServeNotify(s.request(c), c.notifier)
+	if s.notifiers == nil {
+		s.notifiers = make(map[*Characteristic]*notifier)
+	}
+	n := newNotifier(s.l2cap, c, maxlen)
+	s.notifiers[c] = n
+	c.serveNotify(s.request(c), n)
 }
 
 func (s *Server) stopNotify(c *Characteristic) {
-	c.notifier.stop()
-	c.notifier = nil
+	if n := s.notifiers[c]; n != nil {
+		n.stop()
+		delete(s.notifiers, c)
+	}
+}
+
+func (s *Server) startIndicate(c *Characteristic, maxlen int) {
+	if s.indicators[c] != nil {
+		return
+	}
+	if s.indicators == nil {
+		s.indicators = make(map[*Characteristic]*notifier)
+	}
+	n := newIndicator(s.l2cap, c, maxlen)
+	s.indicators[c] = n
+	c.serveNotify(s.request(c), n)
+}
+
+func (s *Server) stopIndicate(c *Characteristic) {
+	if n := s.indicators[c]; n != nil {
+		n.stop()
+		delete(s.indicators, c)
+	}
 }
 
 func (s *Server) connected(addr net.HardwareAddr) {
 	s.connmu.Lock()
 	s.conn = newConn(s, BDAddr{addr})
+	if s.conns == nil {
+		s.conns = make(map[string]*conn)
+	}
+	s.conns[addr.String()] = s.conn
 	s.connmu.Unlock()
 	s.connmu.RLock()
 	defer s.connmu.RUnlock()
@@ -353,24 +1069,46 @@ func (s *Server) connected(addr net.HardwareAddr) {
 	}
 }
 
-func (s *Server) disconnected(hw net.HardwareAddr) {
-	// Stop all notifiers
-	// TODO: Clear all descriptor CCC values?
-	for _, svc := range s.services {
-		for _, char := range svc.chars {
-			if char.notifier != nil {
-				char.notifier.stop()
-				char.notifier = nil
-			}
-		}
-	}
+func (s *Server) switched(hw net.HardwareAddr) {
+	s.connmu.Lock()
+	s.conn = s.conns[hw.String()]
+	s.connmu.Unlock()
+}
 
-	if s.Disconnect != nil {
-		s.Disconnect(s.conn)
+func (s *Server) disconnected(hw net.HardwareAddr, reason DisconnectReason) {
+	// l2cap has already stopped the notifiers and indicators
+	// to which only this central was subscribed.
+	s.connmu.Lock()
+	c := s.conns[hw.String()]
+	if c != nil {
+		c.reason = reason
+	}
+	s.connmu.Unlock()
+	if s.Disconnect != nil && c != nil {
+		s.Disconnect(c)
 	}
 	s.connmu.Lock()
-	s.conn = nil
+	delete(s.conns, hw.String())
+	if s.conn == c {
+		s.conn = nil
+	}
+	shutdown := s.shutdown
 	s.connmu.Unlock()
+	if shutdown {
+		return
+	}
+	if err := s.startAdvertising(); err != nil {
+		s.close(err)
+	}
+}
+
+func (s *Server) transportReopened() {
+	s.connmu.RLock()
+	shutdown := s.shutdown
+	s.connmu.RUnlock()
+	if shutdown {
+		return
+	}
 	if err := s.startAdvertising(); err != nil {
 		s.close(err)
 	}
@@ -387,13 +1125,54 @@ func (s *Server) receivedRSSI(rssi int) {
 	}
 }
 
+func (s *Server) mtuChanged(mtu int) {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	if s.conn != nil && s.MTUChange != nil {
+		s.MTUChange(s.conn, mtu)
+	}
+}
+
+func (s *Server) phyUpdated(tx, rx PHY) {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	if s.conn != nil && s.PHYUpdate != nil {
+		s.PHYUpdate(s.conn, tx, rx)
+	}
+}
+
+func (s *Server) dataLengthChanged(tx, rx int) {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	if s.conn != nil && s.DataLengthChange != nil {
+		s.DataLengthChange(s.conn, tx, rx)
+	}
+}
+
+func (s *Server) securityChanged(level SecurityLevel) {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	if s.conn != nil && s.SecurityChange != nil {
+		s.SecurityChange(s.conn, level)
+	}
+}
+
+func (s *Server) setPHY(c *conn, tx, rx PHY) error {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	if s.conns[c.remoteAddr.String()] != c {
+		return errors.New("already disconnected")
+	}
+	return s.l2cap.setPHY(c.remoteAddr.HardwareAddr, tx, rx)
+}
+
 func (s *Server) disconnect(c *conn) error {
 	s.connmu.RLock()
 	defer s.connmu.RUnlock()
-	if s.conn != c {
+	if s.conns[c.remoteAddr.String()] != c {
 		return errors.New("already disconnected")
 	}
-	return c.server.l2cap.disconnect()
+	return s.l2cap.disconnectConn(c.remoteAddr.HardwareAddr)
 }
 
 type conn struct {
@@ -401,6 +1180,7 @@ type conn struct {
 	localAddr  BDAddr
 	remoteAddr BDAddr
 	rssi       int
+	reason     DisconnectReason // set once disconnected
 }
 
 func newConn(server *Server, addr BDAddr) *conn {
@@ -417,7 +1197,20 @@ func (c *conn) LocalAddr() BDAddr  { return c.localAddr }
 func (c *conn) RemoteAddr() BDAddr { return c.remoteAddr }
 func (c *conn) Close() error       { return c.server.disconnect(c) }
 func (c *conn) RSSI() int          { return c.rssi }
-func (c *conn) MTU() int           { return int(c.server.l2cap.mtu) }
+func (c *conn) MTU() int           { return int(c.server.l2cap.connMTU(c.remoteAddr.HardwareAddr)) }
+func (c *conn) DisconnectReason() DisconnectReason {
+	c.server.connmu.RLock()
+	defer c.server.connmu.RUnlock()
+	return c.reason
+}
+
+func (c *conn) DataLength() (tx, rx int) {
+	return c.server.l2cap.connDataLength(c.remoteAddr.HardwareAddr)
+}
+
+func (c *conn) SetPHY(tx, rx PHY) error {
+	return c.server.setPHY(c, tx, rx)
+}
 
 func (c *conn) UpdateRSSI() (rssi int, err error) {
 	// TODO
@@ -425,11 +1218,13 @@ func (c *conn) UpdateRSSI() (rssi int, err error) {
 }
 
 type notifier struct {
-	l2c    *l2cap
-	char   *Characteristic
-	maxlen int
-	donemu sync.RWMutex
-	done   bool
+	l2c      *l2cap
+	char     *Characteristic
+	maxlen   int
+	indicate bool // send indications, rather than notifications
+	donemu   sync.RWMutex
+	done     bool
+	stopped  chan struct{} // closed by stop
 	// This throttle prevents multiple subsequent notifications from
 	// stepping on each others' toes. This toe-stepping appears to
 	// happen at both the HCI and the link layer.
@@ -441,23 +1236,48 @@ func newNotifier(l2c *l2cap, c *Characteristic, maxlen int) *notifier {
 		l2c:      l2c,
 		char:     c,
 		maxlen:   maxlen,
+		stopped:  make(chan struct{}),
 		throttle: time.NewTicker(50 * time.Millisecond),
 	}
 }
 
+// newIndicator returns a notifier that sends indications,
+// each of which blocks until the central confirms it.
+func newIndicator(l2c *l2cap, c *Characteristic, maxlen int) *notifier {
+	n := newNotifier(l2c, c, maxlen)
+	n.indicate = true
+	return n
+}
+
 func (n *notifier) Write(data []byte) (int, error) {
 	if n.Done() {
 		return 0, errors.New("central stopped notifications")
 	}
 	<-n.throttle.C
-	if err := n.l2c.sendNotification(n.char, data); err != nil {
+	var err error
+	if n.indicate {
+		err = n.l2c.sendIndication(n.char, data)
+	} else {
+		_, err = n.l2c.sendNotification(n.char, data)
+	}
+	if err != nil {
 		return 0, err
 	}
 	return len(data), nil
 }
 
+// Cap returns the maximum notification length for the MTUs of the
+// subscribed centrals, which may have changed since they subscribed:
+// that of the central with the smallest MTU.
 func (n *notifier) Cap() int {
-	return n.maxlen
+	if n.l2c == nil {
+		return n.maxlen
+	}
+	flag := uint16(gattCCCNotifyFlag)
+	if n.indicate {
+		flag = gattCCCIndicateFlag
+	}
+	return int(n.l2c.subscriberMTU(n.char, flag)) - 3
 }
 
 func (n *notifier) Done() bool {
@@ -467,9 +1287,16 @@ func (n *notifier) Done() bool {
 	return done
 }
 
+func (n *notifier) Stopped() <-chan struct{} {
+	return n.stopped
+}
+
 func (n *notifier) stop() {
 	n.donemu.Lock()
-	n.done = true
+	if !n.done {
+		n.done = true
+		close(n.stopped)
+	}
 	n.donemu.Unlock()
 	n.throttle.Stop()
 }
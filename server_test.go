@@ -1,6 +1,14 @@
 package gatt
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestCleanHCIDevice(t *testing.T) {
 	cases := []struct {
@@ -23,3 +31,457 @@ func TestCleanHCIDevice(t *testing.T) {
 		}
 	}
 }
+
+func TestServerUnhandled(t *testing.T) {
+	c := &Characteristic{uuid: UUID16(0xfff1)}
+	c.HandleRead(nil)
+	c.HandleWrite(nil)
+
+	s := new(Server)
+	if _, status := s.readChar(c, nil, 20, 0); status != StatusReadNotPermitted {
+		t.Errorf("readChar without handlers: got status %#x want %#x", status, StatusReadNotPermitted)
+	}
+	if status := s.writeChar(c, nil, []byte("a"), false); status != StatusWriteNotPermitted {
+		t.Errorf("writeChar without handlers: got status %#x want %#x", status, StatusWriteNotPermitted)
+	}
+
+	var wrote *Characteristic
+	s.UnhandledRead = ReadHandlerFunc(func(resp ReadResponseWriter, req *ReadRequest) {
+		resp.Write([]byte("default"))
+	})
+	s.UnhandledWrite = WriteHandlerFunc(func(r Request, data []byte) byte {
+		wrote = r.Characteristic
+		return StatusSuccess
+	})
+	if data, status := s.readChar(c, nil, 20, 0); status != StatusSuccess || string(data) != "default" {
+		t.Errorf("readChar with UnhandledRead: got %q, %#x want %q, %#x", data, status, "default", StatusSuccess)
+	}
+	if status := s.writeChar(c, nil, []byte("a"), false); status != StatusSuccess || wrote != c {
+		t.Errorf("writeChar with UnhandledWrite: got %#x, %p want %#x, %p", status, wrote, StatusSuccess, c)
+	}
+}
+
+func TestPHYString(t *testing.T) {
+	cases := []struct {
+		p    PHY
+		want string
+	}{
+		{p: 0, want: "none"},
+		{p: PHY1M, want: "1M"},
+		{p: PHY2M | PHYCoded, want: "2M|Coded"},
+		{p: PHY1M | 0x10, want: "1M|0x10"},
+	}
+	for _, tt := range cases {
+		if got := tt.p.String(); got != tt.want {
+			t.Errorf("PHY(%#x).String(): got %q want %q", uint8(tt.p), got, tt.want)
+		}
+	}
+}
+
+func TestOwnAddressChange(t *testing.T) {
+	var changed []string
+	s := &Server{OwnAddressChange: func(addr BDAddr) {
+		changed = append(changed, addr.String())
+	}}
+	s.receivedBDAddr("01:02:03:04:05:06")
+	if got, want := s.OwnAddr().String(), "01:02:03:04:05:06"; got != want {
+		t.Errorf("OwnAddr after bdaddr: got %q want %q", got, want)
+	}
+	s.ownAddressChanged("4a:bb:cc:dd:ee:ff")
+	s.ownAddressChanged("not an address")
+	if got, want := s.OwnAddr().String(), "4a:bb:cc:dd:ee:ff"; got != want {
+		t.Errorf("OwnAddr after rotation: got %q want %q", got, want)
+	}
+	if want := []string{"4a:bb:cc:dd:ee:ff"}; fmt.Sprint(changed) != fmt.Sprint(want) {
+		t.Errorf("OwnAddressChange calls: got %v want %v", changed, want)
+	}
+}
+
+func TestOpenTransport(t *testing.T) {
+	errNoAdapter := errors.New("no adapter")
+	var opened []string
+	s := &Server{HCI: "hci1", OpenTransport: func(name, dev string) (Transport, error) {
+		opened = append(opened, name+" "+dev)
+		return nil, errNoAdapter
+	}}
+	if err := s.start(); err != errNoAdapter {
+		t.Errorf("start: got error %v want %v", err, errNoAdapter)
+	}
+	if want := []string{"hci-ble 1"}; fmt.Sprint(opened) != fmt.Sprint(want) {
+		t.Errorf("opened transports: got %q want %q", opened, want)
+	}
+}
+
+func TestServerMTU(t *testing.T) {
+	s := new(Server)
+	if mtu := s.MTU(); mtu != 23 {
+		t.Errorf("MTU before starting: got %d want 23", mtu)
+	}
+
+	l2c, shim := newTestL2cap()
+	l2c.setServices("", nil)
+	s.l2cap = l2c
+	go l2c.listenAndServe()
+
+	// MTU may be called concurrently with the eventloop.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.MTU()
+			}
+		}
+	}()
+	runRxTx(t, shim, []rxtx{
+		{name: "exchange mtu 185", send: "02b900", want: "03b900"},
+	})
+	close(stop)
+	<-done
+	if mtu := s.MTU(); mtu != 185 {
+		t.Errorf("MTU after exchange: got %d want 185", mtu)
+	}
+}
+
+func TestServerFeatures(t *testing.T) {
+	shim := &testL2CShim{readc: make(chan []byte), writec: make(chan []byte)}
+	s := &Server{ServerFeatures: gattServerFeatureEATT, OpenTransport: func(name, dev string) (Transport, error) {
+		if name == "hci-ble" {
+			hciShim := new(testshim)
+			hciShim.WriteString("adapterState poweredOn\n")
+			return hciShim, nil
+		}
+		return shim, nil
+	}}
+	if err := s.start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := s.l2cap.setServices("", nil); err != nil {
+		t.Fatal(err)
+	}
+	go s.l2cap.listenAndServe()
+	defer s.l2cap.close()
+
+	// 8: Server Supported Features value
+	runRxTx(t, shim, []rxtx{{name: "read 8 -- eatt", send: "0a0800", want: "0b01"}})
+}
+
+func TestShutdown(t *testing.T) {
+	s := new(Server)
+	svc := s.AddService(UUID16(0xfff0))
+	status := svc.AddCharacteristic(UUID16(0xfff1))
+	status.HandleIndicateFunc(func(r Request, n Notifier) {})
+
+	hciShim := new(testshim)
+	s.hci = newHCI(hciShim)
+	shim := &testL2CShim{readc: make(chan []byte), writec: make(chan []byte), cmdc: make(chan Command, 1)}
+	s.l2cap = newL2cap(shim, s)
+	s.quit = make(chan struct{})
+	if err := s.l2cap.setServices("", s.services); err != nil {
+		t.Fatal(err)
+	}
+	serverRunningMu.Lock()
+	serverRunning = true
+	serverRunningMu.Unlock()
+	go s.l2cap.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "subscribe, indicate", send: "120c000200", want: "13"},
+	})
+
+	go s.l2cap.sendIndication(status, []byte("a"))
+	runRxTx(t, shim, []rxtx{{name: "pending indication", want: "1d0b0061"}})
+
+	var confirmed bool
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background(), &IndicateItem{
+			Characteristic: status,
+			Value:          []byte("bye"),
+			Confirmed:      func() { confirmed = true },
+		})
+	}()
+
+	// The goodbye waits for the pending indication to be confirmed.
+	select {
+	case b := <-shim.writec:
+		t.Fatalf("sent %q before pending indication was confirmed", b)
+	case <-time.After(20 * time.Millisecond):
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "confirm pending indication", event: "data 1e"},
+		{name: "goodbye indication", want: "1d0b00627965"},
+	})
+	select {
+	case cmd := <-shim.cmdc:
+		t.Fatalf("got command %v before goodbye was confirmed", cmd)
+	case <-time.After(20 * time.Millisecond):
+	}
+	runRxTx(t, shim, []rxtx{{name: "confirm goodbye", event: "data 1e"}})
+
+	if cmd := <-shim.cmdc; cmd != CommandDisconnect {
+		t.Errorf("got command %v want %v", cmd, CommandDisconnect)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if !confirmed {
+		t.Errorf("goodbye not confirmed")
+	}
+	if serving() {
+		t.Errorf("still serving after Shutdown")
+	}
+
+	// The server does not advertise again once the central disconnects.
+	hw, _ := net.ParseMAC("01:02:03:04:05:06")
+	s.disconnected(hw, DisconnectRemoteUser)
+	if hciShim.Len() != 0 {
+		t.Errorf("advertised %q after Shutdown", hciShim.String())
+	}
+}
+
+func TestDumpHandles(t *testing.T) {
+	s := &Server{Name: "n"}
+	char := s.AddService(UUID16(0xaaaa)).AddCharacteristic(UUID16(0xfff1))
+	char.HandleReadFunc(func(resp ReadResponseWriter, req *ReadRequest) {})
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+
+	got := s.DumpHandles()
+	want := []HandleInfo{
+		{Handle: 1, Type: "service", UUID: gatAttrGAPUUID},
+		{Handle: 2, Type: "characteristic", UUID: gattAttrDeviceNameUUID, Properties: charRead},
+		{Handle: 3, Type: "characteristicValue", UUID: gattAttrDeviceNameUUID},
+		{Handle: 4, Type: "characteristic", UUID: gattAttrAppearanceUUID, Properties: charRead},
+		{Handle: 5, Type: "characteristicValue", UUID: gattAttrAppearanceUUID},
+		{Handle: 6, Type: "service", UUID: gatAttrGATTUUID},
+		{Handle: 7, Type: "characteristic", UUID: gattAttrServerSupportedFeaturesUUID, Properties: charRead},
+		{Handle: 8, Type: "characteristicValue", UUID: gattAttrServerSupportedFeaturesUUID},
+		{Handle: 9, Type: "service", UUID: UUID16(0xaaaa)},
+		{Handle: 10, Type: "characteristic", UUID: UUID16(0xfff1), Properties: charRead | charNotify},
+		{Handle: 11, Type: "characteristicValue", UUID: UUID16(0xfff1)},
+		{Handle: 12, Type: "descriptor", UUID: gattAttrClientCharacteristicConfigUUID, Properties: charRead | charWrite},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("DumpHandles: got %d handles want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if g, w := got[i], want[i]; g.Handle != w.Handle || g.Type != w.Type || !uuidEqual(g.UUID, w.UUID) || g.Properties != w.Properties {
+			t.Errorf("handle %d: got %+v want %+v", i+1, g, w)
+		}
+	}
+}
+
+func TestServerHandle(t *testing.T) {
+	svc := &Service{uuid: UUID16(0xfff0)}
+	a := svc.AddCharacteristic(UUID16(0xfff1))
+	a.HandleNotifyFunc(func(r Request, n Notifier) {})
+	b := svc.AddCharacteristic(UUID16(0xfff2))
+
+	// Servers sharing svc number it in their own tables.
+	s1 := &Server{services: []*Service{svc}}
+	s2 := &Server{services: []*Service{svc}, ServiceChanged: true}
+
+	// s1: fff0 [9,14]: 10: a, 11: a value, 12: a ccc, 13: b, 14: b value
+	if na, nb := s1.Handle(a), s1.Handle(b); na != 11 || nb != 14 {
+		t.Errorf("s1 handles: got %d, %d want 11, 14", na, nb)
+	}
+	if start, end := s1.HandleRange(svc); start != 9 || end != 14 {
+		t.Errorf("s1 range: got [%d,%d] want [9,14]", start, end)
+	}
+	// s2 has a Service Changed characteristic, so fff0 is [12,17].
+	if na, nb := s2.Handle(a), s2.Handle(b); na != 14 || nb != 17 {
+		t.Errorf("s2 handles: got %d, %d want 14, 17", na, nb)
+	}
+	if start, end := s2.HandleRange(svc); start != 12 || end != 17 {
+		t.Errorf("s2 range: got [%d,%d] want [12,17]", start, end)
+	}
+
+	other := &Service{uuid: UUID16(0xffe0)}
+	if n := s1.Handle(other.AddCharacteristic(UUID16(0xffe1))); n != 0 {
+		t.Errorf("handle of unserved characteristic: got %d want 0", n)
+	}
+	if start, end := s1.HandleRange(other); start != 0 || end != 0 {
+		t.Errorf("range of unserved service: got [%d,%d] want [0,0]", start, end)
+	}
+}
+
+func TestConnDisconnectReason(t *testing.T) {
+	var got []DisconnectReason
+	s := &Server{shutdown: true} // don't advertise after disconnecting
+	s.Disconnect = func(c Conn) { got = append(got, c.DisconnectReason()) }
+
+	hw, _ := net.ParseMAC("01:02:03:04:05:06")
+	s.connected(hw)
+	if reason := s.conn.DisconnectReason(); reason != DisconnectUnknown {
+		t.Errorf("reason while connected: got %v want %v", reason, DisconnectUnknown)
+	}
+	s.disconnected(hw, DisconnectTimeout)
+	s.connected(hw)
+	s.disconnected(hw, DisconnectUnknown)
+	if want := []DisconnectReason{DisconnectTimeout, DisconnectUnknown}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("reasons: got %v want %v", got, want)
+	}
+}
+
+func TestNotifierStopped(t *testing.T) {
+	s := &Server{shutdown: true} // don't advertise after disconnecting
+	nc := make(chan Notifier, 1)
+	exited := make(chan struct{})
+	svc := &Service{uuid: UUID16(0xfff0)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleNotifyFunc(func(r Request, n Notifier) {
+		nc <- n
+		go func() {
+			<-n.Stopped()
+			close(exited)
+		}()
+	})
+	shim := &testL2CShim{readc: make(chan []byte), writec: make(chan []byte)}
+	s.l2cap = newL2cap(shim, s)
+	s.l2cap.setServices("", []*Service{svc})
+	go s.l2cap.listenAndServe()
+
+	runRxTx(t, shim, []rxtx{
+		{name: "connect", event: "accept 01:02:03:04:05:06"},
+		{name: "subscribe", send: "120c000100", want: "13"},
+	})
+	n := <-nc
+	if got := n.Cap(); got != 20 {
+		t.Errorf("Cap at mtu 23: got %d want 20", got)
+	}
+	runRxTx(t, shim, []rxtx{{name: "exchange mtu 185", send: "02b900", want: "03b900"}})
+	if got := n.Cap(); got != 182 {
+		t.Errorf("Cap at mtu 185: got %d want 182", got)
+	}
+	select {
+	case <-exited:
+		t.Fatal("notifier stopped while subscribed")
+	default:
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "disconnect", event: "disconnect 01:02:03:04:05:06"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("notifier not stopped after disconnecting")
+	}
+	if !n.Done() {
+		t.Errorf("Done after disconnecting: got false want true")
+	}
+}
+
+func TestCentrals(t *testing.T) {
+	s := &Server{shutdown: true} // don't advertise after disconnecting
+	if got := s.Centrals(); len(got) != 0 {
+		t.Errorf("Centrals before connecting: got %v want none", got)
+	}
+
+	a, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	b, _ := net.ParseMAC("01:02:03:04:05:06")
+	s.connected(a)
+	s.connected(b)
+	if got, want := fmt.Sprint(s.Centrals()), "[01:02:03:04:05:06 0a:0b:0c:0d:0e:0f]"; got != want {
+		t.Errorf("Centrals with a and b connected: got %v want %v", got, want)
+	}
+	s.disconnected(b, DisconnectRemoteUser)
+	if got, want := fmt.Sprint(s.Centrals()), "[0a:0b:0c:0d:0e:0f]"; got != want {
+		t.Errorf("Centrals after b disconnected: got %v want %v", got, want)
+	}
+	s.disconnected(a, DisconnectRemoteUser)
+	if got := s.Centrals(); len(got) != 0 {
+		t.Errorf("Centrals after disconnecting: got %v want none", got)
+	}
+}
+
+func TestAuthorizeConn(t *testing.T) {
+	s := &Server{shutdown: true} // don't advertise after disconnecting
+	char := &Characteristic{uuid: UUID16(0xfff1)}
+	var got []string
+	s.AuthorizeRead = func(c Conn, char *Characteristic) bool {
+		got = append(got, "read "+c.RemoteAddr().String())
+		return true
+	}
+	s.AuthorizeWrite = func(c Conn, char *Characteristic) bool {
+		got = append(got, "write "+c.RemoteAddr().String())
+		return false
+	}
+
+	a, _ := net.ParseMAC("01:02:03:04:05:06")
+	b, _ := net.ParseMAC("0a:0b:0c:0d:0e:0f")
+	s.connected(a)
+	s.connected(b) // b is current
+
+	// The authorizer sees the central that made the request.
+	if !s.authorizeRead(char, a) {
+		t.Errorf("authorizeRead for a: got false want true")
+	}
+	if s.authorizeWrite(char, a) {
+		t.Errorf("authorizeWrite for a: got true want false")
+	}
+	s.authorizeRead(char, b)
+	if want := []string{"read 01:02:03:04:05:06", "write 01:02:03:04:05:06", "read 0a:0b:0c:0d:0e:0f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("authorized: got %v want %v", got, want)
+	}
+
+	s.disconnected(a, DisconnectRemoteUser)
+	if s.authorizeRead(char, a) {
+		t.Errorf("authorizeRead for disconnected a: got true want false")
+	}
+}
+
+func TestConnTargets(t *testing.T) {
+	s := &Server{shutdown: true} // don't advertise after disconnecting
+	conns := make(map[string]Conn)
+	s.Connect = func(c Conn) { conns[c.RemoteAddr().String()] = c }
+	shim := &testL2CShim{readc: make(chan []byte), writec: make(chan []byte)}
+	s.l2cap = newL2cap(shim, s)
+	s.l2cap.setServices("", nil)
+	go s.l2cap.listenAndServe()
+
+	// b is current, and has a longer data length than a.
+	runRxTx(t, shim, []rxtx{
+		{name: "supports 1M, 2M", event: "phys 3"},
+		{name: "connect a", event: "accept 01:02:03:04:05:06"},
+		{name: "connect b", event: "accept 0a:0b:0c:0d:0e:0f"},
+		{name: "b: data length 251 251", event: "datalen 251 251"},
+		{name: "b: sync -- target b", send: "021700", want: "conn 0a:0b:0c:0d:0e:0f"},
+		{name: "b: sync", want: "031700"},
+	})
+	a, b := conns["01:02:03:04:05:06"], conns["0a:0b:0c:0d:0e:0f"]
+	if tx, rx := a.DataLength(); tx != 27 || rx != 27 {
+		t.Errorf("a.DataLength: got %d, %d want 27, 27", tx, rx)
+	}
+	if tx, rx := b.DataLength(); tx != 251 || rx != 251 {
+		t.Errorf("b.DataLength: got %d, %d want 251, 251", tx, rx)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- a.SetPHY(PHY2M, PHY2M) }()
+	runRxTx(t, shim, []rxtx{{name: "a.SetPHY", want: "phy 01:02:03:04:05:06 2 2"}})
+	if err := <-errc; err != nil {
+		t.Errorf("a.SetPHY: %v", err)
+	}
+	go func() { errc <- a.Close() }()
+	runRxTx(t, shim, []rxtx{{name: "a.Close", want: "disconnect 01:02:03:04:05:06"}})
+	if err := <-errc; err != nil {
+		t.Errorf("a.Close: %v", err)
+	}
+
+	runRxTx(t, shim, []rxtx{
+		{name: "a disconnected", event: "disconnect 01:02:03:04:05:06"},
+		{name: "sync", send: "021700", want: "031700"},
+	})
+	if err := a.SetPHY(PHY2M, PHY2M); err == nil {
+		t.Errorf("a.SetPHY after disconnecting: got nil error")
+	}
+	if err := a.Close(); err == nil {
+		t.Errorf("a.Close after disconnecting: got nil error")
+	}
+}
@@ -1,24 +1,20 @@
 package gatt
 
+import "fmt"
+
 // A Service is a BLE service.
 // Calls to AddCharacteristic must occur before the
 // service is used by a server.
 type Service struct {
-	uuid  UUID
-	chars []*Characteristic
+	uuid     UUID
+	includes []*Service
+	chars    []*Characteristic
 }
 
 // AddCharacteristic adds a characteristic to a service.
-// AddCharacteristic panics if the service already contains
-// another characteristic with the same UUID.
+// A service may contain several characteristics with the same
+// UUID, though that is often a mistake; see Server.StrictServices.
 func (s *Service) AddCharacteristic(u UUID) *Characteristic {
-	// TODO: write test for this panic
-	for _, char := range s.chars {
-		if uuidEqual(char.uuid, u) {
-			panic("service already contains a characteristic with uuid " + u.String())
-		}
-	}
-
 	char := &Characteristic{
 		service: s,
 		uuid:    u,
@@ -27,6 +23,15 @@ func (s *Service) AddCharacteristic(u UUID) *Characteristic {
 	return char
 }
 
+// AddIncludedService makes s include inc, which lets centrals that
+// discover s find inc, as from a profile that builds on another
+// service. inc must also be served by any server that serves s.
+// Calls to AddIncludedService must occur before the service is
+// used by a server.
+func (s *Service) AddIncludedService(inc *Service) {
+	s.includes = append(s.includes, inc)
+}
+
 func (s *Service) generateHandles(n uint16) (uint16, []handle) {
 	h := handle{
 		typ:    "service",
@@ -38,6 +43,20 @@ func (s *Service) generateHandles(n uint16) (uint16, []handle) {
 	}
 	handles := []handle{h}
 
+	// Include declarations come first. Their values, which hold
+	// the included services' handle ranges, are set once all
+	// services have handles; see generateHandles.
+	for _, inc := range s.includes {
+		n++
+		handles = append(handles, handle{
+			typ:   "include",
+			n:     n,
+			uuid:  inc.uuid,
+			attr:  inc,
+			props: charRead,
+		})
+	}
+
 	for _, char := range s.chars {
 		n++
 		var hh []handle
@@ -54,3 +73,18 @@ func (s *Service) generateHandles(n uint16) (uint16, []handle) {
 func (s *Service) UUID() UUID {
 	return s.uuid
 }
+
+// uniqueCharUUIDs returns an error if any of svcs
+// has several characteristics with the same UUID.
+func uniqueCharUUIDs(svcs []*Service) error {
+	for _, svc := range svcs {
+		for i, a := range svc.chars {
+			for _, b := range svc.chars[:i] {
+				if uuidEqual(a.uuid, b.uuid) {
+					return fmt.Errorf("service %v has several characteristics with UUID %v", svc.uuid, a.uuid)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -1,45 +1,79 @@
 package gatt
 
 import (
+	"fmt"
 	"io"
-	"os"
-	"os/exec"
 )
 
-// A shim provides mediated access to BLE.
-type shim interface {
+// A Transport provides mediated access to BLE. A Server uses two
+// transports: an hci transport, which reports the adapter state and
+// accepts advertising packets, and an l2cap transport, which carries
+// the ATT traffic of connected centrals. By default, both are shims,
+// external executables started via NewShimTransport; supply another
+// Transport, e.g. a TCP bridge to a remote adapter or a simulator,
+// via Server.OpenTransport.
+//
+// Both directions are framed as newline-terminated lines of text.
+//
+// The hci transport reports events such as "adapterState poweredOn"
+// and "hciDeviceId 0", and accepts lines of the form
+// "<adv hex> <scan hex>" to start advertising.
+//
+// The l2cap transport reports events such as "accept <addr>",
+// "data <hex>", "rssi <n>", "security <level>", "bdaddr <addr>",
+// "mtu <n>", "phy <tx> <rx>", "datalen <tx> <rx>" and
+// "disconnect <addr> [<reason hex>]".
+// It accepts lines of the form "<hex>", which send an ATT PDU to the
+// connected central, "phy <addr> <tx> <rx>", which request a PHY update
+// for the central at addr, and "disconnect <addr>", which disconnects
+// just the central at addr.
+// A transport that serves several centrals at once reports
+// "conn <addr>" before events that concern a central other than the
+// one most recently accepted or named. In the other direction, PDUs
+// are sent to the central named by the last "conn <addr>" line that
+// the transport accepted. Until one is named, and once the named
+// central disconnects, PDUs are sent to the next central accepted.
+// Transports that serve one central at a time may ignore "conn" lines.
+//
+// Control delivers out-of-band requests, such as CommandDisconnect,
+// to the l2cap transport, which maps them to its native mechanism.
+// Control must return an error for commands that the transport does
+// not support. Close stops the transport, after which Read must fail;
+// Wait waits for it to stop.
+type Transport interface {
 	io.ReadWriteCloser
-	Signal(os.Signal) error
+	Control(cmd Command) error
 	Wait() error
 }
 
-// cshim provides access to BLE via an external c executable.
-type cshim struct {
-	cmd *exec.Cmd
-	io.Reader
-	io.Writer
+// A Command is an out-of-band request to a Transport.
+type Command int
+
+// Commands. More may be added; transports must reject those
+// that they do not know.
+const (
+	CommandDisconnect Command = iota + 1 // disconnect the connected central
+	CommandUpdateRSSI                    // report the RSSI of the connection, as an "rssi" event
+)
+
+var commandNames = map[Command]string{
+	CommandDisconnect: "disconnect",
+	CommandUpdateRSSI: "update RSSI",
 }
 
-// newCShim starts the shim named file using the provided args.
-func newCShim(file string, arg ...string) (shim, error) {
-	c := new(cshim)
-	var err error
-	if file, err = exec.LookPath(file); err != nil {
-		return nil, err
-	}
-	c.cmd = exec.Command(file, arg...)
-	if c.Writer, err = c.cmd.StdinPipe(); err != nil {
-		return nil, err
+func (cmd Command) String() string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
 	}
-	if c.Reader, err = c.cmd.StdoutPipe(); err != nil {
-		return nil, err
-	}
-	if err = c.cmd.Start(); err != nil {
-		return nil, err
-	}
-	return c, err
+	return fmt.Sprintf("Command(%d)", int(cmd))
 }
 
-func (c *cshim) Wait() error                { return c.cmd.Wait() }
-func (c *cshim) Close() error               { return c.cmd.Process.Kill() }
-func (c *cshim) Signal(sig os.Signal) error { return c.cmd.Process.Signal(sig) }
+// NewShimTransport starts the shim executable named file, such as
+// "hci-ble" or "l2cap-ble", using the provided args, and returns a
+// Transport that communicates with it via its stdin and stdout.
+// Shims are only available on Linux, with BlueZ; elsewhere,
+// NewShimTransport fails, and a Transport must be supplied via
+// Server.OpenTransport.
+func NewShimTransport(file string, arg ...string) (Transport, error) {
+	return newShim(file, arg...)
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package gatt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// newShim starts the shim named file using the provided args.
+// On Linux, the shims are the c executables that talk to BlueZ.
+func newShim(file string, arg ...string) (Transport, error) {
+	return newCShim(file, arg...)
+}
+
+// shimSignals are the signals by which the shims receive commands.
+var shimSignals = map[Command]os.Signal{
+	CommandDisconnect: syscall.SIGHUP,
+	CommandUpdateRSSI: syscall.SIGUSR1,
+}
+
+// cshim provides access to BLE via an external c executable.
+type cshim struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.Writer
+}
+
+// newCShim starts the shim named file using the provided args.
+func newCShim(file string, arg ...string) (Transport, error) {
+	c := new(cshim)
+	var err error
+	if file, err = exec.LookPath(file); err != nil {
+		return nil, err
+	}
+	c.cmd = exec.Command(file, arg...)
+	if c.Writer, err = c.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if c.Reader, err = c.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err = c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return c, err
+}
+
+func (c *cshim) Wait() error  { return c.cmd.Wait() }
+func (c *cshim) Close() error { return c.cmd.Process.Kill() }
+
+func (c *cshim) Control(cmd Command) error {
+	sig, ok := shimSignals[cmd]
+	if !ok {
+		return fmt.Errorf("unsupported command %v", cmd)
+	}
+	return c.cmd.Process.Signal(sig)
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package gatt
+
+import "testing"
+
+func TestShimMissing(t *testing.T) {
+	if _, err := NewShimTransport("gatt-no-such-shim"); err == nil {
+		t.Errorf("NewShimTransport of a missing executable: got nil error")
+	}
+}
+
+func TestShimControl(t *testing.T) {
+	shim, err := NewShimTransport("cat")
+	if err != nil {
+		t.Skipf("cat: %v", err)
+	}
+	defer shim.Wait()
+	defer shim.Close()
+	if err := shim.Control(Command(0)); err == nil {
+		t.Errorf("Control of an unknown command: got nil error")
+	}
+}
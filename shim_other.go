@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package gatt
+
+import (
+	"errors"
+	"runtime"
+)
+
+// newShim fails: the shims require BlueZ, so elsewhere, such as
+// on darwin, a Transport must be supplied via Server.OpenTransport.
+func newShim(file string, arg ...string) (Transport, error) {
+	return nil, errors.New("gatt: shim " + file + " is not supported on " + runtime.GOOS)
+}
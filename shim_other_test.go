@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package gatt
+
+import "testing"
+
+func TestShimUnsupported(t *testing.T) {
+	if _, err := NewShimTransport("l2cap-ble"); err == nil {
+		t.Errorf("NewShimTransport: got nil error, want unsupported")
+	}
+	s := new(Server)
+	if err := s.start(); err == nil {
+		t.Errorf("start without OpenTransport: got nil error, want unsupported")
+	}
+}
@@ -0,0 +1,105 @@
+package gatt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A Value is a characteristic value backed by a Go value, such as a
+// uint16, a fixed-size array, or a struct of fixed-size fields. It is
+// a ReadHandler and a WriteHandler that encode and decode the Go value
+// in little-endian byte order, as by encoding/binary, which suits the
+// many numeric characteristics. Use it with Characteristic.HandleValue,
+// or with HandleRead and HandleWrite for a read- or write-only value.
+//
+// Writes must supply exactly the encoded size of the value; other
+// lengths fail with StatusInvalidValueLength. Use the raw handlers
+// for values that need other encodings.
+type Value struct {
+	// Changed is an optional callback function that will be called,
+	// with the Value unlocked, after a central writes the value.
+	// Changed must be set, if at all, before the Value is in use.
+	Changed func(r Request)
+
+	mu   sync.Mutex
+	ptr  interface{}
+	size int
+}
+
+// NewValue returns a Value backed by the value pointed to by ptr.
+// NewValue panics if ptr is not a pointer to a fixed-size value.
+// Once the Value is in use, access *ptr only between calls to
+// Lock and Unlock.
+func NewValue(ptr interface{}) *Value {
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("gatt: NewValue of non-pointer %T", ptr))
+	}
+	size := binary.Size(ptr)
+	if size < 0 || rv.Elem().Kind() == reflect.Slice {
+		panic(fmt.Sprintf("gatt: NewValue of %T, which has no fixed size", ptr))
+	}
+	return &Value{ptr: ptr, size: size}
+}
+
+// Lock locks v, so that its Go value may be accessed.
+func (v *Value) Lock() { v.mu.Lock() }
+
+// Unlock unlocks v.
+func (v *Value) Unlock() { v.mu.Unlock() }
+
+// Bytes returns the encoding of v's Go value.
+func (v *Value) Bytes() []byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.bytes()
+}
+
+// bytes returns the encoding of v's Go value. v.mu must be held.
+func (v *Value) bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, v.ptr) // cannot fail; checked by NewValue
+	return buf.Bytes()
+}
+
+// ServeRead serves the encoding of v's Go value.
+func (v *Value) ServeRead(resp ReadResponseWriter, req *ReadRequest) {
+	b := v.Bytes()
+	if req.Offset > len(b) {
+		resp.SetStatus(StatusInvalidOffset)
+		return
+	}
+	b = b[req.Offset:]
+	if len(b) > req.Cap {
+		b = b[:req.Cap]
+	}
+	resp.Write(b)
+}
+
+// ServeWrite decodes data into v's Go value.
+func (v *Value) ServeWrite(r Request, data []byte) (status byte) {
+	if len(data) != v.size {
+		return StatusInvalidValueLength
+	}
+	v.mu.Lock()
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, v.ptr)
+	v.mu.Unlock()
+	if err != nil {
+		return StatusUnexpectedError
+	}
+	if v.Changed != nil {
+		v.Changed(r)
+	}
+	return StatusSuccess
+}
+
+// HandleValue makes the characteristic support read and write
+// requests of v, calling HandleRead(v) and HandleWrite(v).
+// HandleValue must be called before any server using c has been started.
+func (c *Characteristic) HandleValue(v *Value) {
+	c.HandleRead(v)
+	c.HandleWrite(v)
+}
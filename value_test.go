@@ -0,0 +1,58 @@
+package gatt
+
+import "testing"
+
+func TestValue(t *testing.T) {
+	level := uint16(0x1234)
+	v := NewValue(&level)
+	var changed int
+	v.Changed = func(r Request) { changed++ }
+
+	l2c, shim := newTestL2cap()
+	svc := &Service{uuid: UUID16(0xaaaa)}
+	svc.AddCharacteristic(UUID16(0xfff1)).HandleValue(v)
+	l2c.setServices("", []*Service{svc})
+	go l2c.listenAndServe()
+
+	// 11: fff1 value
+	runRxTx(t, shim, []rxtx{
+		{name: "read 11", send: "0a0b00", want: "0b3412"},
+		{name: "read blob 11 offset 1", send: "0c0b000100", want: "0d12"},
+		{name: "read blob 11 offset 3 -- invalid", send: "0c0b000300", want: "010c0b0007"},
+		{name: "write 11 0xbeef", send: "120b00efbe", want: "13"},
+		{name: "write 11 3 bytes -- invalid length", send: "120b00010203", want: "01120b000d"},
+	})
+
+	v.Lock()
+	got := level
+	level = 0x0102
+	v.Unlock()
+	if got != 0xbeef {
+		t.Errorf("value after write: got %#04x want 0xbeef", got)
+	}
+	if changed != 1 {
+		t.Errorf("Changed calls: got %d want 1", changed)
+	}
+	runRxTx(t, shim, []rxtx{
+		{name: "read 11 after update", send: "0a0b00", want: "0b0201"},
+	})
+
+	type reading struct {
+		Temp  int16
+		Flags uint8
+	}
+	if b := NewValue(&reading{Temp: -2, Flags: 1}).Bytes(); string(b) != "\xfe\xff\x01" {
+		t.Errorf("struct value: got %x want feff01", b)
+	}
+
+	for _, bad := range []interface{}{level, new([]byte), new(string)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewValue(%T): did not panic", bad)
+				}
+			}()
+			NewValue(bad)
+		}()
+	}
+}